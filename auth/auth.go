@@ -7,12 +7,19 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-const jwtSecretKey = "secret"
 const issuer = "muzz"
 
+// DefaultAccessTokenTTL is how long an access token is valid for, refresh tokens are used to get a new one
+const DefaultAccessTokenTTL = time.Minute * 15
+
+// mfaPendingTokenTTL is how long the user has to enter their two factor code after entering their password
+const mfaPendingTokenTTL = time.Minute * 5
+
 // JWTClaims represents JWT claims
 type JWTClaims struct {
 	UserID int `json:"user_id"`
+	// MFAPending tokens only prove the password was correct, they can only be exchanged for a full token with a two factor code
+	MFAPending bool `json:"mfa_pending,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -30,6 +37,12 @@ type tokenAuthenticatorOption func(*tokenAuthenticator)
 
 // handles creating and retrieving tokens
 type tokenAuthenticator struct {
+	// keys used to sign and verify tokens
+	keys *KeySet
+
+	// how long the generated access tokens are valid for
+	accessTokenTTL time.Duration
+
 	// timeFunc is used to supply the current time that is needed for
 	// token validation. If unspecified, this defaults to time.Now.
 	timeFunc func() time.Time
@@ -42,10 +55,17 @@ func WithTimeFunc(timeFunc func() time.Time) tokenAuthenticatorOption {
 	}
 }
 
-// Handles creating and retrieving tokens
+// Sets how long generated access tokens are valid for
+func WithAccessTokenTTL(ttl time.Duration) tokenAuthenticatorOption {
+	return func(t *tokenAuthenticator) {
+		t.accessTokenTTL = ttl
+	}
+}
+
+// Handles creating and retrieving tokens, tokens are signed with the active key in the key set
 // Pass in some optional function options to modify the behaviour of the token auth
-func NewTokenAuthenticator(options ...tokenAuthenticatorOption) *tokenAuthenticator {
-	t := &tokenAuthenticator{}
+func NewTokenAuthenticator(keys *KeySet, options ...tokenAuthenticatorOption) *tokenAuthenticator {
+	t := &tokenAuthenticator{keys: keys, accessTokenTTL: DefaultAccessTokenTTL}
 
 	for _, option := range options {
 		option(t)
@@ -55,6 +75,15 @@ func NewTokenAuthenticator(options ...tokenAuthenticatorOption) *tokenAuthentica
 
 // generates a JWT token with the given user ID
 func (t *tokenAuthenticator) GenerateJWTToken(userID int) (string, error) {
+	return t.generateToken(userID, t.accessTokenTTL, false)
+}
+
+// generates a short lived token for a user who has entered their password but still needs to enter their two factor code
+func (t *tokenAuthenticator) GenerateMFAPendingToken(userID int) (string, error) {
+	return t.generateToken(userID, mfaPendingTokenTTL, true)
+}
+
+func (t *tokenAuthenticator) generateToken(userID int, ttl time.Duration, mfaPending bool) (string, error) {
 
 	var now time.Time
 
@@ -65,38 +94,91 @@ func (t *tokenAuthenticator) GenerateJWTToken(userID int) (string, error) {
 		now = time.Now()
 	}
 
+	// unique ID so the token can be revoked
+	jti, _, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
 	claims := JWTClaims{
-		UserID: userID,
+		UserID:     userID,
+		MFAPending: mfaPending,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    issuer,
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour * 24)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecretKey))
+	key := t.keys.activeKey()
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signingKey())
 }
 
 var (
 	errNoJWTToken         = errors.New("no jwt token given")
 	errNoUserIDFoundOnJWT = errors.New("no user ID on JWT token")
+	errMFAPending         = errors.New("two factor authentication hasn't been completed")
+	errNotMFAPending      = errors.New("token isn't waiting for two factor authentication")
 )
 
 // gets the claims from the JWT token
+// the token must be signed by a key in the key set which hasn't been retired
 // claims are checked for their validity otherwise an error is returned
+// tokens which are still waiting for a two factor code are rejected
 func (t *tokenAuthenticator) ExtractClaimsFromToken(tokenString string) (*JWTClaims, error) {
+	claims, err := t.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.MFAPending {
+		return nil, errMFAPending
+	}
+
+	return claims, nil
+}
+
+// gets the claims from a token returned by login for a user who still needs to enter their two factor code
+func (t *tokenAuthenticator) ExtractMFAPendingClaims(tokenString string) (*JWTClaims, error) {
+	claims, err := t.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.MFAPending {
+		return nil, errNotMFAPending
+	}
+
+	return claims, nil
+}
+
+func (t *tokenAuthenticator) parseToken(tokenString string) (*JWTClaims, error) {
 
 	if tokenString == "" {
 		return nil, errNoJWTToken
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
+		keyID, ok := token.Header["kid"].(string)
+		if !ok || keyID == "" {
+			return nil, errNoKeyIDOnJWT
+		}
+
+		key, err := t.keys.verificationKey(keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		// the algorithm is pinned to the key, otherwise a public key could be used as a HMAC secret
+		if token.Method.Alg() != key.method().Alg() {
+			return nil, errWrongSigningMethod
 		}
-		return []byte(jwtSecretKey), nil
+		return key.verifyingKey(), nil
 	})
 	if err != nil || !token.Valid {
 		return nil, err
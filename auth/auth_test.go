@@ -10,9 +10,10 @@ import (
 
 func TestGenerateJWTToken(t *testing.T) {
 	userID := 123
-	expectedExpiration := time.Now().Add(time.Hour * 24).Unix()
+	expectedExpiration := time.Now().Add(DefaultAccessTokenTTL).Unix()
 
-	tokenAuth := NewTokenAuthenticator()
+	keys := newTestKeySet(t)
+	tokenAuth := NewTokenAuthenticator(keys)
 	tokenString, err := tokenAuth.GenerateJWTToken(userID)
 	if err != nil {
 		t.Fatalf("Error generating JWT token: %v", err)
@@ -22,12 +23,16 @@ func TestGenerateJWTToken(t *testing.T) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, jwt.ErrSignatureInvalid
 		}
-		return []byte(jwtSecretKey), nil
+		return keys.activeKey().Secret, nil
 	})
 	if err != nil || !token.Valid {
 		t.Fatalf("Error parsing JWT token: %v", err)
 	}
 
+	if kid := token.Header["kid"]; kid != testActiveKeyID {
+		t.Errorf("Expected kid %s, got %v", testActiveKeyID, kid)
+	}
+
 	claims, ok := token.Claims.(*JWTClaims)
 	if !ok {
 		t.Fatal("Invalid token claims")
@@ -41,33 +46,68 @@ func TestGenerateJWTToken(t *testing.T) {
 		t.Errorf("Expected expiration time %d, got %v", expectedExpiration, claims.ExpiresAt)
 	}
 
+	if claims.ID == "" {
+		t.Error("Expected a jti claim so the token can be revoked")
+	}
+
 	if claims.Issuer != issuer {
 		t.Errorf("invalid issuer: %s, got: %s", "muzz", claims.Issuer)
 	}
 
 }
 
+const (
+	testActiveKeyID  = "active"
+	testOldKeyID     = "old"
+	testRetiredKeyID = "retired"
+)
+
+var (
+	testActiveSecret  = []byte("active-secret-which-is-at-least-32-bytes")
+	testOldSecret     = []byte("old-secret-which-is-also-at-least-32-bytes")
+	testRetiredSecret = []byte("retired-secret-which-is-at-least-32-bytes")
+)
+
+// key set with an active key, an older key which is still accepted and a retired key
+func newTestKeySet(t *testing.T) *KeySet {
+	t.Helper()
+	keys, err := NewKeySet(testActiveKeyID,
+		SigningKey{ID: testActiveKeyID, Secret: testActiveSecret},
+		SigningKey{ID: testOldKeyID, Secret: testOldSecret},
+		SigningKey{ID: testRetiredKeyID, Secret: testRetiredSecret, Retired: true},
+	)
+	if err != nil {
+		t.Fatal("failed to create key set", err)
+	}
+	return keys
+}
+
+// signs the claims with the given key ID and secret
+func signToken(claims jwt.Claims, keyID string, secret []byte) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if keyID != "" {
+		token.Header["kid"] = keyID
+	}
+	tokenString, _ := token.SignedString(secret)
+	return tokenString
+}
+
 // for testing invalid tokens
 func generateInValidToken(withClaims bool) string {
-	token := jwt.New(jwt.SigningMethodHS256)
+	var claims jwt.Claims = jwt.MapClaims{}
 	if withClaims {
-		token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"foo": "bar"})
+		claims = jwt.MapClaims{"foo": "bar"}
 	}
-	tokenString, _ := token.SignedString([]byte(jwtSecretKey))
-	return tokenString
+	return signToken(claims, testActiveKeyID, testActiveSecret)
 }
 
 func generateJWTWithNoUserID() string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{})
-	tokenString, _ := token.SignedString([]byte(jwtSecretKey))
-
-	return tokenString
-
+	return signToken(JWTClaims{}, testActiveKeyID, testActiveSecret)
 }
 
 func TestExtractClaimsFromToken(t *testing.T) {
 
-	tokenAuth := NewTokenAuthenticator()
+	tokenAuth := NewTokenAuthenticator(newTestKeySet(t))
 	userID := 1
 	happyJWT, err := tokenAuth.GenerateJWTToken(userID)
 	if err != nil {
@@ -97,6 +137,36 @@ func TestExtractClaimsFromToken(t *testing.T) {
 			expectedUserID: 0,
 			expectedErr:    errNoUserIDFoundOnJWT,
 		},
+		{
+			name:           "Invalid no kid given on token",
+			token:          signToken(JWTClaims{UserID: userID}, "", testActiveSecret),
+			expectedUserID: 0,
+			expectedErr:    errNoKeyIDOnJWT,
+		},
+		{
+			name:           "Invalid token signed with an unknown key",
+			token:          signToken(JWTClaims{UserID: userID}, "unknown", testActiveSecret),
+			expectedUserID: 0,
+			expectedErr:    errUnknownKeyID,
+		},
+		{
+			name:           "Invalid token signed with a retired key",
+			token:          signToken(JWTClaims{UserID: userID}, testRetiredKeyID, testRetiredSecret),
+			expectedUserID: 0,
+			expectedErr:    errRetiredKeyID,
+		},
+		{
+			name:           "Invalid kid doesn't match the signing secret",
+			token:          signToken(JWTClaims{UserID: userID}, testOldKeyID, testActiveSecret),
+			expectedUserID: 0,
+			expectedErr:    jwt.ErrSignatureInvalid,
+		},
+		{
+			name:           "Valid token signed with an older key that hasn't been retired",
+			token:          signToken(JWTClaims{UserID: userID}, testOldKeyID, testOldSecret),
+			expectedUserID: userID,
+			expectedErr:    nil,
+		},
 		{
 			name:           "Valid token in request header",
 			token:          happyJWT,
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"muzz/httpresponse"
+	"muzz/mailer"
+	"muzz/user"
+	"net/http"
+	"time"
+)
+
+// DefaultEmailVerificationTTL is how long an email verification link can be used for
+const DefaultEmailVerificationTTL = time.Hour * 24
+
+// EmailVerifications emails users a one time link to prove they own their email address
+type EmailVerifications struct {
+	tokens oneTimeTokens
+	mailer mailer.Mailer
+	// the link emailed to the user, the token is added as the `token` query param
+	verifyURL string
+}
+
+// Creates email verifications whose links expire after the given ttl
+func NewEmailVerifications(db *sql.DB, mailer mailer.Mailer, verifyURL string, ttl time.Duration) *EmailVerifications {
+	return &EmailVerifications{
+		tokens:    oneTimeTokens{db: db, purpose: "email_verification", ttl: ttl},
+		mailer:    mailer,
+		verifyURL: verifyURL,
+	}
+}
+
+// Sends the user a link to verify their email, any previous links stop working
+func (e *EmailVerifications) SendVerificationEmail(ctx context.Context, userID int, email string) error {
+	token, err := e.tokens.issue(userID)
+	if err != nil {
+		return err
+	}
+
+	return e.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your Muzz email",
+		Body: fmt.Sprintf("Welcome to Muzz!\n\nVerify your email here: %s\n\nThe link expires in %s.",
+			linkWithToken(e.verifyURL, token), e.tokens.ttl),
+	})
+}
+
+// The JSON response for the verify email handler
+type VerifyEmailResponse struct {
+	Verified bool `json:"verified"`
+}
+
+type VerifyEmailHandlerDeps struct {
+	DB            *sql.DB
+	Verifications *EmailVerifications
+
+	// optional, called after the user is marked as verified as it changes who they can be shown to
+	UserVerified func(userID int)
+}
+
+// verifies the user's email using the `token` query param from the link in the verification email
+func VerifyEmailHandler(deps VerifyEmailHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "token is required"})
+			return
+		}
+
+		// the token is only used up if the email is marked as verified, so a failure can be retried with the same link
+		tx, err := deps.DB.Begin()
+		if err != nil {
+			slog.Error("failed to begin email verification transaction", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to verify email"})
+			return
+		}
+		defer tx.Rollback()
+
+		userID, err := deps.Verifications.tokens.consumeWith(tx, token)
+		if err != nil {
+			if errors.Is(err, errInvalidOneTimeToken) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid or expired verification token"})
+				return
+			}
+			slog.Error("failed to consume email verification token", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to verify email"})
+			return
+		}
+
+		if err := user.MarkEmailVerified(tx, userID, deps.Verifications.tokens.now()); err != nil {
+			slog.Error("failed to mark email as verified", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to verify email"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit email verification", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to verify email"})
+			return
+		}
+
+		if deps.UserVerified != nil {
+			deps.UserVerified(userID)
+		}
+
+		json.NewEncoder(w).Encode(VerifyEmailResponse{Verified: true})
+	}
+}
+
+type ResendVerificationEmailHandlerDeps struct {
+	DB            *sql.DB
+	Verifications *EmailVerifications
+	ClaimsFromContext
+}
+
+// sends the logged in user a new verification link, e.g. when the first one has expired
+func ResendVerificationEmailHandler(deps ResendVerificationEmailHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := deps.ClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		var email string
+		var verifiedAt sql.NullInt64
+		err := deps.DB.QueryRow("SELECT email, email_verified_at FROM users WHERE id = ?", claims.UserID).Scan(&email, &verifiedAt)
+		if err != nil {
+			slog.Error("failed to find user to resend verification email", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to send verification email"})
+			return
+		}
+
+		if verifiedAt.Valid {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Email is already verified"})
+			return
+		}
+
+		if err := deps.Verifications.SendVerificationEmail(r.Context(), claims.UserID, email); err != nil {
+			slog.Error("failed to send verification email", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to send verification email"})
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
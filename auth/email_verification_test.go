@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"muzz/mailer"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerification(t *testing.T) {
+	db := newTestDB(t)
+	outboxDir := t.TempDir()
+
+	outbox, err := mailer.NewOutboxMailer(outboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifications := NewEmailVerifications(db, outbox, "https://muzz.example/verify", time.Hour)
+	claimsFromContext := func(ctx context.Context) (JWTClaims, bool) { return JWTClaims{UserID: userID}, true }
+
+	verifiedUsers := []int{}
+	verify := VerifyEmailHandler(VerifyEmailHandlerDeps{DB: db, Verifications: verifications, UserVerified: func(userID int) { verifiedUsers = append(verifiedUsers, userID) }})
+	resend := ResendVerificationEmailHandler(ResendVerificationEmailHandlerDeps{DB: db, Verifications: verifications, ClaimsFromContext: claimsFromContext})
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		verify.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+
+	if err := verifications.SendVerificationEmail(context.Background(), userID, "test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// asking for another email invalidates the first link
+	rr := httptest.NewRecorder()
+	resend.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/email/verify/resend", nil))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	tokens := tokensFromOutbox(t, outboxDir)
+	if !assert.Len(t, tokens, 2) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, http.StatusBadRequest, get("/email/verify").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/email/verify?token="+tokens[0]).Code)
+
+	verified, err := user.IsEmailVerified(db, userID)
+	assert.NoError(t, err)
+	assert.False(t, verified)
+	assert.Empty(t, verifiedUsers)
+
+	assert.Equal(t, http.StatusOK, get("/email/verify?token="+tokens[1]).Code)
+
+	verified, err = user.IsEmailVerified(db, userID)
+	assert.NoError(t, err)
+	assert.True(t, verified)
+	assert.Equal(t, []int{userID}, verifiedUsers)
+
+	// nothing to resend once verified
+	rr = httptest.NewRecorder()
+	resend.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/email/verify/resend", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestEmailVerificationKeepsTokenWhenUpdateFails(t *testing.T) {
+	db := newTestDB(t)
+
+	outbox, err := mailer.NewOutboxMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifications := NewEmailVerifications(db, outbox, "https://muzz.example/verify", time.Hour)
+	verify := VerifyEmailHandler(VerifyEmailHandlerDeps{DB: db, Verifications: verifications})
+
+	// the token is for a user who doesn't exist so they can't be marked as verified
+	token, err := verifications.tokens.issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	verify.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/email/verify?token="+token, nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	_, err = verifications.tokens.consume(token)
+	assert.NoError(t, err, "the token should still be usable")
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+// JWK is a JSON Web Key (RFC 7517) holding the public half of a signing key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 public key parameters
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the JSON response for the JWKS handler
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// returns the public keys of every asymmetric key which hasn't been retired
+// HMAC keys are never published as they are shared secrets
+func (k *KeySet) publicKeys() []JWK {
+	jwks := []JWK{}
+
+	for _, key := range k.keys {
+		if key.Retired {
+			continue
+		}
+
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.method().Alg()}
+
+		switch publicKey := key.verifyingKey().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+
+		jwks = append(jwks, jwk)
+	}
+
+	// keeps the response stable between requests
+	sort.Slice(jwks, func(i, j int) bool {
+		return jwks[i].KeyID < jwks[j].KeyID
+	})
+
+	return jwks
+}
+
+type JWKSHandlerDeps struct {
+	Keys *KeySet
+}
+
+// publishes the public keys used to sign tokens so other services can verify tokens themselves
+func JWKSHandler(deps JWKSHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// verifiers can cache the keys, a new key should be published before it becomes active
+		w.Header().Set("Cache-Control", "public, max-age=300")
+
+		json.NewEncoder(w).Encode(JWKS{Keys: deps.Keys.publicKeys()})
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// key set containing a RSA, Ed25519, HMAC and a retired Ed25519 key
+func newAsymmetricTestKeySet(t *testing.T, activeKeyID string) *KeySet {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, retiredKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewKeySet(activeKeyID,
+		SigningKey{ID: "rsa", PrivateKey: rsaKey},
+		SigningKey{ID: "ed25519", PrivateKey: edKey},
+		SigningKey{ID: "hmac", Secret: testActiveSecret},
+		SigningKey{ID: "retired-ed25519", PrivateKey: retiredKey, Retired: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+	testCases := []struct {
+		activeKeyID string
+		alg         string
+	}{
+		{activeKeyID: "rsa", alg: "RS256"},
+		{activeKeyID: "ed25519", alg: "EdDSA"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.alg, func(t *testing.T) {
+			tokenAuth := NewTokenAuthenticator(newAsymmetricTestKeySet(t, tc.activeKeyID))
+
+			token, err := tokenAuth.GenerateJWTToken(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &JWTClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.alg, parsed.Method.Alg())
+
+			claims, err := tokenAuth.ExtractClaimsFromToken(token)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, claims.UserID)
+		})
+	}
+}
+
+func TestExtractClaimsRejectsAlgorithmConfusion(t *testing.T) {
+	keys := newAsymmetricTestKeySet(t, "rsa")
+	tokenAuth := NewTokenAuthenticator(keys)
+
+	// the public key is public so an attacker could try to use it as a HMAC secret
+	rsaKey, err := keys.verificationKey("rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := rsaKey.verifyingKey().(*rsa.PublicKey)
+
+	token := signToken(JWTClaims{UserID: 1}, "rsa", publicKey.N.Bytes())
+
+	_, err = tokenAuth.ExtractClaimsFromToken(token)
+	assert.ErrorIs(t, err, errWrongSigningMethod)
+}
+
+func TestJWKSHandler(t *testing.T) {
+	keys := newAsymmetricTestKeySet(t, "rsa")
+	tokenAuth := NewTokenAuthenticator(keys)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+
+	JWKSHandler(JWKSHandlerDeps{Keys: keys}).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var response JWKS
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// the HMAC secret and the retired key must never be published
+	if assert.Len(t, response.Keys, 2) {
+		assert.Equal(t, "ed25519", response.Keys[0].KeyID)
+		assert.Equal(t, "OKP", response.Keys[0].KeyType)
+		assert.Equal(t, "rsa", response.Keys[1].KeyID)
+		assert.Equal(t, "RSA", response.Keys[1].KeyType)
+	}
+
+	// another service should be able to verify our tokens from the published key alone
+	token, err := tokenAuth.GenerateJWTToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaJWK := response.Keys[1]
+	n, err := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(rsaJWK.E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	parsed, err := jwt.ParseWithClaims(token, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	}, jwt.WithValidMethods([]string{rsaJWK.Algorithm}))
+	assert.NoError(t, err)
+	assert.True(t, parsed.Valid)
+}
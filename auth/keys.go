@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minSecretLength is the minimum number of bytes a HMAC signing secret must have
+const minSecretLength = 32
+
+// minRSAKeyBits is the minimum size of a RSA signing key
+const minRSAKeyBits = 2048
+
+var (
+	errNoSigningKeys        = errors.New("key set must contain at least one key")
+	errNoActiveKey          = errors.New("active signing key not found in key set")
+	errActiveKeyRetired     = errors.New("active signing key has been retired")
+	errDuplicateKeyID       = errors.New("duplicate key ID in key set")
+	errMissingKeyID         = errors.New("signing key must have an ID")
+	errSigningSecretTooWeak = fmt.Errorf("signing secret must be at least %d bytes", minSecretLength)
+	errRSAKeyTooWeak        = fmt.Errorf("RSA signing key must be at least %d bits", minRSAKeyBits)
+	errAmbiguousSigningKey  = errors.New("signing key must have exactly one of a secret or a private key")
+	errUnsupportedKeyType   = errors.New("unsupported private key type, must be RSA or Ed25519")
+	errUnknownKeyID         = errors.New("token signed with an unknown key")
+	errRetiredKeyID         = errors.New("token signed with a retired key")
+	errNoKeyIDOnJWT         = errors.New("no kid header on JWT token")
+	errWrongSigningMethod   = errors.New("token signing method doesn't match the key")
+)
+
+// SigningKey is used to sign and verify JWT tokens.
+// Keys are either symmetric (HS256) using a shared secret or asymmetric (RS256/EdDSA) using a private key,
+// the public half of asymmetric keys is published so other services can verify tokens without the secret.
+type SigningKey struct {
+	// ID is stamped onto the token header as the `kid` so we know which key to verify with
+	ID string
+	// Secret is the HMAC secret, set this for HS256 keys
+	Secret []byte
+	// PrivateKey is either a *rsa.PrivateKey (RS256) or ed25519.PrivateKey (EdDSA)
+	PrivateKey crypto.Signer
+	// Retired keys are no longer accepted when verifying tokens
+	Retired bool
+}
+
+// returns the algorithm the key signs tokens with
+func (s SigningKey) method() jwt.SigningMethod {
+	switch s.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// returns the key passed to the jwt library when signing a token
+func (s SigningKey) signingKey() interface{} {
+	if s.PrivateKey != nil {
+		return s.PrivateKey
+	}
+	return s.Secret
+}
+
+// returns the key passed to the jwt library when verifying a token
+func (s SigningKey) verifyingKey() interface{} {
+	if s.PrivateKey != nil {
+		return s.PrivateKey.Public()
+	}
+	return s.Secret
+}
+
+// checks the key is strong enough to sign tokens with
+func (s SigningKey) validate() error {
+	if s.ID == "" {
+		return errMissingKeyID
+	}
+
+	if (s.Secret == nil) == (s.PrivateKey == nil) {
+		return fmt.Errorf("key %s: %w", s.ID, errAmbiguousSigningKey)
+	}
+
+	switch key := s.PrivateKey.(type) {
+	case nil:
+		if len(s.Secret) < minSecretLength {
+			return fmt.Errorf("key %s: %w", s.ID, errSigningSecretTooWeak)
+		}
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("key %s: %w", s.ID, errRSAKeyTooWeak)
+		}
+	case ed25519.PrivateKey:
+	default:
+		return fmt.Errorf("key %s: %w", s.ID, errUnsupportedKeyType)
+	}
+
+	return nil
+}
+
+// KeySet holds all the keys known to the token authenticator.
+// Tokens are always signed with the active key but can be verified with any key that hasn't been retired,
+// this allows keys to be rotated without logging every user out.
+type KeySet struct {
+	activeKeyID string
+	keys        map[string]SigningKey
+}
+
+// Creates a key set, the active key is used for signing new tokens
+func NewKeySet(activeKeyID string, keys ...SigningKey) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errNoSigningKeys
+	}
+
+	ks := &KeySet{activeKeyID: activeKeyID, keys: make(map[string]SigningKey, len(keys))}
+
+	for _, key := range keys {
+		if err := key.validate(); err != nil {
+			return nil, err
+		}
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("%w: %s", errDuplicateKeyID, key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	active, ok := ks.keys[activeKeyID]
+	if !ok {
+		return nil, errNoActiveKey
+	}
+	if active.Retired {
+		return nil, errActiveKeyRetired
+	}
+
+	return ks, nil
+}
+
+// returns the key new tokens are signed with
+func (k *KeySet) activeKey() SigningKey {
+	return k.keys[k.activeKeyID]
+}
+
+// returns the key that can be used to verify a token signed with the given key ID
+func (k *KeySet) verificationKey(keyID string) (SigningKey, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return SigningKey{}, errUnknownKeyID
+	}
+	if key.Retired {
+		return SigningKey{}, errRetiredKeyID
+	}
+	return key, nil
+}
+
+// keySetFile is the on-disk representation of a key set
+type keySetFile struct {
+	ActiveKeyID string `json:"active_key_id"`
+	Keys        []struct {
+		ID string `json:"id"`
+		// base64 encoded secret
+		Secret string `json:"secret,omitempty"`
+		// path to a file containing the raw secret, relative paths are resolved from the key set file
+		SecretFile string `json:"secret_file,omitempty"`
+		// path to a PEM encoded RSA or Ed25519 private key, relative paths are resolved from the key set file
+		PrivateKeyFile string `json:"private_key_file,omitempty"`
+		Retired        bool   `json:"retired,omitempty"`
+	} `json:"keys"`
+}
+
+// Loads a key set from a JSON file, e.g.
+//
+//	{
+//		"active_key_id": "2024-06",
+//		"keys": [
+//			{"id": "2024-06", "secret": "<base64>"},
+//			{"id": "2024-01", "secret_file": "./2024-01.key", "retired": true},
+//			{"id": "2024-07", "private_key_file": "./2024-07.pem"}
+//		]
+//	}
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set: %w", err)
+	}
+
+	var file keySetFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse key set: %w", err)
+	}
+
+	// resolves paths relative to the key set file
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(path), p)
+	}
+
+	keys := make([]SigningKey, 0, len(file.Keys))
+	for _, k := range file.Keys {
+		var secret []byte
+		var privateKey crypto.Signer
+
+		switch {
+		case k.PrivateKeyFile != "" && (k.Secret != "" || k.SecretFile != ""):
+			return nil, fmt.Errorf("key %s: %w", k.ID, errAmbiguousSigningKey)
+		case k.Secret != "" && k.SecretFile != "":
+			return nil, fmt.Errorf("key %s: only one of secret or secret_file can be set", k.ID)
+		case k.PrivateKeyFile != "":
+			privateKey, err = loadPrivateKey(resolve(k.PrivateKeyFile))
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.ID, err)
+			}
+		case k.Secret != "":
+			secret, err = base64.StdEncoding.DecodeString(k.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: secret must be base64 encoded: %w", k.ID, err)
+			}
+		case k.SecretFile != "":
+			raw, err := os.ReadFile(resolve(k.SecretFile))
+			if err != nil {
+				return nil, fmt.Errorf("key %s: failed to read secret file: %w", k.ID, err)
+			}
+			secret = []byte(strings.TrimSpace(string(raw)))
+		}
+
+		keys = append(keys, SigningKey{ID: k.ID, Secret: secret, PrivateKey: privateKey, Retired: k.Retired})
+	}
+
+	return NewKeySet(file.ActiveKeyID, keys...)
+}
+
+// reads a PEM encoded PKCS#8 (RSA or Ed25519) or PKCS#1 (RSA) private key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key file is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedKeyType
+	}
+	return signer, nil
+}
+
+// Generates a key set with a single random Ed25519 key.
+// Tokens signed by this key set won't survive a restart so this should only be used for local development.
+func GenerateEphemeralKeySet() (*KeySet, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySet("ephemeral", SigningKey{ID: "ephemeral", PrivateKey: privateKey})
+}
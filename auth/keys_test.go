@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeySet(t *testing.T) {
+	testCases := []struct {
+		name        string
+		activeKeyID string
+		keys        []SigningKey
+		expectedErr error
+	}{
+		{
+			name:        "no keys given",
+			activeKeyID: testActiveKeyID,
+			expectedErr: errNoSigningKeys,
+		},
+		{
+			name:        "active key not in key set",
+			activeKeyID: "missing",
+			keys:        []SigningKey{{ID: testActiveKeyID, Secret: testActiveSecret}},
+			expectedErr: errNoActiveKey,
+		},
+		{
+			name:        "active key is retired",
+			activeKeyID: testActiveKeyID,
+			keys:        []SigningKey{{ID: testActiveKeyID, Secret: testActiveSecret, Retired: true}},
+			expectedErr: errActiveKeyRetired,
+		},
+		{
+			name:        "duplicate key IDs",
+			activeKeyID: testActiveKeyID,
+			keys:        []SigningKey{{ID: testActiveKeyID, Secret: testActiveSecret}, {ID: testActiveKeyID, Secret: testOldSecret}},
+			expectedErr: errDuplicateKeyID,
+		},
+		{
+			name:        "key without an ID",
+			activeKeyID: testActiveKeyID,
+			keys:        []SigningKey{{Secret: testActiveSecret}},
+			expectedErr: errMissingKeyID,
+		},
+		{
+			name:        "secret is too short",
+			activeKeyID: testActiveKeyID,
+			keys:        []SigningKey{{ID: testActiveKeyID, Secret: []byte("secret")}},
+			expectedErr: errSigningSecretTooWeak,
+		},
+		{
+			name:        "valid key set",
+			activeKeyID: testActiveKeyID,
+			keys:        []SigningKey{{ID: testActiveKeyID, Secret: testActiveSecret}, {ID: testOldKeyID, Secret: testOldSecret}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := NewKeySet(tc.activeKeyID, tc.keys...)
+
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected err '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if err == nil {
+				assert.Equal(t, tc.activeKeyID, keys.activeKey().ID)
+			}
+		})
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "old.key"), append(testOldSecret, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keySetJSON := `{
+		"active_key_id": "active",
+		"keys": [
+			{"id": "active", "secret": "` + base64.StdEncoding.EncodeToString(testActiveSecret) + `"},
+			{"id": "old", "secret_file": "old.key"},
+			{"id": "retired", "secret": "` + base64.StdEncoding.EncodeToString(testRetiredSecret) + `", "retired": true}
+		]
+	}`
+
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, []byte(keySetJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatal("failed to load key set", err)
+	}
+
+	assert.Equal(t, testActiveSecret, keys.activeKey().Secret)
+
+	oldKey, err := keys.verificationKey(testOldKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, testOldSecret, oldKey.Secret, "secret file should be trimmed")
+
+	_, err = keys.verificationKey(testRetiredKeyID)
+	assert.ErrorIs(t, err, errRetiredKeyID)
+}
+
+func TestTokensSurviveKeyRotation(t *testing.T) {
+	before, err := NewKeySet(testOldKeyID, SigningKey{ID: testOldKeyID, Secret: testOldSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewTokenAuthenticator(before).GenerateJWTToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new key is promoted to active but the old key is still accepted
+	after := newTestKeySet(t)
+	claims, err := NewTokenAuthenticator(after).ExtractClaimsFromToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, claims.UserID)
+
+	// once the old key is retired the token is no longer accepted
+	retired, err := NewKeySet(testActiveKeyID,
+		SigningKey{ID: testActiveKeyID, Secret: testActiveSecret},
+		SigningKey{ID: testOldKeyID, Secret: testOldSecret, Retired: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewTokenAuthenticator(retired).ExtractClaimsFromToken(token)
+	assert.ErrorIs(t, err, errRetiredKeyID)
+}
@@ -4,60 +4,186 @@ import (
 	"database/sql"
 	"encoding/json"
 	"log/slog"
+	"math"
 	"muzz/httpresponse"
 	"muzz/user"
 	"net/http"
+	"strconv"
 
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type LoginHandlerDeps struct {
 	DB *sql.DB
 	JwtTokenGenerator
+
+	// optional, when set a refresh token is returned alongside the access token
+	RefreshTokenIssuer
+
+	// optional, when set repeated failures are slowed down and eventually locked out
+	Throttle *LoginThrottle
+
+	// optional, when set users with two factor authentication get an mfa token instead
+	// which is exchanged for a JWT token by the MFALoginHandler
+	MFA                      *MFA
+	MFAPendingTokenGenerator JwtTokenGenerator
+
+	// optional, defaults to user.DefaultPasswordHasher
+	PasswordHasher user.PasswordHasher
+}
+
+func (d *LoginHandlerDeps) passwordHasher() user.PasswordHasher {
+	if d.PasswordHasher == nil {
+		return user.DefaultPasswordHasher
+	}
+	return d.PasswordHasher
+}
+
+// replaces the stored hash with one from the current hasher
+func (d *LoginHandlerDeps) rehashPassword(userID int, password string) error {
+	hashedPassword, err := d.passwordHasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	return user.UpdatePasswordHash(d.DB, userID, hashedPassword)
 }
 
 // Generates a signed JWT token from a given user id
 type JwtTokenGenerator func(userID int) (string, error)
 
-// logs the user into the application and returns a JWT token to the user
+// logs the user into the application and returns a JWT token (and refresh token) to the user
 func LoginHandler(deps LoginHandlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var user user.User
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		var credentials user.User
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
 			return
 		}
 
-		row := deps.DB.QueryRow("SELECT id, password FROM users WHERE email = ?", user.Email)
+		credentials.Email = user.NormalizeEmail(credentials.Email)
+		address := clientAddress(r)
+
+		// the attempt counts as a failure until the password is found to be right
+		if deps.Throttle != nil {
+			if !reserveLoginAttempt(w, deps.Throttle, credentials.Email, address) {
+				return
+			}
+		}
+
+		loginFailed := func() {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid email or password"})
+		}
+
+		row := deps.DB.QueryRow("SELECT id, password FROM users WHERE LOWER(email) = ?", credentials.Email)
 		var storedID int
 		var storedPassword string
 		err := row.Scan(&storedID, &storedPassword)
 		if err != nil {
 			slog.Error("error scanning row", slog.Any("error", err))
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid email or password"})
+			loginFailed()
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(user.Password)); err != nil {
-			slog.Error("Invalid email or password", slog.Any("error", err))
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid email or password"})
+		match, needsRehash, err := deps.passwordHasher().Verify(credentials.Password, storedPassword)
+		if err != nil {
+			slog.Error("error verifying password", slog.Any("error", err))
+		}
+		if !match {
+			loginFailed()
 			return
 		}
 
-		token, err := deps.JwtTokenGenerator(storedID)
+		// the password is only known now so this is the chance to move it onto the current algorithm and costs
+		if needsRehash {
+			if err := deps.rehashPassword(storedID, credentials.Password); err != nil {
+				slog.Error("error rehashing password", slog.Any("error", err))
+			}
+		}
+
+		if deps.MFA != nil {
+			enabled, err := deps.MFA.IsEnabled(storedID)
+			if err != nil {
+				slog.Error("error checking two factor authentication", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to login"})
+				return
+			}
+
+			// the password was right but the user isn't logged in until they enter their code
+			if enabled {
+				if deps.Throttle != nil {
+					if err := deps.Throttle.Release(credentials.Email, address); err != nil {
+						slog.Error("error releasing login attempt", slog.Any("error", err))
+					}
+				}
+
+				mfaToken, err := deps.MFAPendingTokenGenerator(storedID)
+				if err != nil {
+					slog.Error("error generating mfa token", slog.Any("error", err))
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to generate token"})
+					return
+				}
+				json.NewEncoder(w).Encode(MFARequiredResponse{MFARequired: true, MFAToken: mfaToken})
+				return
+			}
+		}
+
+		if deps.Throttle != nil {
+			if err := deps.Throttle.RecordSuccess(credentials.Email, address); err != nil {
+				slog.Error("error clearing failed logins", slog.Any("error", err))
+			}
+		}
+
+		issueTokens(w, storedID, deps.JwtTokenGenerator, deps.RefreshTokenIssuer)
+	}
+}
+
+// reserves a login attempt against the throttle, responds with 429 and returns false when the email or client address is currently throttled
+func reserveLoginAttempt(w http.ResponseWriter, throttle *LoginThrottle, email string, address string) bool {
+	retryAfter, err := throttle.Reserve(email, address)
+	if err != nil {
+		slog.Error("error reserving login attempt", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to login"})
+		return false
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Too many failed login attempts, try again later"})
+		return false
+	}
+
+	return true
+}
+
+// responds with a JWT token, and a refresh token when an issuer is given
+func issueTokens(w http.ResponseWriter, userID int, generateToken JwtTokenGenerator, issueRefreshToken RefreshTokenIssuer) {
+	token, err := generateToken(userID)
+	if err != nil {
+		slog.Error("error generating JWT", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	response := TokenResponse{Token: token}
+
+	if issueRefreshToken != nil {
+		response.RefreshToken, err = issueRefreshToken(userID)
 		if err != nil {
-			slog.Error("error generating JWT", slog.Any("error", err))
+			slog.Error("error issuing refresh token", slog.Any("error", err))
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to generate token"})
 			return
 		}
-
-		json.NewEncoder(w).Encode(map[string]string{"token": token})
 	}
+
+	json.NewEncoder(w).Encode(response)
 }
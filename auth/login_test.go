@@ -9,10 +9,13 @@ import (
 	"muzz/user"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestLoginHandler(t *testing.T) {
@@ -52,7 +55,8 @@ func TestLoginHandler(t *testing.T) {
 	}
 	req.Body = io.NopCloser(bytes.NewReader(reqBody))
 
-	handler := http.HandlerFunc(LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: NewTokenAuthenticator().GenerateJWTToken}))
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+	handler := http.HandlerFunc(LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: NewTokenAuthenticator(newTestKeySet(t)).GenerateJWTToken, RefreshTokenIssuer: refreshTokens.Issue}))
 
 	handler.ServeHTTP(rr, req)
 
@@ -66,5 +70,54 @@ func TestLoginHandler(t *testing.T) {
 		t.Errorf("error parsing response body: %v", err)
 	}
 
-	assert.NotNil(t, response["token"], "handler did not return token")
+	assert.NotEmpty(t, response["token"], "handler did not return token")
+	assert.NotEmpty(t, response["refresh_token"], "handler did not return refresh token")
+
+	_, _, err = refreshTokens.Rotate(response["refresh_token"])
+	assert.NoError(t, err, "refresh token should be usable")
+
+	// emails are matched ignoring case
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/login", bytes.NewBufferString(`{"email": " Test@Example.com", "password": "password123"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestLoginHandlerRehashesOutdatedPasswords(t *testing.T) {
+	db := newTestDB(t)
+
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (email, password) VALUES (?, ?)", "test@example.com", string(legacyHash)); err != nil {
+		t.Fatal(err)
+	}
+
+	hasher := user.Argon2idHasher{Params: user.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}}
+	handler := LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: NewTokenAuthenticator(newTestKeySet(t)).GenerateJWTToken, PasswordHasher: hasher})
+
+	login := func(password string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBufferString(`{"email": "test@example.com", "password": "`+password+`"}`)))
+		return rr.Code
+	}
+
+	storedHash := func() string {
+		var hash string
+		if err := db.QueryRow("SELECT password FROM users WHERE email = ?", "test@example.com").Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password"))
+	assert.Equal(t, string(legacyHash), storedHash(), "failed logins shouldn't change the hash")
+
+	assert.Equal(t, http.StatusOK, login("password123"))
+	upgraded := storedHash()
+	assert.True(t, strings.HasPrefix(upgraded, "$argon2id$"), upgraded)
+
+	// already up to date so it isn't rehashed again
+	assert.Equal(t, http.StatusOK, login("password123"))
+	assert.Equal(t, upgraded, storedHash())
 }
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"muzz/httpresponse"
+	"net/http"
+)
+
+// Request body for the LogoutHandler
+type LogoutRequest struct {
+	// optional, revokes the refresh token issued alongside the access token
+	RefreshToken string `json:"refresh_token"`
+}
+
+// returns the claims of the authenticated user and whether they were found
+type ClaimsFromContext func(ctx context.Context) (JWTClaims, bool)
+
+type LogoutHandlerDeps struct {
+	Revocations   *RevocationStore
+	RefreshTokens *RefreshTokenStore
+	ClaimsFromContext
+}
+
+// logs the user out by revoking the access token used to make the request and the given refresh token
+func LogoutHandler(deps LogoutHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := deps.ClaimsFromContext(r.Context())
+		if !found || claims.ID == "" || claims.ExpiresAt == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		// the body is optional
+		var req LogoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if err := deps.Revocations.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+			slog.Error("failed to revoke access token", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to logout"})
+			return
+		}
+
+		if req.RefreshToken != "" {
+			if err := deps.RefreshTokens.RevokeFamily(claims.UserID, req.RefreshToken); err != nil {
+				slog.Error("failed to revoke refresh token", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to logout"})
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
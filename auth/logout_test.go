@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogoutHandler(t *testing.T) {
+	db := newTestDB(t)
+	tokenAuth := NewTokenAuthenticator(newTestKeySet(t))
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+
+	revocations, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := tokenAuth.GenerateJWTToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokenAuth.ExtractClaimsFromToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshToken, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh tokens belonging to other users shouldn't be affected
+	otherUsersRefreshToken, err := refreshTokens.Issue(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		claims         *JWTClaims
+		reqBody        string
+		expectedStatus int
+	}{
+		{
+			name:           "no claims on context",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "claims without a jti",
+			claims:         &JWTClaims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: claims.ExpiresAt}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid payload",
+			claims:         claims,
+			reqBody:        `invalid_json_payload`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "logout revokes the access and refresh token",
+			claims:         claims,
+			reqBody:        `{"refresh_token": "` + refreshToken + `"}`,
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/logout", bytes.NewBufferString(tt.reqBody))
+			rr := httptest.NewRecorder()
+
+			claimsFromContext := func(ctx context.Context) (JWTClaims, bool) {
+				if tt.claims == nil {
+					return JWTClaims{}, false
+				}
+				return *tt.claims, true
+			}
+
+			LogoutHandler(LogoutHandlerDeps{Revocations: revocations, RefreshTokens: refreshTokens, ClaimsFromContext: claimsFromContext}).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+
+	assert.True(t, revocations.IsRevoked(*claims), "access token should be revoked")
+
+	_, _, err = refreshTokens.Rotate(refreshToken)
+	assert.ErrorIs(t, err, errInvalidRefreshToken, "refresh token should be revoked")
+
+	_, _, err = refreshTokens.Rotate(otherUsersRefreshToken)
+	assert.NoError(t, err, "other users refresh tokens should be unaffected")
+}
@@ -0,0 +1,474 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"muzz/httpresponse"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// number of recovery codes generated when two factor authentication is enabled
+const recoveryCodeCount = 10
+
+// characters used in recovery codes, lowercase base32 without the easily confused characters
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var (
+	errMFANotEnrolled     = errors.New("two factor authentication hasn't been set up")
+	errMFAAlreadyEnabled  = errors.New("two factor authentication is already enabled")
+	errMFANotEnabled      = errors.New("two factor authentication isn't enabled")
+	errInvalidMFACode     = errors.New("invalid two factor code")
+	errMFAIssuerMissing   = errors.New("issuer is required")
+	errMFAAccountNotFound = errors.New("user not found")
+)
+
+// MFA manages TOTP (RFC 6238) two factor authentication for users.
+//
+// Secrets are stored in the db as is so the db should be encrypted at rest.
+type MFA struct {
+	db *sql.DB
+	// shown in the user's authenticator app
+	issuer string
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates the two factor authentication manager, the issuer is shown in the user's authenticator app
+func NewMFA(db *sql.DB, issuer string) (*MFA, error) {
+	if issuer == "" {
+		return nil, errMFAIssuerMissing
+	}
+	return &MFA{db: db, issuer: issuer}, nil
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (m *MFA) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock()
+}
+
+// reports whether the user has to enter a two factor code when logging in
+func (m *MFA) IsEnabled(userID int) (bool, error) {
+	var enabledAt sql.NullInt64
+	err := m.db.QueryRow("SELECT enabled_at FROM mfa_secrets WHERE user_id = ?", userID).Scan(&enabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabledAt.Valid, err
+}
+
+// generates a new secret for the user, two factor authentication isn't enabled until the user confirms a code
+// returns the secret and the URI used to add the account to an authenticator app
+func (m *MFA) Enroll(userID int) (secret string, uri string, err error) {
+	var email string
+	if err := m.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", errMFAAccountNotFound
+		}
+		return "", "", err
+	}
+
+	enabled, err := m.IsEnabled(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		return "", "", errMFAAlreadyEnabled
+	}
+
+	secret, err = generateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	// enrolling again replaces a secret which was never confirmed
+	_, err = m.db.Exec(`INSERT INTO mfa_secrets (user_id, secret) VALUES (?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_used_step = 0`, userID, secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, totpURI(m.issuer, email, secret), nil
+}
+
+// enables two factor authentication once the user has proved their authenticator works
+// returns the recovery codes which are only ever shown to the user this once
+func (m *MFA) Confirm(userID int, code string) ([]string, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabledAt sql.NullInt64
+	var lastUsedStep int64
+	err = tx.QueryRow("SELECT secret, enabled_at, last_used_step FROM mfa_secrets WHERE user_id = ?", userID).Scan(&secret, &enabledAt, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, errMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, errMFAAlreadyEnabled
+	}
+
+	now := m.now()
+
+	step, ok := validateTOTP(secret, code, now)
+	if !ok || step <= lastUsedStep {
+		return nil, errInvalidMFACode
+	}
+
+	if _, err := tx.Exec("UPDATE mfa_secrets SET enabled_at = ?, last_used_step = ? WHERE user_id = ?", now.Unix(), step, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		recoveryCode, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(recoveryCode)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, recoveryCode)
+	}
+
+	return codes, tx.Commit()
+}
+
+// checks a TOTP code or an unused recovery code, each can only be used once
+func (m *MFA) Verify(userID int, code string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.verifyWith(tx, userID, code); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// verify within the given transaction, so the code is only used up if the rest of the transaction succeeds
+func (m *MFA) verifyWith(tx *sql.Tx, userID int, code string) error {
+	var secret string
+	var enabledAt sql.NullInt64
+	var lastUsedStep int64
+	err := tx.QueryRow("SELECT secret, enabled_at, last_used_step FROM mfa_secrets WHERE user_id = ?", userID).Scan(&secret, &enabledAt, &lastUsedStep)
+	if err == sql.ErrNoRows || (err == nil && !enabledAt.Valid) {
+		return errMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	now := m.now()
+
+	if step, ok := validateTOTP(secret, code, now); ok {
+		if step <= lastUsedStep {
+			return errInvalidMFACode
+		}
+		_, err := tx.Exec("UPDATE mfa_secrets SET last_used_step = ? WHERE user_id = ?", step, userID)
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE mfa_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		now.Unix(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	used, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return errInvalidMFACode
+	}
+
+	return nil
+}
+
+// turns off two factor authentication, the user has to prove they still have access with a code
+func (m *MFA) Disable(userID int, code string) error {
+	// the code is checked in the same transaction as everything is removed
+	// so it isn't used up when mfa can't be disabled, and mfa is never left half disabled
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.verifyWith(tx, userID, code); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM mfa_secrets WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// generates a recovery code in the format xxxxx-xxxxx
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	var code strings.Builder
+	for i, c := range b {
+		if i == len(b)/2 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(recoveryCodeAlphabet[int(c)%len(recoveryCodeAlphabet)])
+	}
+	return code.String(), nil
+}
+
+// recovery codes are compared ignoring case, whitespace and dashes
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashOpaqueToken(normalised)
+}
+
+// Request body for the MFA handlers
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// The JSON response when enrolling in two factor authentication
+type EnrollMFAResponse struct {
+	Secret string `json:"secret"`
+	// otpauth:// URI, usually shown to the user as a QR code
+	URI string `json:"otpauth_url"`
+}
+
+// The JSON response when two factor authentication has been enabled
+type ConfirmMFAResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFAHandlerDeps struct {
+	MFA *MFA
+	ClaimsFromContext
+}
+
+// starts setting up two factor authentication for the logged in user
+func EnrollMFAHandler(deps MFAHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := deps.ClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		secret, uri, err := deps.MFA.Enroll(claims.UserID)
+		if err != nil {
+			if errors.Is(err, errMFAAlreadyEnabled) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Two factor authentication is already enabled"})
+				return
+			}
+			slog.Error("failed to enroll in two factor authentication", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to set up two factor authentication"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(EnrollMFAResponse{Secret: secret, URI: uri})
+	}
+}
+
+// enables two factor authentication once the user has entered a code from their authenticator
+func ConfirmMFAHandler(deps MFAHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := deps.ClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		recoveryCodes, err := deps.MFA.Confirm(claims.UserID, req.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, errInvalidMFACode):
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid two factor code"})
+			case errors.Is(err, errMFANotEnrolled), errors.Is(err, errMFAAlreadyEnabled):
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			default:
+				slog.Error("failed to confirm two factor authentication", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to set up two factor authentication"})
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(ConfirmMFAResponse{RecoveryCodes: recoveryCodes})
+	}
+}
+
+// turns off two factor authentication, requires a code or a recovery code
+func DisableMFAHandler(deps MFAHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := deps.ClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if err := deps.MFA.Disable(claims.UserID, req.Code); err != nil {
+			switch {
+			case errors.Is(err, errInvalidMFACode):
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid two factor code"})
+			case errors.Is(err, errMFANotEnabled):
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Two factor authentication isn't enabled"})
+			default:
+				slog.Error("failed to disable two factor authentication", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to disable two factor authentication"})
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Request body for the MFALoginHandler
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// The JSON response from login when the user still needs to enter their two factor code
+type MFARequiredResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// gets the claims from a token
+type ExtractClaimsFromToken func(tokenString string) (*JWTClaims, error)
+
+type MFALoginHandlerDeps struct {
+	DB  *sql.DB
+	MFA *MFA
+	// checks the token returned by login when two factor authentication is required
+	ExtractMFAPendingClaims ExtractClaimsFromToken
+	JwtTokenGenerator
+
+	// optional, when set a refresh token is returned alongside the access token
+	RefreshTokenIssuer
+
+	// optional, when set wrong codes count as failed logins
+	Throttle *LoginThrottle
+}
+
+// completes a login by exchanging the token returned by login and a two factor code for a full JWT token
+func MFALoginHandler(deps MFALoginHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req MFALoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		claims, err := deps.ExtractMFAPendingClaims(req.MFAToken)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid or expired mfa token"})
+			return
+		}
+
+		var email string
+		if err := deps.DB.QueryRow("SELECT email FROM users WHERE id = ?", claims.UserID).Scan(&email); err != nil {
+			slog.Error("failed to find user for two factor login", slog.Any("error", err))
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid or expired mfa token"})
+			return
+		}
+
+		address := clientAddress(r)
+
+		// the attempt counts as a failure until the code is found to be right
+		if deps.Throttle != nil {
+			if !reserveLoginAttempt(w, deps.Throttle, email, address) {
+				return
+			}
+		}
+
+		if err := deps.MFA.Verify(claims.UserID, req.Code); err != nil {
+			if !errors.Is(err, errInvalidMFACode) && !errors.Is(err, errMFANotEnabled) {
+				slog.Error("failed to verify two factor code", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to login"})
+				return
+			}
+
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid two factor code"})
+			return
+		}
+
+		if deps.Throttle != nil {
+			if err := deps.Throttle.RecordSuccess(email, address); err != nil {
+				slog.Error("error clearing failed logins", slog.Any("error", err))
+			}
+		}
+
+		issueTokens(w, claims.UserID, deps.JwtTokenGenerator, deps.RefreshTokenIssuer)
+	}
+}
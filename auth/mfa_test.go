@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the code the user's authenticator app would show
+func currentTOTPCode(t *testing.T, encodedSecret string, now time.Time) string {
+	t.Helper()
+
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(secret, totpStep(now))
+}
+
+func TestMFALogin(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfa, err := NewMFA(db, "Muzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa.clock = func() time.Time { return now }
+
+	tokenAuth := NewTokenAuthenticator(newTestKeySet(t))
+	claimsFromContext := func(ctx context.Context) (JWTClaims, bool) { return JWTClaims{UserID: userID}, true }
+
+	enroll := EnrollMFAHandler(MFAHandlerDeps{MFA: mfa, ClaimsFromContext: claimsFromContext})
+	confirm := ConfirmMFAHandler(MFAHandlerDeps{MFA: mfa, ClaimsFromContext: claimsFromContext})
+	disable := DisableMFAHandler(MFAHandlerDeps{MFA: mfa, ClaimsFromContext: claimsFromContext})
+	login := LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: tokenAuth.GenerateJWTToken, MFA: mfa, MFAPendingTokenGenerator: tokenAuth.GenerateMFAPendingToken})
+	mfaLogin := MFALoginHandler(MFALoginHandlerDeps{DB: db, MFA: mfa, ExtractMFAPendingClaims: tokenAuth.ExtractMFAPendingClaims, JwtTokenGenerator: tokenAuth.GenerateJWTToken})
+
+	post := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// logs in with the password and returns the mfa token
+	loginWithPassword := func() string {
+		rr := post(login, `{"email": "test@example.com", "password": "password123"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var response MFARequiredResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, response.MFARequired)
+		return response.MFAToken
+	}
+
+	// a code is needed before it can be confirmed
+	rr := post(confirm, `{"code": "123456"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = post(enroll, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var enrollment EnrollMFAResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+	// not enabled until confirmed so the password is enough
+	rr = post(login, `{"email": "test@example.com", "password": "password123"}`)
+	var tokens TokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, tokens.Token)
+
+	rr = post(confirm, `{"code": "000000"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = post(confirm, `{"code": "`+currentTOTPCode(t, enrollment.Secret, now)+`"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var confirmation ConfirmMFAResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &confirmation); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, confirmation.RecoveryCodes, recoveryCodeCount)
+
+	rr = post(enroll, "")
+	assert.Equal(t, http.StatusConflict, rr.Code, "can't enroll again once enabled")
+
+	mfaToken := loginWithPassword()
+
+	// the mfa token can't be used as an access token
+	_, err = tokenAuth.ExtractClaimsFromToken(mfaToken)
+	assert.ErrorIs(t, err, errMFAPending)
+
+	// the code used to confirm can't be replayed
+	rr = post(mfaLogin, `{"mfa_token": "`+mfaToken+`", "code": "`+currentTOTPCode(t, enrollment.Secret, now)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	now = now.Add(totpPeriod)
+	code := currentTOTPCode(t, enrollment.Secret, now)
+
+	rr = post(mfaLogin, `{"mfa_token": "not-a-token", "code": "`+code+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = post(mfaLogin, `{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	tokens = TokenResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokenAuth.ExtractClaimsFromToken(tokens.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, userID, claims.UserID)
+
+	// recovery codes work once each
+	mfaToken = loginWithPassword()
+	rr = post(mfaLogin, `{"mfa_token": "`+mfaToken+`", "code": "`+confirmation.RecoveryCodes[0]+`"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = post(mfaLogin, `{"mfa_token": "`+mfaToken+`", "code": "`+confirmation.RecoveryCodes[0]+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = post(disable, `{"code": "`+confirmation.RecoveryCodes[1]+`"}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	enabled, err := mfa.IsEnabled(userID)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	rr = post(disable, `{"code": "`+confirmation.RecoveryCodes[2]+`"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestMFADisableKeepsCodeWhenDeleteFails(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfa, err := NewMFA(db, "Muzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa.clock = func() time.Time { return now }
+
+	secret, _, err := mfa.Enroll(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes, err := mfa.Confirm(userID, currentTOTPCode(t, secret, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mfa can't be removed while the trigger is in place
+	if _, err := db.Exec("CREATE TRIGGER fail_mfa_delete BEFORE DELETE ON mfa_secrets BEGIN SELECT RAISE(ABORT, 'delete failed'); END"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, mfa.Disable(userID, recoveryCodes[0]))
+
+	enabled, err := mfa.IsEnabled(userID)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	if _, err := db.Exec("DROP TRIGGER fail_mfa_delete"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, mfa.Verify(userID, recoveryCodes[0]), "the recovery code should still be usable")
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	errInvalidOneTimeToken = errors.New("invalid or expired token")
+	errOneTimeTokenTooSoon = errors.New("a token was issued too recently")
+)
+
+// oneTimeTokens issues tokens which can only be used once for a single purpose e.g. resetting a password
+type oneTimeTokens struct {
+	db      *sql.DB
+	purpose string
+	ttl     time.Duration
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (o *oneTimeTokens) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock()
+}
+
+// issues a new token for the user, any outstanding tokens for the same purpose can no longer be used
+func (o *oneTimeTokens) issue(userID int) (string, error) {
+	return o.issueWithCooldown(userID, 0)
+}
+
+// like issue but fails with errOneTimeTokenTooSoon when the user was issued a token for the same purpose within the cooldown
+func (o *oneTimeTokens) issueWithCooldown(userID int, cooldown time.Duration) (string, error) {
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := o.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := o.now()
+
+	// the check is part of the insert so two requests at once can't both get a token
+	result, err := tx.Exec(`INSERT INTO one_time_tokens (user_id, purpose, token_hash, created_at, expires_at)
+	SELECT ?, ?, ?, ?, ?
+	WHERE NOT EXISTS (SELECT 1 FROM one_time_tokens WHERE user_id = ? AND purpose = ? AND created_at > ?)`,
+		userID, o.purpose, hash, now.Unix(), now.Add(o.ttl).Unix(), userID, o.purpose, now.Add(-cooldown).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if inserted == 0 {
+		return "", errOneTimeTokenTooSoon
+	}
+
+	if _, err := tx.Exec("UPDATE one_time_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND token_hash != ?", now.Unix(), userID, o.purpose, hash); err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// uses up the token, returning the user it was issued to
+func (o *oneTimeTokens) consume(token string) (int, error) {
+	return o.consumeWith(o.db, token)
+}
+
+// dbQueryRower is satisfied by both *sql.DB and *sql.Tx
+type dbQueryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// consume using the given db or transaction, so the token is only used up if the rest of the transaction succeeds
+func (o *oneTimeTokens) consumeWith(db dbQueryRower, token string) (int, error) {
+	now := o.now()
+
+	var userID int
+	err := db.QueryRow(`UPDATE one_time_tokens SET used_at = ?
+	WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	RETURNING user_id`, now.Unix(), hashOpaqueToken(token), o.purpose, now.Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidOneTimeToken
+	}
+
+	return userID, err
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"muzz/httpresponse"
+	"muzz/mailer"
+	"muzz/user"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultPasswordResetTTL is how long a password reset link can be used for
+	DefaultPasswordResetTTL = time.Hour
+	// DefaultPasswordResetCooldown is how long a user has to wait between reset emails
+	DefaultPasswordResetCooldown = time.Minute * 5
+)
+
+// PasswordResets issues the one time tokens emailed to users who have forgotten their password
+type PasswordResets struct {
+	tokens oneTimeTokens
+}
+
+// Creates password resets which expire after the given ttl
+func NewPasswordResets(db *sql.DB, ttl time.Duration) *PasswordResets {
+	return &PasswordResets{tokens: oneTimeTokens{db: db, purpose: "password_reset", ttl: ttl}}
+}
+
+// Request body for the ForgotPasswordHandler
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ForgotPasswordHandlerDeps struct {
+	DB     *sql.DB
+	Resets *PasswordResets
+	Mailer mailer.Mailer
+	// the link emailed to the user, the token is added as the `token` query param
+	ResetURL string
+	// optional, a user is sent at most one reset email in this long so the endpoint can't be used to flood their inbox
+	Cooldown time.Duration
+}
+
+// emails the user a link to reset their password
+// always responds with 202 so it can't be used to find out which emails are registered
+func ForgotPasswordHandler(deps ForgotPasswordHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req ForgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		// the email is sent to the address stored for the account rather than whatever was typed in
+		var userID int
+		var email string
+		err := deps.DB.QueryRow("SELECT id, email FROM users WHERE LOWER(email) = ?", user.NormalizeEmail(req.Email)).Scan(&userID, &email)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("failed to find user for password reset", slog.Any("error", err))
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		token, err := deps.Resets.tokens.issueWithCooldown(userID, deps.Cooldown)
+		if errors.Is(err, errOneTimeTokenTooSoon) {
+			// the same response as when an email is sent so this can't be used to find out which emails are registered either
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to issue password reset token", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		msg := mailer.Message{
+			To:      email,
+			Subject: "Reset your Muzz password",
+			Body: fmt.Sprintf("Someone asked to reset the password for your account.\n\nReset your password here: %s\n\nThe link expires in %s. If it wasn't you, you can ignore this email.",
+				linkWithToken(deps.ResetURL, token), deps.Resets.tokens.ttl),
+		}
+
+		if err := deps.Mailer.Send(r.Context(), msg); err != nil {
+			slog.Error("failed to send password reset email", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// adds the token to the link as the `token` query param
+func linkWithToken(link string, token string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Request body for the ResetPasswordHandler
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ResetPasswordHandlerDeps struct {
+	DB            *sql.DB
+	Resets        *PasswordResets
+	Revocations   *RevocationStore
+	RefreshTokens *RefreshTokenStore
+}
+
+// sets a new password using the token from the reset email, the user is logged out everywhere
+func ResetPasswordHandler(deps ResetPasswordHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if err := user.ValidatePassword(req.Password); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// hashed before the token is used so the transaction isn't held open while hashing
+		hashedPassword, err := user.HashPassword(req.Password)
+		if err != nil {
+			slog.Error("failed to hash password", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		// the token is only used up if the password is changed, so a failed reset can be retried with the same link
+		tx, err := deps.DB.Begin()
+		if err != nil {
+			slog.Error("failed to begin password reset transaction", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+		defer tx.Rollback()
+
+		userID, err := deps.Resets.tokens.consumeWith(tx, req.Token)
+		if err != nil {
+			if errors.Is(err, errInvalidOneTimeToken) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid or expired reset token"})
+				return
+			}
+			slog.Error("failed to consume password reset token", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		if err := user.UpdatePasswordHash(tx, userID, hashedPassword); err != nil {
+			slog.Error("failed to update password", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit password reset", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		// whoever had access to the account before the reset shouldn't keep it
+		if err := deps.Revocations.RevokeUser(userID); err != nil {
+			slog.Error("failed to revoke access tokens after password reset", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		if err := deps.RefreshTokens.RevokeAllForUser(userID); err != nil {
+			slog.Error("failed to revoke refresh tokens after password reset", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reset password"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
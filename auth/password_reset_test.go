@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"bytes"
+	"muzz/mailer"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reads the token out of the links in every email in the outbox
+func tokensFromOutbox(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenParam := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+	tokens := []string{}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := tokenParam.FindStringSubmatch(string(content)); match != nil {
+			tokens = append(tokens, match[1])
+		}
+	}
+	return tokens
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := newTestDB(t)
+	outboxDir := t.TempDir()
+
+	outbox, err := mailer.NewOutboxMailer(outboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := user.StoreUser(db, user.User{Email: "test@example.com", Password: "old-password"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session is from a second ago, a token issued in the same second as the reset can't be told apart from a new login
+	tokenAuth := NewTokenAuthenticator(newTestKeySet(t), WithTimeFunc(func() time.Time { return time.Now().Add(-time.Second) }))
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+	resets := NewPasswordResets(db, time.Hour)
+	revocations, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user is logged in somewhere before they reset their password
+	accessToken, err := tokenAuth.GenerateJWTToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgot := ForgotPasswordHandler(ForgotPasswordHandlerDeps{DB: db, Resets: resets, Mailer: outbox, ResetURL: "https://muzz.example/reset"})
+	reset := ResetPasswordHandler(ResetPasswordHandlerDeps{DB: db, Resets: resets, Revocations: revocations, RefreshTokens: refreshTokens})
+
+	post := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post(forgot, `{"email": "unknown@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code, "unknown emails shouldn't be revealed")
+	assert.Empty(t, tokensFromOutbox(t, outboxDir))
+
+	rr = post(forgot, `{"email": "test@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	tokens := tokensFromOutbox(t, outboxDir)
+	if !assert.Len(t, tokens, 1) {
+		t.FailNow()
+	}
+	token := tokens[0]
+
+	rr = post(reset, `{"token": "unknown", "password": "new-password1"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = post(reset, `{"token": "`+token+`", "password": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = post(reset, `{"token": "`+token+`", "password": "no-numbers-here"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = post(reset, `{"token": "`+token+`", "password": "new-password1"}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	var storedPassword string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = 1").Scan(&storedPassword); err != nil {
+		t.Fatal(err)
+	}
+	match, _, err := user.DefaultPasswordHasher.Verify("new-password1", storedPassword)
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	// existing sessions are logged out
+	claims, err := tokenAuth.ExtractClaimsFromToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, revocations.IsRevoked(*claims))
+
+	_, _, err = refreshTokens.Rotate(refreshToken)
+	assert.ErrorIs(t, err, errInvalidRefreshToken)
+
+	// the token can only be used once
+	rr = post(reset, `{"token": "`+token+`", "password": "another-password1"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPasswordResetTokenExpires(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC)
+
+	resets := NewPasswordResets(db, time.Hour)
+	resets.tokens.clock = func() time.Time { return now }
+
+	token, err := resets.tokens.issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issuing a new token invalidates the old one
+	newToken, err := resets.tokens.issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resets.tokens.consume(token)
+	assert.ErrorIs(t, err, errInvalidOneTimeToken)
+
+	now = now.Add(time.Hour)
+	_, err = resets.tokens.consume(newToken)
+	assert.ErrorIs(t, err, errInvalidOneTimeToken)
+}
+
+func TestPasswordResetKeepsTokenWhenUpdateFails(t *testing.T) {
+	db := newTestDB(t)
+
+	resets := NewPasswordResets(db, time.Hour)
+	revocations, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := ResetPasswordHandler(ResetPasswordHandlerDeps{DB: db, Resets: resets, Revocations: revocations, RefreshTokens: NewRefreshTokenStore(db, time.Hour)})
+
+	// the token is for a user who doesn't exist so the password can't be updated
+	token, err := resets.tokens.issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	reset.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"token": "`+token+`", "password": "new-password1"}`)))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	_, err = resets.tokens.consume(token)
+	assert.NoError(t, err, "the token should still be usable")
+}
+
+func TestForgotPasswordCooldown(t *testing.T) {
+	db := newTestDB(t)
+	outboxDir := t.TempDir()
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC)
+
+	outbox, err := mailer.NewOutboxMailer(outboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := user.StoreUser(db, user.User{Email: "test@example.com", Password: "password123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resets := NewPasswordResets(db, time.Hour)
+	resets.tokens.clock = func() time.Time { return now }
+	forgot := ForgotPasswordHandler(ForgotPasswordHandlerDeps{DB: db, Resets: resets, Mailer: outbox, ResetURL: "https://muzz.example/reset", Cooldown: time.Minute * 5})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		forgot.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := post(`{"email": "  Test@EXAMPLE.com "}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	// the email goes to the stored address rather than what was typed
+	entries, err := os.ReadDir(outboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 1) {
+		content, err := os.ReadFile(filepath.Join(outboxDir, entries[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(content), "To: test@example.com\r\n")
+	}
+
+	// asking again straight away doesn't send another email
+	rr = post(`{"email": "test@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Len(t, tokensFromOutbox(t, outboxDir), 1)
+
+	now = now.Add(time.Minute * 5)
+	rr = post(`{"email": "test@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Len(t, tokensFromOutbox(t, outboxDir), 2)
+}
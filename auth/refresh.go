@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"muzz/httpresponse"
+	"net/http"
+	"time"
+)
+
+// DefaultRefreshTokenTTL is how long a refresh token can be used for before the user has to login again
+const DefaultRefreshTokenTTL = time.Hour * 24 * 30
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token has expired")
+	errRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// Issues a new opaque refresh token for the user
+type RefreshTokenIssuer func(userID int) (string, error)
+
+// RefreshTokenStore persists opaque refresh tokens.
+// Every time a refresh token is used it's rotated for a new one, if a used token is presented again
+// we assume it has been stolen and revoke every token descended from the same login.
+type RefreshTokenStore struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates a store for refresh tokens which expire after the given ttl
+func NewRefreshTokenStore(db *sql.DB, ttl time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{db: db, ttl: ttl}
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (s *RefreshTokenStore) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// Issues a refresh token for a fresh login, starting a new token family
+func (s *RefreshTokenStore) Issue(userID int) (string, error) {
+	family, _, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return s.insert(s.db, userID, family)
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *RefreshTokenStore) insert(db dbExecutor, userID int, family string) (string, error) {
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := s.now()
+	_, err = db.Exec("INSERT INTO refresh_tokens (user_id, family, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, family, hash, now.Unix(), now.Add(s.ttl).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Exchanges a refresh token for a new one, the old token can't be used again.
+// Returns the user the token belongs to along with the new refresh token.
+func (s *RefreshTokenStore) Rotate(token string) (userID int, newToken string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var family string
+	var expiresAt int64
+	var usedAt, revokedAt sql.NullInt64
+
+	err = tx.QueryRow("SELECT id, user_id, family, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = ?", hashOpaqueToken(token)).
+		Scan(&id, &userID, &family, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, "", errInvalidRefreshToken
+		}
+		return 0, "", err
+	}
+
+	now := s.now()
+
+	if revokedAt.Valid {
+		return 0, "", errInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		// the token has been presented twice, one of the holders must have stolen it
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at IS NULL", now.Unix(), family); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", errRefreshTokenReused
+	}
+
+	if now.Unix() >= expiresAt {
+		return 0, "", errRefreshTokenExpired
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now.Unix(), id); err != nil {
+		return 0, "", err
+	}
+
+	newToken, err = s.insert(tx, userID, family)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	return userID, newToken, nil
+}
+
+// Revokes the refresh token and every other token rotated from the same login
+// tokens belonging to other users are ignored
+func (s *RefreshTokenStore) RevokeFamily(userID int, token string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked_at = ?
+	WHERE revoked_at IS NULL AND user_id = ? AND family = (SELECT family FROM refresh_tokens WHERE token_hash = ?)`,
+		s.now().Unix(), userID, hashOpaqueToken(token))
+	return err
+}
+
+// Revokes every refresh token belonging to the user, logging them out everywhere
+func (s *RefreshTokenStore) RevokeAllForUser(userID int) error {
+	_, err := s.db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", s.now().Unix(), userID)
+	return err
+}
+
+// Request body for the RefreshTokenHandler
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenResponse is returned to the client whenever they are issued new tokens
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type RefreshTokenHandlerDeps struct {
+	RefreshTokens *RefreshTokenStore
+	JwtTokenGenerator
+}
+
+// exchanges a refresh token for a new access token and a new refresh token
+func RefreshTokenHandler(deps RefreshTokenHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req RefreshTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		userID, refreshToken, err := deps.RefreshTokens.Rotate(req.RefreshToken)
+		if err != nil {
+			if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenExpired) || errors.Is(err, errRefreshTokenReused) {
+				slog.Warn("refresh token rejected", slog.Any("error", err))
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid refresh token"})
+				return
+			}
+			slog.Error("error rotating refresh token", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to refresh token"})
+			return
+		}
+
+		token, err := deps.JwtTokenGenerator(userID)
+		if err != nil {
+			slog.Error("error generating JWT", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to generate token"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(TokenResponse{Token: token, RefreshToken: refreshToken})
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"muzz/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db := newTestDB(t)
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+
+	first, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, second, err := refreshTokens.Rotate(first)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, userID)
+	assert.NotEqual(t, first, second)
+
+	userID, third, err := refreshTokens.Rotate(second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, userID)
+
+	// presenting an old token again means it was stolen, every token in the family is revoked
+	_, _, err = refreshTokens.Rotate(first)
+	assert.ErrorIs(t, err, errRefreshTokenReused)
+
+	_, _, err = refreshTokens.Rotate(third)
+	assert.ErrorIs(t, err, errInvalidRefreshToken)
+
+	// other logins aren't affected
+	other, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = refreshTokens.Rotate(other)
+	assert.NoError(t, err)
+}
+
+func TestRefreshTokenExpires(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC)
+
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+	refreshTokens.clock = func() time.Time { return now }
+
+	token, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+
+	_, _, err = refreshTokens.Rotate(token)
+	assert.ErrorIs(t, err, errRefreshTokenExpired)
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	db := newTestDB(t)
+	refreshTokens := NewRefreshTokenStore(db, time.Hour)
+	tokenAuth := NewTokenAuthenticator(newTestKeySet(t))
+
+	validToken, err := refreshTokens.Issue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usedToken, err := refreshTokens.Issue(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := refreshTokens.Rotate(usedToken); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		expectedUserID int
+	}{
+		{
+			name:           "Invalid payload",
+			reqBody:        `invalid_json_payload`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No refresh token given",
+			reqBody:        `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown refresh token",
+			reqBody:        `{"refresh_token": "unknown"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Refresh token has already been used",
+			reqBody:        `{"refresh_token": "` + usedToken + `"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Valid refresh token",
+			reqBody:        `{"refresh_token": "` + validToken + `"}`,
+			expectedStatus: http.StatusOK,
+			expectedUserID: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/token/refresh", bytes.NewBufferString(tt.reqBody))
+			rr := httptest.NewRecorder()
+
+			RefreshTokenHandler(RefreshTokenHandlerDeps{RefreshTokens: refreshTokens, JwtTokenGenerator: tokenAuth.GenerateJWTToken}).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+
+			if rr.Code == http.StatusOK {
+				var response TokenResponse
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+
+				assert.NotEmpty(t, response.RefreshToken)
+				assert.NotEqual(t, validToken, response.RefreshToken)
+
+				claims, err := tokenAuth.ExtractClaimsFromToken(response.Token)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedUserID, claims.UserID)
+			}
+		})
+	}
+}
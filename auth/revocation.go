@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps track of access tokens that have been revoked before they expired.
+// Revocations are persisted to the db but every check is served from memory,
+// so the auth guard doesn't need to hit the db on every request.
+//
+// The cache is only updated by this process, if multiple instances share a db they won't see each others revocations
+// until they are restarted.
+type RevocationStore struct {
+	db *sql.DB
+
+	mu sync.RWMutex
+	// jti of revoked tokens mapped to when the token expires
+	tokens map[string]time.Time
+	// tokens issued to the user before this time are revoked, whole seconds like a token's iat
+	users map[int]time.Time
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates the revocation store, loading the existing revocations from the db into memory
+func NewRevocationStore(db *sql.DB) (*RevocationStore, error) {
+	s := &RevocationStore{db: db, tokens: map[string]time.Time{}, users: map[int]time.Time{}}
+
+	// expired tokens would be rejected anyway so there's no need to remember them
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", s.now().Unix()); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT jti, expires_at FROM revoked_tokens")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jti string
+		var expiresAt int64
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return nil, err
+		}
+		s.tokens[jti] = time.Unix(expiresAt, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	userRows, err := db.Query("SELECT user_id, revoked_before FROM user_token_revocations")
+	if err != nil {
+		return nil, err
+	}
+	defer userRows.Close()
+
+	for userRows.Next() {
+		var userID int
+		var revokedBefore int64
+		if err := userRows.Scan(&userID, &revokedBefore); err != nil {
+			return nil, err
+		}
+		s.users[userID] = time.Unix(revokedBefore, 0)
+	}
+
+	return s, userRows.Err()
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (s *RevocationStore) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// Revokes a single access token, e.g. when the user logs out
+func (s *RevocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", jti, expiresAt.Unix()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[jti] = expiresAt
+	s.pruneLocked()
+
+	return nil
+}
+
+// Revokes every access token issued to the user so far, e.g. when the user is banned or resets their password
+func (s *RevocationStore) RevokeUser(userID int) error {
+	// a token's iat is truncated to the second, so a token issued straight after this in the same second still works
+	revokedBefore := s.now().Truncate(time.Second)
+
+	_, err := s.db.Exec(`INSERT INTO user_token_revocations (user_id, revoked_before) VALUES (?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET revoked_before = excluded.revoked_before`, userID, revokedBefore.Unix())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[userID] = revokedBefore
+
+	return nil
+}
+
+// reports whether the token the claims came from has been revoked
+func (s *RevocationStore) IsRevoked(claims JWTClaims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if claims.ID != "" {
+		if _, revoked := s.tokens[claims.ID]; revoked {
+			return true
+		}
+	}
+
+	revokedBefore, found := s.users[claims.UserID]
+	if !found {
+		return false
+	}
+
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(revokedBefore)
+}
+
+// removes expired tokens from memory, must be called with the lock held
+func (s *RevocationStore) pruneLocked() {
+	now := s.now()
+	for jti, expiresAt := range s.tokens {
+		if expiresAt.Before(now) {
+			delete(s.tokens, jti)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationStore(t *testing.T) {
+	db := newTestDB(t)
+	// the store prunes expired tokens with the real clock when it's created
+	now := time.Now().Truncate(time.Second)
+
+	revocations, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations.clock = func() time.Time { return now }
+
+	claims := func(userID int, jti string, issuedAt time.Time) JWTClaims {
+		return JWTClaims{UserID: userID, RegisteredClaims: jwt.RegisteredClaims{ID: jti, IssuedAt: jwt.NewNumericDate(issuedAt)}}
+	}
+
+	loggedOut := claims(1, "logged-out", now)
+	stillLoggedIn := claims(1, "still-logged-in", now)
+	issuedBeforeBan := claims(2, "before-ban", now.Add(-time.Minute))
+	issuedAfterBan := claims(2, "after-ban", now.Add(time.Second))
+	// in the same second as the ban, a token's iat is only whole seconds so it can't be told apart from one issued after
+	issuedWithBan := claims(2, "with-ban", now)
+
+	if err := revocations.RevokeToken(loggedOut.ID, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := revocations.RevokeUser(2); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, revocations.IsRevoked(loggedOut))
+	assert.False(t, revocations.IsRevoked(stillLoggedIn))
+	assert.True(t, revocations.IsRevoked(issuedBeforeBan))
+	assert.False(t, revocations.IsRevoked(issuedAfterBan))
+	assert.False(t, revocations.IsRevoked(issuedWithBan))
+
+	// revocations survive a restart
+	reloaded, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, reloaded.IsRevoked(loggedOut))
+	assert.False(t, reloaded.IsRevoked(stillLoggedIn))
+	assert.True(t, reloaded.IsRevoked(issuedBeforeBan))
+	assert.False(t, reloaded.IsRevoked(issuedAfterBan))
+}
+
+func TestRevokeUserThenLogInInTheSameSecond(t *testing.T) {
+	db := newTestDB(t)
+	revocations, err := NewRevocationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// half way through a second so the login straight after the reset is in the same second, in the past as the tokens
+	// are checked against the real clock
+	now := time.Now().Truncate(time.Second).Add(-time.Second*3 + time.Millisecond*500)
+	revocations.clock = func() time.Time { return now }
+	authenticator := NewTokenAuthenticator(newTestKeySet(t), WithTimeFunc(func() time.Time { return now }))
+
+	login := func() JWTClaims {
+		t.Helper()
+		token, err := authenticator.GenerateJWTToken(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := authenticator.ExtractClaimsFromToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *claims
+	}
+
+	oldLogin := login()
+
+	// a second later they reset their password and log straight back in
+	now = now.Add(time.Second)
+	if err := revocations.RevokeUser(1); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Millisecond * 100)
+	newLogin := login()
+
+	assert.True(t, revocations.IsRevoked(oldLogin))
+	assert.False(t, revocations.IsRevoked(newLogin))
+}
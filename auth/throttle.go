@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"muzz/httpresponse"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ThrottlePolicy controls how quickly repeated login failures are slowed down and then locked out
+type ThrottlePolicy struct {
+	// number of failures allowed before the client has to wait between attempts
+	FreeAttempts int
+	// wait after the first failure past the free attempts, doubles with every further failure
+	BaseDelay time.Duration
+	// number of failures before attempts are rejected for the whole lockout duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// failures are forgotten when there hasn't been one for this long
+	ResetAfter time.Duration
+}
+
+var (
+	// DefaultEmailThrottlePolicy is applied to every email address
+	DefaultEmailThrottlePolicy = ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, LockoutThreshold: 10, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+	// DefaultIPThrottlePolicy is applied to every client address, it's more lenient as many users can share an address
+	DefaultIPThrottlePolicy = ThrottlePolicy{FreeAttempts: 20, BaseDelay: time.Second, LockoutThreshold: 100, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+)
+
+// how long the client must wait after the last failure before they can try again
+// the delay never exceeds the lockout duration
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failures && delay < p.LockoutDuration; i++ {
+		delay *= 2
+	}
+	return min(delay, p.LockoutDuration)
+}
+
+// LoginThrottle tracks failed logins for each email and each client address.
+// After a few failures the client has to wait an increasing amount of time between attempts and eventually they are locked out.
+// Attempts made too early are rejected rather than delayed, so attackers can't tie up the server.
+type LoginThrottle struct {
+	db          *sql.DB
+	emailPolicy ThrottlePolicy
+	ipPolicy    ThrottlePolicy
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates a login throttle which persists its state to the db
+func NewLoginThrottle(db *sql.DB, emailPolicy ThrottlePolicy, ipPolicy ThrottlePolicy) *LoginThrottle {
+	return &LoginThrottle{db: db, emailPolicy: emailPolicy, ipPolicy: ipPolicy}
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (l *LoginThrottle) now() time.Time {
+	if l.clock == nil {
+		return time.Now()
+	}
+	return l.clock()
+}
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(address string) string {
+	return "ip:" + address
+}
+
+// returns the address of the client, forwarded headers are ignored as they can be spoofed
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// how long the client has to wait before the key is allowed to attempt a login, zero if they can try now
+func (l *LoginThrottle) retryAfter(db dbQueryRower, key string, policy ThrottlePolicy) (time.Duration, error) {
+	var failures int
+	var lastFailureAt int64
+	var lockedUntil sql.NullInt64
+
+	err := db.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = ?", key).
+		Scan(&failures, &lastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := l.now()
+
+	if lockedUntil.Valid {
+		if wait := time.Unix(lockedUntil.Int64, 0).Sub(now); wait > 0 {
+			return wait, nil
+		}
+	}
+
+	lastFailure := time.Unix(lastFailureAt, 0)
+	if now.Sub(lastFailure) >= policy.ResetAfter {
+		return 0, nil
+	}
+
+	return max(lastFailure.Add(policy.delay(failures)).Sub(now), 0), nil
+}
+
+// Reserve checks the email and client address are allowed to attempt a login and counts the attempt as a failure up front.
+// The check and the count happen in one transaction so parallel guesses can't all get past the throttle before any of them is recorded.
+// Returns how long the client has to wait when they aren't allowed to try yet, in which case nothing is counted.
+// The attempt is given back by RecordSuccess or Release once the credentials turn out to be right.
+func (l *LoginThrottle) Reserve(email string, address string) (time.Duration, error) {
+	emailKey, ipKey := emailThrottleKey(email), ipThrottleKey(address)
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// sqlite only takes the write lock on the first write, so one is made before anything is read.
+	// Otherwise two transactions could read the same counts and then one would fail to upgrade its lock.
+	if _, err := tx.Exec("UPDATE login_attempts SET key = key WHERE key IN (?, ?)", emailKey, ipKey); err != nil {
+		return 0, err
+	}
+
+	emailWait, err := l.retryAfter(tx, emailKey, l.emailPolicy)
+	if err != nil {
+		return 0, err
+	}
+
+	ipWait, err := l.retryAfter(tx, ipKey, l.ipPolicy)
+	if err != nil {
+		return 0, err
+	}
+
+	if wait := max(emailWait, ipWait); wait > 0 {
+		return wait, nil
+	}
+
+	if err := l.recordFailureWith(tx, emailKey, l.emailPolicy); err != nil {
+		return 0, err
+	}
+	if err := l.recordFailureWith(tx, ipKey, l.ipPolicy); err != nil {
+		return 0, err
+	}
+
+	return 0, tx.Commit()
+}
+
+// counts a failed login against the key, locking it out once there are too many
+func (l *LoginThrottle) recordFailureWith(tx *sql.Tx, key string, policy ThrottlePolicy) error {
+	now := l.now()
+
+	var failures int
+	var lastFailureAt int64
+	var lockedUntil sql.NullInt64
+
+	err := tx.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = ?", key).
+		Scan(&failures, &lastFailureAt, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// old failures are forgotten, as is a lockout which has run its course
+	lockoutExpired := lockedUntil.Valid && now.Unix() >= lockedUntil.Int64
+	if now.Sub(time.Unix(lastFailureAt, 0)) >= policy.ResetAfter || lockoutExpired {
+		failures = 0
+		lockedUntil = sql.NullInt64{}
+	}
+
+	failures++
+
+	if failures >= policy.LockoutThreshold {
+		lockedUntil = sql.NullInt64{Int64: now.Add(policy.LockoutDuration).Unix(), Valid: true}
+	}
+
+	_, err = tx.Exec(`INSERT INTO login_attempts (key, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?)
+	ON CONFLICT(key) DO UPDATE SET failures = excluded.failures, last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		key, failures, now.Unix(), lockedUntil)
+	return err
+}
+
+// gives back an attempt taken by Reserve, for when the password was right but the login isn't finished yet
+func (l *LoginThrottle) Release(email string, address string) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := releaseWith(tx, emailThrottleKey(email), l.emailPolicy); err != nil {
+		return err
+	}
+	if err := releaseWith(tx, ipThrottleKey(address), l.ipPolicy); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// takes one failure off the key, lifting the lockout if that failure is what caused it
+func releaseWith(tx *sql.Tx, key string, policy ThrottlePolicy) error {
+	_, err := tx.Exec(`UPDATE login_attempts SET failures = failures - 1,
+	locked_until = CASE WHEN failures - 1 < ? THEN NULL ELSE locked_until END
+	WHERE key = ? AND failures > 0`, policy.LockoutThreshold, key)
+	return err
+}
+
+// forgets the failures for the email after a successful login and gives back the attempt taken from the client address.
+// The client address keeps its other failures, otherwise an attacker could reset them with their own account
+func (l *LoginThrottle) RecordSuccess(email string, address string) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE key = ?", emailThrottleKey(email)); err != nil {
+		return err
+	}
+	if err := releaseWith(tx, ipThrottleKey(address), l.ipPolicy); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Lockout is an email or client address which is currently being throttled
+type Lockout struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+	LockedUntil   time.Time `json:"lockedUntil"`
+}
+
+// returns every email and client address which is currently locked out
+func (l *LoginThrottle) Lockouts() ([]Lockout, error) {
+	rows, err := l.db.Query("SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE locked_until > ? ORDER BY locked_until DESC", l.now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []Lockout{}
+	for rows.Next() {
+		var lockout Lockout
+		var lastFailureAt, lockedUntil int64
+		if err := rows.Scan(&lockout.Key, &lockout.Failures, &lastFailureAt, &lockedUntil); err != nil {
+			return nil, err
+		}
+		lockout.LastFailureAt = time.Unix(lastFailureAt, 0).UTC()
+		lockout.LockedUntil = time.Unix(lockedUntil, 0).UTC()
+		lockouts = append(lockouts, lockout)
+	}
+
+	return lockouts, rows.Err()
+}
+
+// clears the failures for the key, lifting any lockout
+func (l *LoginThrottle) Unlock(key string) error {
+	_, err := l.db.Exec("DELETE FROM login_attempts WHERE key = ?", key)
+	return err
+}
+
+// The JSON response for the lockouts handler
+type LockoutsResponse struct {
+	Results []Lockout `json:"results"`
+}
+
+type LockoutsHandlerDeps struct {
+	Throttle *LoginThrottle
+}
+
+// lists the emails and client addresses which are currently locked out, for admins
+func LockoutsHandler(deps LockoutsHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		lockouts, err := deps.Throttle.Lockouts()
+		if err != nil {
+			slog.Error("failed to get lockouts", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get lockouts"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(LockoutsResponse{Results: lockouts})
+	}
+}
+
+// lifts the lockout on the email or client address given by the `key` path value, for admins
+func UnlockHandler(deps LockoutsHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := deps.Throttle.Unlock(r.PathValue("key")); err != nil {
+			slog.Error("failed to unlock", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to unlock"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
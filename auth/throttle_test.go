@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"muzz/store"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottlePolicyDelay(t *testing.T) {
+	policy := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, LockoutThreshold: 10, LockoutDuration: time.Minute}
+
+	assert.Equal(t, time.Duration(0), policy.delay(2))
+	assert.Equal(t, time.Second, policy.delay(3))
+	assert.Equal(t, time.Second*2, policy.delay(4))
+	assert.Equal(t, time.Second*4, policy.delay(5))
+	assert.Equal(t, time.Minute, policy.delay(1000), "delay should be capped to the lockout duration")
+}
+
+func TestLoginThrottle(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC)
+
+	policy := ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Second * 10, LockoutThreshold: 4, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+	newThrottle := func() *LoginThrottle {
+		throttle := NewLoginThrottle(db, policy, DefaultIPThrottlePolicy)
+		throttle.clock = func() time.Time { return now }
+		return throttle
+	}
+	throttle := newThrottle()
+
+	// every attempt which is let through counts as a failure until it is given back
+	assertReserve := func(expectedWait time.Duration) {
+		t.Helper()
+		wait, err := throttle.Reserve("Test@Example.com", "127.0.0.1")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedWait, wait)
+	}
+
+	assertReserve(0)
+	assertReserve(0)
+	assertReserve(time.Second * 10)
+
+	// attempts which had to wait weren't counted
+	now = now.Add(time.Second * 10)
+	assertReserve(0)
+	assertReserve(time.Second * 20)
+
+	now = now.Add(time.Second * 20)
+	assertReserve(0)
+	assertReserve(time.Minute * 15)
+
+	// the lockout survives a restart and is visible to admins
+	throttle = newThrottle()
+	assertReserve(time.Minute * 15)
+
+	lockouts, err := throttle.Lockouts()
+	assert.NoError(t, err)
+	if assert.Len(t, lockouts, 1) {
+		assert.Equal(t, "email:test@example.com", lockouts[0].Key)
+		assert.Equal(t, 4, lockouts[0].Failures)
+	}
+
+	// admins can lift the lockout
+	if err := throttle.Unlock("email:test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	assertReserve(0)
+	assertReserve(0)
+	assertReserve(time.Second * 10)
+
+	// a right password which still needs a two factor code gives its attempt back
+	if err := throttle.Release("test@example.com", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	assertReserve(0)
+
+	// a successful login forgets the failures
+	if err := throttle.RecordSuccess("test@example.com", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	assertReserve(0)
+	assertReserve(0)
+	assertReserve(time.Second * 10)
+}
+
+func TestLoginThrottleConcurrentReservations(t *testing.T) {
+	// a file rather than memory so the reservations run on separate connections like they would in production
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "throttle.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Minute, LockoutThreshold: 5, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+	throttle := NewLoginThrottle(db, policy, DefaultIPThrottlePolicy)
+	now := time.Now()
+	throttle.clock = func() time.Time { return now }
+
+	const attempts = 50
+	allowed := make(chan bool, attempts)
+
+	var wg sync.WaitGroup
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := throttle.Reserve("test@example.com", "127.0.0.1")
+			assert.NoError(t, err)
+			allowed <- err == nil && wait == 0
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+
+	count := 0
+	for ok := range allowed {
+		if ok {
+			count++
+		}
+	}
+
+	// only the free attempts are let through however many arrive at once
+	assert.Equal(t, policy.FreeAttempts, count)
+
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_attempts WHERE key = ?", emailThrottleKey("test@example.com")).Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, policy.FreeAttempts, failures)
+}
+
+func TestLoginHandlerLockout(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := user.StoreUser(db, user.User{Email: "test@example.com", Password: "password123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Minute, LockoutThreshold: 5, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+	throttle := NewLoginThrottle(db, policy, DefaultIPThrottlePolicy)
+	// a fixed clock as the failure is counted before the password is checked, which can take long enough to change the wait
+	now := time.Now()
+	throttle.clock = func() time.Time { return now }
+	handler := LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: NewTokenAuthenticator(newTestKeySet(t)).GenerateJWTToken, Throttle: throttle})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(user.User{Email: "test@example.com", Password: password})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(reqBody))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := login("wrong-password")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// even the right password is rejected until the delay has passed
+	rr = login("password123")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+}
+
+func TestLoginHandlerConcurrentGuesses(t *testing.T) {
+	// a file rather than memory so the guesses run on separate connections like they would in production
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "throttle.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := user.StoreUser(db, user.User{Email: "test@example.com", Password: "password123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Minute, LockoutThreshold: 5, LockoutDuration: time.Minute * 15, ResetAfter: time.Hour}
+	throttle := NewLoginThrottle(db, policy, DefaultIPThrottlePolicy)
+	handler := LoginHandler(LoginHandlerDeps{DB: db, JwtTokenGenerator: NewTokenAuthenticator(newTestKeySet(t)).GenerateJWTToken, Throttle: throttle})
+
+	const guesses = 50
+	codes := make(chan int, guesses)
+
+	var wg sync.WaitGroup
+	for range guesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reqBody, _ := json.Marshal(user.User{Email: "test@example.com", Password: "wrong-password"})
+			req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(reqBody))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+
+	// only the free attempts get to check a password, the rest have to wait for the delay
+	assert.Equal(t, policy.FreeAttempts, counts[http.StatusUnauthorized])
+	assert.Equal(t, guesses-policy.FreeAttempts, counts[http.StatusTooManyRequests])
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.code, totpCode(secret, totpStep(time.Unix(tc.unix, 0))))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	encodedSecret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	step, ok := validateTOTP(encodedSecret, "081804", now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// codes from the neighbouring steps are accepted for clock drift
+	_, ok = validateTOTP(encodedSecret, "081804", now.Add(totpPeriod))
+	assert.True(t, ok)
+
+	_, ok = validateTOTP(encodedSecret, "081804", now.Add(totpPeriod*2))
+	assert.False(t, ok)
+
+	_, ok = validateTOTP(encodedSecret, "000000", now)
+	assert.False(t, ok)
+
+	_, ok = validateTOTP("not base32!", "081804", now)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(totpURI("Muzz", "test@example.com", "SECRET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Muzz:test@example.com", uri.Path)
+	assert.Equal(t, "SECRET", uri.Query().Get("secret"))
+	assert.Equal(t, "Muzz", uri.Query().Get("issuer"))
+}
@@ -0,0 +1,98 @@
+// Compares discover scorers offline by replaying the swipe history from a copy of the database and measuring how
+// highly each scorer ranked the people users went on to like
+//
+//	go run ./cmd/evaluate-ranking -db ./muzz.db -scorers ./scorers.json -k 10
+//
+// The scorers file is a JSON list of named scorer weights, weights which are left out are 0. Without a file the default
+// scorer is evaluated on its own:
+//
+//	[{"name": "default", "scorer": {"distance_weight": 0.8, "likes_weight": 0.2}}]
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"muzz/matchmaker"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	path := flag.String("db", "./muzz.db", "path to the sqlite database, it is only read")
+	scorersPath := flag.String("scorers", "", "path to a JSON file of the scorers to compare")
+	k := flag.Int("k", 10, "how many of the top ranked candidates are looked at")
+	every := flag.Int("every", 1, "only evaluate every Nth swipe, for large histories")
+	// default to the server's settings so the candidates are the ones discover finds
+	requireVerifiedEmail := flag.Bool("require-verified-email", os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true", "leave out users who haven't verified their email, defaults to REQUIRE_VERIFIED_EMAIL")
+	maxDistanceKm := flag.Float64("default-max-distance-km", envFloat("DISCOVER_MAX_DISTANCE_KM"), "max distance for users who have never saved preferences, 0 for no limit, defaults to DISCOVER_MAX_DISTANCE_KM")
+	flag.Parse()
+
+	scorers, err := loadScorers(*scorersPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+*path+"?mode=ro")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	results, err := matchmaker.Evaluate(context.Background(), db, scorers, matchmaker.EvaluationOptions{
+		K:                    *k,
+		Every:                *every,
+		Now:                  time.Now(),
+		RequireVerifiedEmail: *requireVerifiedEmail,
+		DefaultMaxDistanceKm: *maxDistanceKm,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "scorer\tswipes\tprecision@%d\tndcg@%d\tmatch rate@%d\n", *k, *k, *k)
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%.4f\t%.4f\t%.4f\n", r.Scorer, r.Points, r.PrecisionAtK, r.NDCGAtK, r.MatchRateAtK)
+	}
+	w.Flush()
+
+	if len(results) > 0 && results[0].DeletedSwipers > 0 {
+		fmt.Printf("skipped %d swipes from users who have since been deleted\n", results[0].DeletedSwipers)
+	}
+}
+
+// the number in the env var, 0 when it isn't set or isn't a number
+func envFloat(key string) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// the scorers in the JSON file at path, or the default scorer on its own when there is no file. Weights left out of
+// the file are 0.
+func loadScorers(path string) ([]matchmaker.NamedScorer, error) {
+	if path == "" {
+		return []matchmaker.NamedScorer{{Name: "default", Scorer: matchmaker.DefaultScorer.(matchmaker.WeightedScorer)}}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// decoded into an empty slice so none of the default weights are kept
+	scorers := []matchmaker.NamedScorer{}
+	if err := json.Unmarshal(data, &scorers); err != nil {
+		return nil, fmt.Errorf("invalid scorers file: %w", err)
+	}
+	return scorers, nil
+}
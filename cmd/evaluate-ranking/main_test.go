@@ -0,0 +1,38 @@
+package main
+
+import (
+	"muzz/matchmaker"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadScorers(t *testing.T) {
+	scorers, err := loadScorers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []matchmaker.NamedScorer{{Name: "default", Scorer: matchmaker.DefaultScorer.(matchmaker.WeightedScorer)}}, scorers)
+
+	// weights which aren't in the file are 0 rather than the default weights
+	path := filepath.Join(t.TempDir(), "scorers.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "distance", "scorer": {"distance_weight": 1}}, {"name": "likes", "scorer": {"likes_weight": 1}}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	scorers, err = loadScorers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []matchmaker.NamedScorer{
+		{Name: "distance", Scorer: matchmaker.WeightedScorer{DistanceWeight: 1}},
+		{Name: "likes", Scorer: matchmaker.WeightedScorer{LikesWeight: 1}},
+	}, scorers)
+
+	if err := os.WriteFile(path, []byte(`{`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadScorers(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+// Recomputes everyone's desirability rating by replaying the swipe history, e.g. after changing how ratings are
+// calculated or to fill in ratings for swipes made before they existed. The rating columns are added first when the
+// database was created before them, so it can be run on an old database before the server is upgraded.
+//
+//	go run ./cmd/recompute-ratings -db ./muzz.db
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"muzz/matchmaker"
+	"muzz/store"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	path := flag.String("db", "./muzz.db", "path to the sqlite database")
+	flag.Parse()
+
+	db, err := sql.Open("sqlite3", *path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := store.Migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := matchmaker.RecomputeRatings(db); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Ratings recomputed")
+}
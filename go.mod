@@ -3,7 +3,6 @@ module muzz
 go 1.22.2
 
 require (
-	github.com/go-faker/faker/v4 v4.4.1
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/mattn/go-sqlite3 v1.14.22
 )
@@ -11,11 +10,12 @@ require (
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/crypto v0.22.0
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/image v0.18.0
 )
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// OutboxMailer writes every message to a file in a directory instead of sending it.
+// Used for local development and testing, so emails can be read without a mail server.
+type OutboxMailer struct {
+	dir string
+
+	// guards the sequence number
+	mu  sync.Mutex
+	seq int
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates an outbox mailer which writes messages to the given directory, creating it if necessary
+func NewOutboxMailer(dir string) (*OutboxMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox: %w", err)
+	}
+	return &OutboxMailer{dir: dir}, nil
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (o *OutboxMailer) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock()
+}
+
+// characters which aren't safe to use in a file name
+var unsafeFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+// writes the message to `<timestamp>-<seq>-<recipient>.eml` in the outbox
+func (o *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := o.now()
+
+	o.mu.Lock()
+	o.seq++
+	seq := o.seq
+	o.mu.Unlock()
+
+	name := fmt.Sprintf("%s-%d-%s.eml", now.UTC().Format("20060102T150405"), seq, unsafeFileNameChars.ReplaceAllString(msg.To, "_"))
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		msg.To, msg.Subject, now.Format(time.RFC1123Z), msg.Body)
+
+	return os.WriteFile(filepath.Join(o.dir, name), []byte(content), 0o600)
+}
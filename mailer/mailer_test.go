@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+
+	outbox, err := NewOutboxMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.clock = func() time.Time { return time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC) }
+
+	msg := Message{To: "test@example.com", Subject: "Hello", Body: "Hello world"}
+	if err := outbox.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, entries, 2, "every message should be written to its own file") {
+		assert.Equal(t, "20240401T000000-1-test@example.com.eml", entries[0].Name())
+
+		content, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Contains(t, string(content), "To: test@example.com\r\n")
+		assert.Contains(t, string(content), "Subject: Hello\r\n")
+		assert.Contains(t, string(content), "\r\n\r\nHello world")
+	}
+}
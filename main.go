@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/slog"
 	"muzz/auth"
+	"muzz/mailer"
 	"muzz/matchmaker"
 	"muzz/middleware"
+	"muzz/photo"
+	"muzz/profile"
 	"muzz/store"
 	"muzz/user"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -24,29 +32,142 @@ func main() {
 	}
 	defer db.Close()
 
-	if _, err := db.Exec(store.SchemaSQL); err != nil {
+	if err := store.Migrate(db); err != nil {
 		log.Fatal(err)
 	}
 
+	passwordHasher, err := loadPasswordHasher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	user.DefaultPasswordHasher = passwordHasher
+
 	testUser := user.User{Name: "TestUser", Email: "testuser@gmail.com", Password: "password"}
 	if err := user.StoreUser(db, testUser); err != nil {
 		slog.Error("failed to create test user for application", slog.Any("error", err))
 	}
 
-	tokenAuth := auth.NewTokenAuthenticator()
-	authGuardMiddleware := middleware.NewAuthGuardMiddleware(tokenAuth.ExtractClaimsFromToken)
+	keys, err := loadKeySet()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokenAuth := auth.NewTokenAuthenticator(keys)
+	refreshTokens := auth.NewRefreshTokenStore(db, auth.DefaultRefreshTokenTTL)
+
+	revocations, err := auth.NewRevocationStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authGuardMiddleware := middleware.NewAuthGuardMiddleware(tokenAuth.ExtractClaimsFromToken, middleware.WithRevocationCheck(revocations.IsRevoked))
+	adminGuardMiddleware := middleware.NewAdminGuardMiddleware(func(userID int) (bool, error) { return user.IsAdmin(db, userID) })
+
+	loginThrottle := auth.NewLoginThrottle(db, auth.DefaultEmailThrottlePolicy, auth.DefaultIPThrottlePolicy)
+	passwordResets := auth.NewPasswordResets(db, auth.DefaultPasswordResetTTL)
+
+	outbox, err := mailer.NewOutboxMailer(getEnv("MAILER_OUTBOX_DIR", "./outbox"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	emailVerifications := auth.NewEmailVerifications(db, outbox, getEnv("EMAIL_VERIFY_URL", "http://localhost:8080/email/verify"), auth.DefaultEmailVerificationTTL)
+	requireVerifiedEmail := os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
+	discoverMaxDistanceKm, err := strconv.ParseFloat(getEnv("DISCOVER_MAX_DISTANCE_KM", "0"), 64)
+	if err != nil || discoverMaxDistanceKm < 0 {
+		log.Fatalf("DISCOVER_MAX_DISTANCE_KM must be 0 (unlimited) or a positive number: %q", os.Getenv("DISCOVER_MAX_DISTANCE_KM"))
+	}
+
+	photoBlobs, err := photo.NewLocalBlobStore(getEnv("PHOTO_DIR", "./photos"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	photos := photo.NewPhotos(db, photoBlobs, getEnv("PUBLIC_URL", "http://localhost:8080"))
+	photoURL := func(photoKey string) string { return photos.URL(photoKey, "medium") }
+
+	mfa, err := auth.NewMFA(db, getEnv("MFA_ISSUER", "Muzz"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scorer, err := loadScorer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exploration, err := loadExplorationPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	experiments, err := loadExperiments(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	recommendationsInterval, err := time.ParseDuration(getEnv("RECOMMENDATIONS_INTERVAL", "1h"))
+	if err != nil || recommendationsInterval <= 0 {
+		log.Fatalf("RECOMMENDATIONS_INTERVAL must be a positive duration e.g. 30m: %q", os.Getenv("RECOMMENDATIONS_INTERVAL"))
+	}
+	discoverQueueRefresh, err := time.ParseDuration(getEnv("DISCOVER_QUEUE_REFRESH", "10s"))
+	if err != nil || discoverQueueRefresh <= 0 {
+		log.Fatalf("DISCOVER_QUEUE_REFRESH must be a positive duration e.g. 10s: %q", os.Getenv("DISCOVER_QUEUE_REFRESH"))
+	}
+	cursorSecret, err := loadCursorSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	discoverQueues := matchmaker.NewQueueManager(db, exploration)
+	go discoverQueues.Run(context.Background(), discoverQueueRefresh)
+
+	// rebuilding the recommendations reads every swipe, so it's only worth it when they are part of someone's ranking
+	if matchmaker.UsesRecommendations(scorer) || experiments.UsesRecommendations() {
+		recommender := matchmaker.NewRecommender(db, matchmaker.DefaultRecommendationsPerUser, discoverQueues.RecommendationsRebuilt)
+		go recommender.Run(context.Background(), recommendationsInterval)
+	} else {
+		slog.Info("recommendations aren't used by any discover ranking, not rebuilding them")
+	}
 
 	router := http.NewServeMux()
 
 	// Define auth endpoints
 	authRouter := http.NewServeMux()
-	authRouter.HandleFunc("POST /user/create", user.CreateUserHandler(user.CreateUserHandlerDeps{DB: db}))
-	authRouter.HandleFunc("GET /discover", matchmaker.DiscoverHandler(matchmaker.DiscoverHandlerDeps{DB: db}))
-	authRouter.HandleFunc("POST /swipe", matchmaker.SwipeHandler(matchmaker.SwipeHandlerDeps{DB: db}))
+	authRouter.HandleFunc("GET /user/me", profile.GetMyProfileHandler(profile.ProfileHandlerDeps{DB: db}))
+	authRouter.HandleFunc("PATCH /user/me", profile.UpdateMyProfileHandler(profile.ProfileHandlerDeps{DB: db, MatchingChanged: discoverQueues.UserChanged}))
+	authRouter.HandleFunc("GET /user/{id}", profile.GetPublicProfileHandler(profile.ProfileHandlerDeps{DB: db, RequireVerifiedEmail: requireVerifiedEmail}))
+	authRouter.HandleFunc("GET /user/me/preferences", profile.GetPreferencesHandler(profile.PreferencesHandlerDeps{DB: db}))
+	authRouter.HandleFunc("PUT /user/me/preferences", profile.UpdatePreferencesHandler(profile.PreferencesHandlerDeps{DB: db, PreferencesChanged: discoverQueues.UserChanged}))
+	authRouter.HandleFunc("GET /user/me/photos", photo.ListPhotosHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	authRouter.HandleFunc("POST /user/me/photos", photo.UploadPhotoHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	authRouter.HandleFunc("PUT /user/me/photos/order", photo.ReorderPhotosHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	authRouter.HandleFunc("PUT /user/me/photos/{id}/primary", photo.SetPrimaryPhotoHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	authRouter.HandleFunc("DELETE /user/me/photos/{id}", photo.DeletePhotoHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	authRouter.HandleFunc("GET /discover", matchmaker.DiscoverHandler(matchmaker.DiscoverHandlerDeps{DB: db, RequireVerifiedEmail: requireVerifiedEmail, PhotoURL: photoURL, DefaultMaxDistanceKm: discoverMaxDistanceKm, Scorer: scorer, Exploration: exploration, Queues: discoverQueues, Experiments: experiments, CursorSecret: cursorSecret}))
+	authRouter.HandleFunc("POST /swipe", matchmaker.SwipeHandler(matchmaker.SwipeHandlerDeps{DB: db, RequireVerifiedEmail: requireVerifiedEmail, Swiped: discoverQueues.Swiped, Experiments: experiments}))
+	authRouter.HandleFunc("POST /email/verify/resend", auth.ResendVerificationEmailHandler(auth.ResendVerificationEmailHandlerDeps{DB: db, Verifications: emailVerifications, ClaimsFromContext: middleware.GetClaimsFromContext}))
+	authRouter.HandleFunc("POST /mfa/enroll", auth.EnrollMFAHandler(auth.MFAHandlerDeps{MFA: mfa, ClaimsFromContext: middleware.GetClaimsFromContext}))
+	authRouter.HandleFunc("POST /mfa/confirm", auth.ConfirmMFAHandler(auth.MFAHandlerDeps{MFA: mfa, ClaimsFromContext: middleware.GetClaimsFromContext}))
+	authRouter.HandleFunc("POST /mfa/disable", auth.DisableMFAHandler(auth.MFAHandlerDeps{MFA: mfa, ClaimsFromContext: middleware.GetClaimsFromContext}))
+	authRouter.HandleFunc("POST /logout", auth.LogoutHandler(auth.LogoutHandlerDeps{Revocations: revocations, RefreshTokens: refreshTokens, ClaimsFromContext: middleware.GetClaimsFromContext}))
+
+	// Define admin endpoints
+	authRouter.Handle("GET /admin/lockouts", adminGuardMiddleware(auth.LockoutsHandler(auth.LockoutsHandlerDeps{Throttle: loginThrottle})))
+	authRouter.Handle("DELETE /admin/lockouts/{key}", adminGuardMiddleware(auth.UnlockHandler(auth.LockoutsHandlerDeps{Throttle: loginThrottle})))
+	authRouter.Handle("GET /admin/experiments", adminGuardMiddleware(matchmaker.ExperimentsReportHandler(matchmaker.ExperimentsHandlerDeps{Experiments: experiments})))
 	router.Handle("/", authGuardMiddleware(authRouter))
 
 	// Define un-authenticated endpoints
-	router.HandleFunc("POST /login", auth.LoginHandler(auth.LoginHandlerDeps{DB: db, JwtTokenGenerator: tokenAuth.GenerateJWTToken}))
+	router.HandleFunc("POST /user/register", user.RegisterHandler(user.RegisterHandlerDeps{DB: db, SendVerificationEmail: emailVerifications.SendVerificationEmail, UserCreated: discoverQueues.UserChanged}))
+	router.HandleFunc("POST /login", auth.LoginHandler(auth.LoginHandlerDeps{DB: db, JwtTokenGenerator: tokenAuth.GenerateJWTToken, RefreshTokenIssuer: refreshTokens.Issue, Throttle: loginThrottle, MFA: mfa, MFAPendingTokenGenerator: tokenAuth.GenerateMFAPendingToken}))
+	router.HandleFunc("POST /login/mfa", auth.MFALoginHandler(auth.MFALoginHandlerDeps{DB: db, MFA: mfa, ExtractMFAPendingClaims: tokenAuth.ExtractMFAPendingClaims, JwtTokenGenerator: tokenAuth.GenerateJWTToken, RefreshTokenIssuer: refreshTokens.Issue, Throttle: loginThrottle}))
+	router.HandleFunc("POST /token/refresh", auth.RefreshTokenHandler(auth.RefreshTokenHandlerDeps{RefreshTokens: refreshTokens, JwtTokenGenerator: tokenAuth.GenerateJWTToken}))
+	router.HandleFunc("GET /email/verify", auth.VerifyEmailHandler(auth.VerifyEmailHandlerDeps{DB: db, Verifications: emailVerifications, UserVerified: discoverQueues.UserChanged}))
+	router.HandleFunc("POST /password/forgot", auth.ForgotPasswordHandler(auth.ForgotPasswordHandlerDeps{DB: db, Resets: passwordResets, Mailer: outbox, ResetURL: getEnv("PASSWORD_RESET_URL", "http://localhost:8080/password/reset"), Cooldown: auth.DefaultPasswordResetCooldown}))
+	router.HandleFunc("POST /password/reset", auth.ResetPasswordHandler(auth.ResetPasswordHandlerDeps{DB: db, Resets: passwordResets, Revocations: revocations, RefreshTokens: refreshTokens}))
+	router.HandleFunc("GET /photos/{key}/{file}", photo.ServePhotoHandler(photo.PhotoHandlerDeps{Photos: photos}))
+	router.HandleFunc("GET /.well-known/jwks.json", auth.JWKSHandler(auth.JWKSHandlerDeps{Keys: keys}))
 
 	server := http.Server{
 		Addr:         ":8080",
@@ -58,3 +179,130 @@ func main() {
 	fmt.Println("Server is listening on port 8080...")
 	server.ListenAndServe()
 }
+
+// loads the JWT signing keys from the file given by JWT_KEYS_FILE
+// falls back to a random key for local development, tokens won't survive a restart
+func loadKeySet() (*auth.KeySet, error) {
+	path := os.Getenv("JWT_KEYS_FILE")
+	if path == "" {
+		slog.Warn("JWT_KEYS_FILE not set, using an ephemeral signing key")
+		return auth.GenerateEphemeralKeySet()
+	}
+	return auth.LoadKeySet(path)
+}
+
+// the secret discover cursors are signed with, from DISCOVER_CURSOR_SECRET
+func loadCursorSecret() ([]byte, error) {
+	if secret := os.Getenv("DISCOVER_CURSOR_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+
+	slog.Warn("DISCOVER_CURSOR_SECRET not set, using an ephemeral secret")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// builds the password hasher using the argon2id costs from the PASSWORD_HASH_* env vars
+// existing hashes are upgraded to the new costs when the user next logs in
+func loadPasswordHasher() (user.PasswordHasher, error) {
+	params := user.DefaultArgon2idParams
+
+	memory, err := strconv.ParseUint(getEnv("PASSWORD_HASH_MEMORY_KIB", strconv.Itoa(int(params.Memory))), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_HASH_MEMORY_KIB: %w", err)
+	}
+	iterations, err := strconv.ParseUint(getEnv("PASSWORD_HASH_ITERATIONS", strconv.Itoa(int(params.Iterations))), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_HASH_ITERATIONS: %w", err)
+	}
+	parallelism, err := strconv.ParseUint(getEnv("PASSWORD_HASH_PARALLELISM", strconv.Itoa(int(params.Parallelism))), 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_HASH_PARALLELISM: %w", err)
+	}
+
+	params.Memory = uint32(memory)
+	params.Iterations = uint32(iterations)
+	params.Parallelism = uint8(parallelism)
+
+	return user.NewArgon2idHasher(params)
+}
+
+// builds the discover ranking from the DISCOVER_*_WEIGHT env vars
+func loadScorer() (matchmaker.Scorer, error) {
+	scorer := matchmaker.DefaultScorer.(matchmaker.WeightedScorer)
+
+	weights := []struct {
+		env    string
+		weight *float64
+	}{
+		{"DISCOVER_DISTANCE_WEIGHT", &scorer.DistanceWeight},
+		{"DISCOVER_LIKES_WEIGHT", &scorer.LikesWeight},
+		{"DISCOVER_RATING_WEIGHT", &scorer.RatingWeight},
+		{"DISCOVER_RECOMMENDATION_WEIGHT", &scorer.RecommendationWeight},
+	}
+	for _, w := range weights {
+		value, err := strconv.ParseFloat(getEnv(w.env, strconv.FormatFloat(*w.weight, 'g', -1, 64)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", w.env, err)
+		}
+		*w.weight = value
+	}
+
+	if err := scorer.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid discover weights: %w", err)
+	}
+	return scorer, nil
+}
+
+// the exploration policy for discover, the defaults can be overridden with env vars
+func loadExplorationPolicy() (matchmaker.ExplorationPolicy, error) {
+	policy := matchmaker.DefaultExplorationPolicy
+
+	share, err := strconv.ParseFloat(getEnv("DISCOVER_EXPLORATION_SHARE", strconv.FormatFloat(policy.Share, 'g', -1, 64)), 64)
+	if err != nil {
+		return policy, fmt.Errorf("invalid DISCOVER_EXPLORATION_SHARE: %w", err)
+	}
+	policy.Share = share
+
+	maxImpressions, err := strconv.Atoi(getEnv("DISCOVER_EXPLORATION_MAX_IMPRESSIONS", strconv.Itoa(policy.MaxImpressions)))
+	if err != nil {
+		return policy, fmt.Errorf("invalid DISCOVER_EXPLORATION_MAX_IMPRESSIONS: %w", err)
+	}
+	policy.MaxImpressions = maxImpressions
+
+	if err := policy.Validate(); err != nil {
+		return policy, fmt.Errorf("invalid discover exploration: %w", err)
+	}
+	return policy, nil
+}
+
+// the discover ranking experiments from the JSON file at DISCOVER_EXPERIMENTS, there are none when it isn't set
+func loadExperiments(db *sql.DB) (*matchmaker.Experiments, error) {
+	experiments := []matchmaker.Experiment{}
+	if path := os.Getenv("DISCOVER_EXPERIMENTS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DISCOVER_EXPERIMENTS: %w", err)
+		}
+		if err := json.Unmarshal(data, &experiments); err != nil {
+			return nil, fmt.Errorf("invalid DISCOVER_EXPERIMENTS: %w", err)
+		}
+	}
+
+	e, err := matchmaker.NewExperiments(db, experiments)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISCOVER_EXPERIMENTS: %w", err)
+	}
+	return e, nil
+}
+
+// returns the environment variable or the fallback when it isn't set
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
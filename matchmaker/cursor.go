@@ -0,0 +1,139 @@
+package matchmaker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many profiles are returned when the request doesn't give a limit
+const defaultPageSize = 20
+
+// the most profiles which can be asked for at once
+const maxPageSize = 100
+
+// how long after the first page was requested a cursor can be used for, the recommendation builds a cursor can refer
+// to are kept until then
+const maxCursorAge = 6 * time.Hour
+
+var (
+	errInvalidCursor   = errors.New("cursor is invalid")
+	errCursorMismatch  = errors.New("cursor was created with different filters, start again without a cursor")
+	errCursorExpired   = errors.New("cursor has expired, start again without a cursor")
+	errInvalidPageSize = fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+)
+
+// snapshot is the state of the db when the first page was requested, later pages ignore users and swipes which
+// arrived afterwards so the ranking doesn't shift between pages
+type snapshot struct {
+	// the newest user and swipe when the first page was requested
+	MaxUserID  int `json:"u"`
+	MaxSwipeID int `json:"s"`
+	// ages are worked out at this time, unix seconds
+	Time int64 `json:"t"`
+	// the newest recommendations, 0 if there weren't any
+	RecommendationBuild int `json:"r"`
+	// the newest impression, profiles are explored based on how often they had been shown by then
+	MaxImpressionID int `json:"i"`
+}
+
+func (s snapshot) now() time.Time {
+	return time.Unix(s.Time, 0)
+}
+
+// cursor points to where the next page starts in the ranking, it is opaque to clients. It is signed so clients can't
+// change the snapshot, e.g. to keep using it past maxCursorAge or to see people they've swiped on again
+type cursor struct {
+	Snapshot snapshot `json:"snap"`
+	// how many ranked profiles came before the next page
+	Offset int `json:"o"`
+	// the user and filters the ranking was made for
+	Fingerprint string `json:"f"`
+}
+
+// encodes the cursor followed by its signature
+func (c cursor) encode(secret []byte) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(signCursor(data, secret))
+}
+
+func signCursor(data []byte, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// the cursor can't be used once the snapshot is older than maxCursorAge
+func (c cursor) expired(now time.Time) bool {
+	return now.Sub(c.Snapshot.now()) > maxCursorAge
+}
+
+// decodes a cursor made by encode, cursors which weren't signed with the secret are invalid
+func decodeCursor(encoded string, secret []byte) (cursor, error) {
+	payload, signature, found := strings.Cut(encoded, ".")
+	if !found {
+		return cursor{}, errInvalidCursor
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signCursor(data, secret)) {
+		return cursor{}, errInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Offset < 0 {
+		return cursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// takes a snapshot of the newest user, swipe, recommendations and impression
+func takeSnapshot(db *sql.DB, now time.Time) (snapshot, error) {
+	s := snapshot{Time: now.Unix()}
+	err := db.QueryRow(`SELECT COALESCE((SELECT MAX(id) FROM users), 0), COALESCE((SELECT MAX(id) FROM swipes), 0),
+		COALESCE((SELECT MAX(build) FROM recommendation_builds), 0), COALESCE((SELECT MAX(id) FROM impressions), 0)`).
+		Scan(&s.MaxUserID, &s.MaxSwipeID, &s.RecommendationBuild, &s.MaxImpressionID)
+	return s, err
+}
+
+// identifies the ranking so a cursor can't be used with another user, different filters or after the user moves to a
+// different experiment variant, variant is empty for users outside every experiment
+func fingerprint(userID int, f filters, variant string) string {
+	genders := slices.Clone(f.genders)
+	slices.Sort(genders)
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%v|%d|%d|%g|%t|%s", userID, genders, f.minAge, f.maxAge, f.maxDistanceKm, f.verifiedOnly, variant)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// the ids of the users the viewer has swiped on since the snapshot, they are left out of later pages
+func swipedSince(db *sql.DB, userID int, swipeID int) (map[int]bool, error) {
+	rows, err := db.Query("SELECT swipe_target FROM swipes WHERE swiper = ? AND id > ?", userID, swipeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	swiped := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		swiped[id] = true
+	}
+	return swiped, rows.Err()
+}
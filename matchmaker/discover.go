@@ -3,14 +3,18 @@ package matchmaker
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"muzz/httpresponse"
 	"muzz/middleware"
 	"muzz/user"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -24,26 +28,64 @@ type profile struct {
 	Age int `json:"age"`
 	// distance from me in km
 	DistanceFromMe float64 `json:"distanceFromMe"`
+	// link to the user's primary photo, empty if they don't have any photos
+	PhotoURL string `json:"photoUrl,omitempty"`
 	// totalLikes received from other users swiping on them
 	totalLikes int
-
-	// users attractiveness is a weighted score based on distance from a user and their total likes
+	// desirability rating from everyone's swipes
+	rating float64
+	// how strongly the recommender thinks the user will like them, 0 if they weren't recommended
+	recommendation float64
+	// how many times they had been shown in discover
+	impressions int
+
+	// users attractiveness is the Scorer's score based on distance from a user and their total likes
 	attractivenessScore float64
-}
-
-// score is based on how close the profile is to the user logged in and how many total likes they have
-func (p *profile) calculateAttractivenessScore(normalizedDistance float64, normalizedTotalLikes float64) {
-	score := ((1 - normalizedDistance) * 0.8) + (normalizedTotalLikes * 0.2)
-	p.attractivenessScore = score
+	// what the score was worked out from
+	features Features
+	// placed in one of the exploration slots
+	explored bool
 }
 
 // The JSON response for the discover handler
 type DiscoverResponse struct {
 	Results []*profile `json:"results"`
+	// pass as the cursor param to get the next page, null on the last page
+	NextCursor *string `json:"next_cursor"`
 }
 
+// Gets the link to a photo from where it is stored
+type PhotoURL func(photoKey string) string
+
 type DiscoverHandlerDeps struct {
-	DB    *sql.DB
+	DB *sql.DB
+
+	// when set, users who haven't verified their email don't appear in discover results
+	RequireVerifiedEmail bool
+
+	// optional, when set results include a link to the user's primary photo
+	PhotoURL PhotoURL
+
+	// optional, decides the order of the results, falls back to the DefaultScorer
+	Scorer Scorer
+
+	// optional, gives some of the slots to profiles which haven't been shown much, off when not set
+	Exploration ExplorationPolicy
+
+	// optional, how far away candidates can be for users who have never saved their preferences and haven't asked for a
+	// max distance, without it discover has to look at every user for them. Users who saved no max distance have no limit
+	DefaultMaxDistanceKm float64
+
+	// optional, keeps each active user's ranking so it doesn't have to be worked out on every request, it must use the
+	// same Exploration
+	Queues *QueueManager
+
+	// optional, users in an experiment are ranked with their variant's scorer instead of Scorer
+	Experiments *Experiments
+
+	// signs the cursors so clients can't change them, cursors stop working when it changes
+	CursorSecret []byte
+
 	clock func() time.Time
 }
 
@@ -55,7 +97,18 @@ func (c *DiscoverHandlerDeps) now() time.Time {
 	return c.clock()
 }
 
+func (c *DiscoverHandlerDeps) scorer() Scorer {
+	if c.Scorer == nil {
+		return DefaultScorer
+	}
+	return c.Scorer
+}
+
 // handler for getting all the potential matches for a given user excluding profiles who the user has already swiped for
+// results are paged with the `limit` and `cursor` params, the ranking stays the same across pages even when new users
+// and swipes arrive
+// admins can pass `explain=true` to see how every candidate was ranked or why they were left out, for themselves or the
+// user in the `user_id` param
 func DiscoverHandler(deps DiscoverHandlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -69,91 +122,515 @@ func DiscoverHandler(deps DiscoverHandlerDeps) http.HandlerFunc {
 
 		userID := claims.UserID
 
-		ageFilterStr := r.URL.Query().Get("age")
-		genderFilter := r.URL.Query().Get("gender")
-
-		var ageFilter int
-		var err error
-
-		if ageFilterStr != "" {
-			ageFilter, err = strconv.Atoi(ageFilterStr)
-
+		explain := r.URL.Query().Get("explain") == "true"
+		if explain {
+			admin, err := user.IsAdmin(deps.DB, claims.UserID)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Age filter must be a number"})
+				slog.Error("failed to check if user is an admin", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+			if !admin {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "explain is only available to admins"})
 				return
 			}
 
-			if ageFilter < 0 {
+			if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+				userID, err = strconv.Atoi(userIDStr)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "user_id must be a whole number"})
+					return
+				}
+			}
+		}
+
+		limit := defaultPageSize
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > maxPageSize {
 				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Age filter must be more than 0"})
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: errInvalidPageSize.Error()})
+				return
 			}
 		}
 
-		userLocation, err := getUserLocation(deps.DB, userID)
-		if err != nil || userLocation == nil {
+		savedFilters, err := userFilters(deps.DB, userID, deps.RequireVerifiedEmail, deps.DefaultMaxDistanceKm)
+		if err != nil {
+			slog.Error("failed to get preferences", slog.Any("error", err))
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
 			return
 		}
 
-		userProfiles, err := getPotentialMatches(deps.DB, userID, deps.now(), filters{age: ageFilter, gender: genderFilter}, *userLocation)
+		filters, err := applyQueryFilters(r.URL.Query(), savedFilters)
 		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// users in an experiment get a ranking of their own
+		scorer := deps.scorer()
+		var experiment, variant, ranking string
+		if deps.Experiments != nil {
+			if e, v, ok := deps.Experiments.Assign(userID); ok {
+				scorer = v.Scorer
+				experiment, variant = e.Name, v.Name
+				ranking = experiment + "/" + variant
+			}
+		}
+
+		if explain {
+			// explain pages through every user rather than the ranking so its cursors can't be used without it
+			ranking += "|explain"
+		}
+		page := cursor{Fingerprint: fingerprint(userID, filters, ranking)}
+		var cursorSnapshot *snapshot
+		if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+			c, err := decodeCursor(cursorStr, deps.CursorSecret)
+			if err == nil && c.Fingerprint != page.Fingerprint {
+				err = errCursorMismatch
+			}
+			if err == nil && c.expired(deps.now()) {
+				err = errCursorExpired
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+				return
+			}
+			page = c
+			cursorSnapshot = &page.Snapshot
+		}
+
+		if explain {
+			if cursorSnapshot == nil {
+				page.Snapshot, err = takeSnapshot(deps.DB, deps.now())
+				if err != nil {
+					slog.Error("failed to take discover snapshot", slog.Any("error", err))
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+					return
+				}
+			}
+
+			viewer, err := getViewer(deps.DB, userID, page.Snapshot.now())
+			if err != nil {
+				if errors.Is(err, errUserNotFound) {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "user not found"})
+					return
+				}
+				slog.Error("failed to get user", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+
+			explanations, err := explainMatches(deps.DB, viewer, page.Snapshot, filters, scorer, deps.Exploration)
+			if err != nil {
+				slog.Error("failed to explain matches", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+
+			// paged the same way as the ranking, the cursor keeps the snapshot so later pages explain the same ranking
+			start := min(page.Offset, len(explanations))
+			end := min(start+limit, len(explanations))
+			var nextCursor *string
+			if end < len(explanations) {
+				page.Offset = end
+				encoded := page.encode(deps.CursorSecret)
+				nextCursor = &encoded
+			}
+
+			json.NewEncoder(w).Encode(DiscoverExplanation{UserID: userID, Experiment: experiment, Variant: variant, Results: explanations[start:end], NextCursor: nextCursor})
+			return
+		}
+
+		var ranked []*profile
+		queued := false
+		// taken before the viewer is loaded so a ranking from before they change isn't queued
+		var generation int
+		if deps.Queues != nil {
+			ranked, page.Snapshot, queued = deps.Queues.get(userID, page.Fingerprint, cursorSnapshot)
+			generation = deps.Queues.generation(userID)
+		}
+
+		if !queued {
+			if cursorSnapshot == nil {
+				page.Snapshot, err = takeSnapshot(deps.DB, deps.now())
+				if err != nil {
+					slog.Error("failed to take discover snapshot", slog.Any("error", err))
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+					return
+				}
+			} else {
+				page.Snapshot = *cursorSnapshot
+			}
+
+			viewer, err := getViewer(deps.DB, userID, page.Snapshot.now())
+			if err != nil {
+				slog.Error("failed to get user", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+
+			ranked, err = getPotentialMatches(deps.DB, viewer, page.Snapshot, filters, scorer, deps.Exploration)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+
+			// only first pages are queued, a later page's snapshot is already out of date
+			if deps.Queues != nil && cursorSnapshot == nil {
+				deps.Queues.put(generation, viewer, filters, ranking, scorer, page.Snapshot, ranked)
+			}
+		}
+
+		// users swiped on since the first page are dropped without moving everyone else's position
+		swiped, err := swipedSince(deps.DB, userID, page.Snapshot.MaxSwipeID)
+		if err != nil {
+			slog.Error("failed to get recent swipes", slog.Any("error", err))
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
 			return
 		}
 
-		response := DiscoverResponse{Results: userProfiles}
+		start := min(page.Offset, len(ranked))
+		end := min(start+limit, len(ranked))
+		userProfiles := []*profile{}
+		for _, p := range ranked[start:end] {
+			if !swiped[p.ID] {
+				// copied as queued profiles are shared between requests
+				copied := *p
+				userProfiles = append(userProfiles, &copied)
+			}
+		}
+
+		// exposure is measured even when exploration is off
+		if err := recordImpressions(deps.DB, userID, page.Snapshot, userProfiles, deps.now()); err != nil {
+			slog.Error("failed to record impressions", slog.Any("error", err))
+		} else if deps.Queues != nil && len(userProfiles) > 0 {
+			shown := make([]int, 0, len(userProfiles))
+			for _, p := range userProfiles {
+				shown = append(shown, p.ID)
+			}
+			deps.Queues.Shown(shown)
+		}
+		if experiment != "" {
+			if err := deps.Experiments.RecordExposure(userID, experiment, variant); err != nil {
+				slog.Error("failed to record experiment exposure", slog.Any("error", err))
+			}
+		}
+
+		var nextCursor *string
+		if end < len(ranked) {
+			page.Offset = end
+			encoded := page.encode(deps.CursorSecret)
+			nextCursor = &encoded
+		}
+
+		if deps.PhotoURL != nil {
+			// looked up for each page rather than ranked with everyone else as photos change without changing the ranking
+			photoKeys, err := primaryPhotoKeys(deps.DB, userProfiles)
+			if err != nil {
+				slog.Error("failed to get photos", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to get matches"})
+				return
+			}
+			for _, p := range userProfiles {
+				if key, ok := photoKeys[p.ID]; ok {
+					p.PhotoURL = deps.PhotoURL(key)
+				}
+			}
+		}
+
+		response := DiscoverResponse{Results: userProfiles, NextCursor: nextCursor}
 		json.NewEncoder(w).Encode(response)
 	}
 }
 
+// where the primary photo of each of the profiles is stored, profiles without photos are left out
+func primaryPhotoKeys(db *sql.DB, profiles []*profile) (map[int]string, error) {
+	keys := map[int]string{}
+	if len(profiles) == 0 {
+		return keys, nil
+	}
+
+	params := make([]interface{}, 0, len(profiles))
+	for _, p := range profiles {
+		params = append(params, p.ID)
+	}
+	rows, err := db.Query("SELECT user_id, blob_key FROM photos WHERE is_primary AND user_id IN (?"+strings.Repeat(", ?", len(profiles)-1)+")", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		var key string
+		if err := rows.Scan(&userID, &key); err != nil {
+			return nil, err
+		}
+		keys[userID] = key
+	}
+	return keys, rows.Err()
+}
+
 type filters struct {
-	age    int
+	// only include users with one of these genders, empty for every gender
+	genders []string
+	// age range in years, 0 for no limit
+	minAge int
+	maxAge int
+	// 0 for no limit
+	maxDistanceKm float64
+	// only include users who have verified their email
+	verifiedOnly bool
+}
+
+// the filters a user's candidates are found with before any query params: their saved preferences along with the
+// server's settings. Used by both discover and Evaluate so they see the same candidates.
+func userFilters(db *sql.DB, userID int, requireVerifiedEmail bool, defaultMaxDistanceKm float64) (filters, error) {
+	preferences, saved, err := user.GetSavedPreferences(db, userID)
+	if err != nil {
+		return filters{}, err
+	}
+	f := filtersFromPreferences(preferences)
+	f.verifiedOnly = requireVerifiedEmail
+	// only users who have never saved preferences get the default, once saved no max distance means no limit. The
+	// query can't set a max distance of 0 so it is still replaced by one given there.
+	if !saved && f.maxDistanceKm == 0 {
+		f.maxDistanceKm = defaultMaxDistanceKm
+	}
+	return f, nil
+}
+
+// the filters the user has saved as their preferences
+func filtersFromPreferences(p user.Preferences) filters {
+	f := filters{genders: p.Genders}
+	if p.MinAge != nil {
+		f.minAge = *p.MinAge
+	}
+	if p.MaxAge != nil {
+		f.maxAge = *p.MaxAge
+	}
+	if p.MaxDistanceKm != nil {
+		f.maxDistanceKm = *p.MaxDistanceKm
+	}
+	return f
+}
+
+// applies the filters from the query params on top of the stored ones, the error can be shown to the user
+func applyQueryFilters(query url.Values, f filters) (filters, error) {
+	age, err := intParam(query, "age")
+	if err != nil {
+		return f, err
+	}
+
+	var q user.Preferences
+	if q.MinAge, err = intParam(query, "min_age"); err != nil {
+		return f, err
+	}
+	if q.MaxAge, err = intParam(query, "max_age"); err != nil {
+		return f, err
+	}
+	if q.MaxDistanceKm, err = floatParam(query, "max_distance_km"); err != nil {
+		return f, err
+	}
+	// gender can be repeated to include several genders
+	q.Genders = query["gender"]
+
+	if age != nil {
+		if q.MinAge != nil || q.MaxAge != nil {
+			return f, errors.New("age can't be combined with min_age or max_age")
+		}
+		if err := user.ValidateAge("age", *age); err != nil {
+			return f, err
+		}
+		q.MinAge, q.MaxAge = age, age
+	}
+
+	if err := q.Validate(); err != nil {
+		return f, err
+	}
+
+	// an age range in the query replaces the stored one rather than being mixed with it
+	if q.MinAge != nil || q.MaxAge != nil {
+		f.minAge, f.maxAge = 0, 0
+		if q.MinAge != nil {
+			f.minAge = *q.MinAge
+		}
+		if q.MaxAge != nil {
+			f.maxAge = *q.MaxAge
+		}
+	}
+	if len(q.Genders) > 0 {
+		f.genders = q.Genders
+	}
+	if q.MaxDistanceKm != nil {
+		f.maxDistanceKm = *q.MaxDistanceKm
+	}
+	return f, nil
+}
+
+// parses an optional whole number query param
+func intParam(query url.Values, name string) (*int, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(query.Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a whole number", name)
+	}
+	return &value, nil
+}
+
+// parses an optional number query param
+func floatParam(query url.Values, name string) (*float64, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(query.Get(name), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	return &value, nil
+}
+
+// the user asking for matches, candidates only appear if the viewer meets their preferences too
+type viewer struct {
+	id     int
 	gender string
+	// nil when the user hasn't given their date of birth
+	age      *int
+	location user.GeoLocation
 }
 
-func getUserLocation(db *sql.DB, userID int) (*user.GeoLocation, error) {
-	var lat, lng float64
-	err := db.QueryRow("SELECT lat, lng FROM users WHERE id = ?", userID).Scan(&lat, &lng)
+// returned by getViewer when the user doesn't exist
+var errUserNotFound = errors.New("user not found")
+
+func getViewer(db *sql.DB, userID int, now time.Time) (viewer, error) {
+	var gender, dob sql.NullString
+	v := viewer{id: userID}
+	err := db.QueryRow("SELECT gender, dob, lat, lng FROM users WHERE id = ?", userID).Scan(&gender, &dob, &v.location.Lat, &v.location.Long)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user with ID %d not found", userID)
+			return v, errUserNotFound
 		}
-		return nil, err
+		return v, err
+	}
+
+	v.gender = gender.String
+	if dob.Valid {
+		age, err := user.CalculateAge(dob.String, now)
+		if err != nil {
+			return v, err
+		}
+		v.age = &age
 	}
-	return &user.GeoLocation{Lat: lat, Long: lng}, nil
+	return v, nil
 }
 
 // Retrieve userProfiles from the database excluding the current user and the profiles the user has already swiped on
+// Only users and swipes from the snapshot are used so the ranking is the same for every page
+// Once ranked some of the slots can be given to low exposure profiles by the exploration policy
 // Assumes all the profiles will fit in memory!
-func getPotentialMatches(db *sql.DB, userID int, now time.Time, filters filters, userLocation user.GeoLocation) (userProfiles []*profile, err error) {
+func getPotentialMatches(db *sql.DB, viewer viewer, snapshot snapshot, filters filters, scorer Scorer, exploration ExplorationPolicy) (userProfiles []*profile, err error) {
+	userProfiles, err = queryCandidates(db, viewer, snapshot, filters, "")
+	if err != nil {
+		return
+	}
+
+	bounds := boundsOf(userProfiles)
+	for _, profile := range userProfiles {
+		bounds.score(profile, scorer)
+	}
+	sortByScore(userProfiles)
+
+	return exploration.explore(userProfiles), nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryCandidates loads everyone in the snapshot who passes the filters and whose own preferences match the viewer,
+// along with the raw features they are ranked on. They still have to be scored. The condition, when given, narrows
+// down which users are loaded and its params are passed after the rest.
+func queryCandidates(db queryer, viewer viewer, snapshot snapshot, filters filters, condition string, conditionParams ...interface{}) (userProfiles []*profile, err error) {
+	now := snapshot.now()
 
 	userProfiles = []*profile{}
 
-	// assumes we only care about the year of the date of birth for simplicity
 	query := `
 	SELECT 
-	u.id, u.name, u.gender, u.dob, strftime('%Y', date('now')) - strftime('%Y', date(u.dob)) AS age, u.lat, u.lng, COUNT(s.id) AS like_count
+	u.id, u.name, u.gender, u.dob, u.lat, u.lng, COUNT(s.id) AS like_count,
+	cp.max_distance_km,
+	COALESCE((SELECT r.target_rating FROM swipes r WHERE r.swipe_target = u.id AND r.id <= ? AND r.target_rating IS NOT NULL ORDER BY r.id DESC LIMIT 1), ?) AS rating,
+	COALESCE((SELECT rc.score FROM recommendations rc WHERE rc.build = ? AND rc.user_id = ? AND rc.candidate_id = u.id), 0) AS recommendation,
+	(SELECT COUNT(*) FROM impressions i WHERE i.profile_id = u.id AND i.id <= ?) AS impressions
 	FROM users u
-	LEFT JOIN swipes s ON u.id = s.swipe_target AND s.liked = 1
-	WHERE u.id NOT IN (SELECT swipe_target FROM swipes WHERE swiper = ?) AND u.id != ?
+	LEFT JOIN swipes s ON u.id = s.swipe_target AND s.liked = 1 AND s.id <= ?
+	LEFT JOIN preferences cp ON cp.user_id = u.id
+	WHERE u.id NOT IN (SELECT swipe_target FROM swipes WHERE swiper = ? AND id <= ?) AND u.id != ? AND u.id <= ?
+	AND (cp.genders IS NULL OR json_array_length(cp.genders) = 0 OR EXISTS (SELECT 1 FROM json_each(cp.genders) WHERE value = ?))
+	AND (cp.min_age IS NULL OR cp.min_age <= ?)
+	AND (cp.max_age IS NULL OR cp.max_age >= ?)
 	`
 
-	params := []interface{}{userID, userID}
+	// ratings are taken from the last swipe in the snapshot, recommendations from the build in the snapshot and
+	// impressions up to the snapshot so they don't change between pages
+	// the candidate's preferences are checked against the viewer, a viewer without a dob fails any age limit
+	params := []interface{}{snapshot.MaxSwipeID, DefaultRating, snapshot.RecommendationBuild, viewer.id, snapshot.MaxImpressionID, snapshot.MaxSwipeID, viewer.id, snapshot.MaxSwipeID, viewer.id, snapshot.MaxUserID, viewer.gender, viewer.age, viewer.age}
 
-	if filters.age != 0 {
-		query += " AND age = ?"
-		params = append(params, filters.age)
+	if len(filters.genders) > 0 {
+		query += " AND gender IN (?" + strings.Repeat(", ?", len(filters.genders)-1) + ")"
+		for _, gender := range filters.genders {
+			params = append(params, gender)
+		}
 	}
 
-	if filters.gender != "" {
-		query += " AND gender = ?"
-		params = append(params, filters.gender)
+	// someone is at least minAge if they were born on or before this day minAge years ago
+	if filters.minAge != 0 {
+		query += " AND u.dob <= ?"
+		params = append(params, user.LatestDOB(filters.minAge, now))
 	}
 
-	query += "GROUP BY u.id, u.name, u.gender, u.dob, u.lat, u.lng"
+	// and at most maxAge if they were born after this day maxAge + 1 years ago
+	if filters.maxAge != 0 {
+		query += " AND u.dob > ?"
+		params = append(params, user.LatestDOB(filters.maxAge+1, now))
+	}
+
+	if filters.maxDistanceKm != 0 {
+		condition, nearbyParams := nearbyCondition(viewer.location, filters.maxDistanceKm)
+		query += " AND " + condition
+		params = append(params, nearbyParams...)
+	}
+
+	if filters.verifiedOnly {
+		query += " AND u.email_verified_at IS NOT NULL"
+	}
+
+	if condition != "" {
+		query += " AND " + condition
+		params = append(params, conditionParams...)
+	}
+
+	query += " GROUP BY u.id, u.name, u.gender, u.dob, u.lat, u.lng, cp.max_distance_km"
 
 	rows, err := db.Query(query, params...)
 	if err != nil {
@@ -161,13 +638,13 @@ func getPotentialMatches(db *sql.DB, userID int, now time.Time, filters filters,
 	}
 	defer rows.Close()
 
-	var minDistanceFromMe, maxDistanceFromMe float64
-	var minTotalLikes, maxTotalLikes int
-
 	for rows.Next() {
 		var u user.User
-		var age, totalLikes int
-		if err := rows.Scan(&u.ID, &u.Name, &u.Gender, &u.DOB, &age, &u.Location.Lat, &u.Location.Long, &totalLikes); err != nil {
+		var totalLikes int
+		var candidateMaxDistance sql.NullFloat64
+		var rating, recommendation float64
+		var impressions int
+		if err := rows.Scan(&u.ID, &u.Name, &u.Gender, &u.DOB, &u.Location.Lat, &u.Location.Long, &totalLikes, &candidateMaxDistance, &rating, &recommendation, &impressions); err != nil {
 			return userProfiles, err
 		}
 
@@ -176,34 +653,75 @@ func getPotentialMatches(db *sql.DB, userID int, now time.Time, filters filters,
 			return userProfiles, err
 		}
 
-		distanceFromMe := haversineDistance(u.Location.Lat, u.Location.Long, userLocation.Lat, userLocation.Long)
-		minDistanceFromMe = math.Min(distanceFromMe, minDistanceFromMe)
-		maxDistanceFromMe = math.Max(distanceFromMe, maxDistanceFromMe)
-
-		if totalLikes < minTotalLikes {
-			minTotalLikes = totalLikes
+		distanceFromMe := haversineDistance(u.Location.Lat, u.Location.Long, viewer.location.Lat, viewer.location.Long)
+		// the bounding boxes let through the corners which are further away
+		if filters.maxDistanceKm != 0 && distanceFromMe > filters.maxDistanceKm {
+			continue
 		}
-
-		if totalLikes > maxTotalLikes {
-			maxTotalLikes = totalLikes
+		if candidateMaxDistance.Valid && distanceFromMe > candidateMaxDistance.Float64 {
+			continue
 		}
 
-		userProfile := &profile{ID: u.ID, Name: u.Name, Gender: u.Gender, Age: age, DistanceFromMe: distanceFromMe, totalLikes: totalLikes}
+		userProfile := &profile{ID: u.ID, Name: u.Name, Gender: u.Gender, Age: age, DistanceFromMe: distanceFromMe, totalLikes: totalLikes, rating: rating, recommendation: recommendation, impressions: impressions}
 		userProfiles = append(userProfiles, userProfile)
 	}
 
-	for _, profile := range userProfiles {
-		normalizedDistance := normalizeScore(profile.DistanceFromMe, minDistanceFromMe, maxDistanceFromMe)
-		normalizedTotalLikes := normalizeScore(float64(profile.totalLikes), float64(minTotalLikes), float64(maxTotalLikes))
-		profile.calculateAttractivenessScore(normalizedDistance, normalizedTotalLikes)
+	return userProfiles, rows.Err()
+}
+
+// featureBounds are the ranges the features are normalized over, taken from every candidate in a ranking.
+// Distances and likes can't go below 0 so their range always starts there
+type featureBounds struct {
+	maxDistance       float64
+	maxLikes          int
+	minRating         float64
+	maxRating         float64
+	maxRecommendation float64
+}
+
+func boundsOf(profiles []*profile) featureBounds {
+	b := featureBounds{minRating: math.Inf(1), maxRating: math.Inf(-1)}
+	for _, p := range profiles {
+		b.include(p)
+	}
+	return b
+}
+
+// widens the bounds to cover the profile
+func (b *featureBounds) include(p *profile) {
+	b.maxDistance = math.Max(p.DistanceFromMe, b.maxDistance)
+	b.maxLikes = max(p.totalLikes, b.maxLikes)
+	b.minRating = math.Min(p.rating, b.minRating)
+	b.maxRating = math.Max(p.rating, b.maxRating)
+	b.maxRecommendation = math.Max(p.recommendation, b.maxRecommendation)
+}
+
+// score works out the profile's features from its raw ones and scores them
+func (b featureBounds) score(p *profile, scorer Scorer) {
+	p.features = Features{
+		DistanceKm:         p.DistanceFromMe,
+		TotalLikes:         p.totalLikes,
+		NormalizedDistance: normalizeScore(p.DistanceFromMe, 0, b.maxDistance),
+		NormalizedLikes:    normalizeScore(float64(p.totalLikes), 0, float64(b.maxLikes)),
+		Rating:             p.rating,
+		NormalizedRating:   normalizeScore(p.rating, b.minRating, b.maxRating),
+		Recommendation:     p.recommendation,
+		// normalized against 0 so candidates who weren't recommended are always at the bottom
+		NormalizedRecommendation: normalizeScore(p.recommendation, 0, b.maxRecommendation),
 	}
+	p.attractivenessScore = scorer.Score(p.features)
+}
 
-	// sorts user profiles by their 'attractiveness' DESC
-	sort.Slice(userProfiles, func(i, j int) bool {
-		return userProfiles[i].attractivenessScore > userProfiles[j].attractivenessScore
-	})
+// rankedBefore orders profiles by their 'attractiveness' DESC, ties are broken by id so pages don't overlap
+func rankedBefore(a *profile, b *profile) bool {
+	if a.attractivenessScore != b.attractivenessScore {
+		return a.attractivenessScore > b.attractivenessScore
+	}
+	return a.ID < b.ID
+}
 
-	return userProfiles, nil
+func sortByScore(profiles []*profile) {
+	sort.Slice(profiles, func(i, j int) bool { return rankedBefore(profiles[i], profiles[j]) })
 }
 
 const (
@@ -230,6 +748,51 @@ func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	return distance
 }
 
+// a lat/lng rectangle
+type box struct {
+	minLat, maxLat, minLng, maxLng float64
+}
+
+// boundingBoxes are the smallest lat/lng boxes containing every point within distanceKm of the location, the area is
+// split in two when it wraps around the antimeridian
+func boundingBoxes(location user.GeoLocation, distanceKm float64) []box {
+	// the angle the distance covers at the centre of the earth
+	angle := distanceKm / earthRadius
+	latDelta := angle * 180 / math.Pi
+	minLat, maxLat := location.Lat-latDelta, location.Lat+latDelta
+
+	// near a pole every longitude is within range
+	lngSpread := math.Sin(angle) / math.Cos(degreesToRadians(location.Lat))
+	if minLat <= -90 || maxLat >= 90 || angle >= math.Pi/2 || lngSpread >= 1 {
+		return []box{{minLat, maxLat, -180, 180}}
+	}
+
+	lngDelta := math.Asin(lngSpread) * 180 / math.Pi
+	minLng, maxLng := location.Long-lngDelta, location.Long+lngDelta
+
+	if minLng < -180 {
+		return []box{{minLat, maxLat, minLng + 360, 180}, {minLat, maxLat, -180, maxLng}}
+	}
+	if maxLng > 180 {
+		return []box{{minLat, maxLat, minLng, 180}, {minLat, maxLat, -180, maxLng - 360}}
+	}
+	return []box{{minLat, maxLat, minLng, maxLng}}
+}
+
+// nearbyCondition is a query condition matching the users within the bounding boxes using the users_geo spatial index.
+// SQLite can't calculate the haversine distance so this narrows down the candidates and the exact distance is
+// checked afterwards
+func nearbyCondition(location user.GeoLocation, distanceKm float64) (string, []interface{}) {
+	queries := []string{}
+	params := []interface{}{}
+	for _, b := range boundingBoxes(location, distanceKm) {
+		// the index rounds coordinates outwards so an overlap check doesn't miss anyone on the edge
+		queries = append(queries, "SELECT id FROM users_geo WHERE max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?")
+		params = append(params, b.minLat, b.maxLat, b.minLng, b.maxLng)
+	}
+	return "u.id IN (" + strings.Join(queries, " UNION ALL ") + ")", params
+}
+
 // degreesToRadians converts degrees to radians
 func degreesToRadians(degrees float64) float64 {
 	return degrees * (math.Pi / 180)
@@ -0,0 +1,101 @@
+package matchmaker
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"muzz/store"
+	"muzz/user"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// creates a db with n users spread across the UK, each with a couple of likes, so radius searches find a realistic
+// share of them
+func newBenchmarkDB(b *testing.B, n int) *sql.DB {
+	b.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// every connection to :memory: gets its own empty db
+	db.SetMaxOpenConns(1)
+	b.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		b.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	insertUser, err := tx.Prepare("INSERT INTO users (name, gender, dob, lat, lng) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	insertSwipe, err := tx.Prepare("INSERT OR IGNORE INTO swipes (swiper, swipe_target, liked) VALUES (?, ?, ?)")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		dob := time.Date(1960+random.Intn(45), time.Month(1+random.Intn(12)), 1+random.Intn(28), 0, 0, 0, 0, time.UTC)
+		gender := user.Genders[random.Intn(len(user.Genders))]
+		if _, err := insertUser.Exec(fmt.Sprintf("user %d", i), gender, dob.Format("2006-01-02"), 50+random.Float64()*8, -6+random.Float64()*8); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < n*2; i++ {
+		swiper, target := 1+random.Intn(n), 1+random.Intn(n)
+		if swiper == target {
+			continue
+		}
+		if _, err := insertSwipe.Exec(swiper, target, random.Intn(2) == 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func BenchmarkGetPotentialMatches(b *testing.B) {
+	for _, users := range []int{100_000, 250_000} {
+		db := newBenchmarkDB(b, users)
+		// someone in central London
+		viewer := viewer{id: 1, location: user.GeoLocation{Lat: 51.5, Long: -0.12}}
+
+		snapshot, err := takeSnapshot(db, time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, maxDistanceKm := range []float64{0, 100, 25, 5} {
+			name := fmt.Sprintf("users=%d/max_distance_km=%g", users, maxDistanceKm)
+			if maxDistanceKm == 0 {
+				name = fmt.Sprintf("users=%d/max_distance_km=unlimited", users)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				var found int
+				for i := 0; i < b.N; i++ {
+					profiles, err := getPotentialMatches(db, viewer, snapshot, filters{maxDistanceKm: maxDistanceKm}, DefaultScorer, DefaultExplorationPolicy)
+					if err != nil {
+						b.Fatal(err)
+					}
+					found = len(profiles)
+				}
+				b.ReportMetric(float64(found), "candidates")
+			})
+		}
+	}
+}
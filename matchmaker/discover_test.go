@@ -1,15 +1,21 @@
 package matchmaker
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"muzz/auth"
+	"muzz/httpresponse"
 	"muzz/middleware"
 	"muzz/store"
+	"muzz/user"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -208,6 +214,90 @@ func TestDiscoverHandlerSortByAttractiveness(t *testing.T) {
 
 }
 
+func TestDiscoverHandlerScorer(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jane and Alice are closest, Alice and Luke have the most likes and Bob has the highest rating
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+    ('John Doe', 'male', '1990-05-15', 0, 0),
+    ('Jane Smith', 'female', '1992-08-20', 2, 1),
+    ('Alice Johnson', 'female', '1985-12-10', 2, 1),
+    ('Bob Williams', 'male', '1988-03-25', 3, 3),
+	('Luke', 'male', '1988-03-25', -3, -3);
+
+	INSERT INTO swipes (swiper, swipe_target, liked, target_rating) VALUES 
+	(2, 3, TRUE, 1520),
+	(4, 3, TRUE, 1540),
+	(4, 5, TRUE, 1510),
+	(2, 5, TRUE, 1525),
+	(3, 4, TRUE, 1600);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		scorer      Scorer
+		expectedIDs []int
+	}{
+		{
+			name:        "distance only",
+			scorer:      WeightedScorer{DistanceWeight: 1},
+			expectedIDs: []int{2, 3, 4, 5},
+		},
+		{
+			name:        "likes only",
+			scorer:      WeightedScorer{LikesWeight: 1},
+			expectedIDs: []int{3, 5, 4, 2},
+		},
+		{
+			name:        "rating only",
+			scorer:      WeightedScorer{RatingWeight: 1},
+			expectedIDs: []int{4, 3, 5, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, "GET", "/discover", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Scorer: tt.scorer}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			var response DiscoverResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []int{}
+			for _, p := range response.Results {
+				ids = append(ids, p.ID)
+			}
+			assert.Equal(t, tt.expectedIDs, ids)
+		})
+	}
+}
+
 func TestDiscoverHandlerFilters(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -259,7 +349,7 @@ func TestDiscoverHandlerFilters(t *testing.T) {
 		},
 		{
 			name:    "filter by age and gender",
-			reqBody: "/discover?age=24&gender=male",
+			reqBody: "/discover?age=23&gender=male",
 			expectedResponse: DiscoverResponse{
 				Results: []*profile{
 					{ID: 4, Name: "Darren", Gender: "male", Age: 23},
@@ -298,6 +388,678 @@ func TestDiscoverHandlerFilters(t *testing.T) {
 
 }
 
+func TestDiscoverHandlerQueryFilters(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice lives next to the antimeridian, Dani is ~22km from her on the other side of it and Bob is ~111km away
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 179.9),
+	('Bob', 'male', '1985-01-01', 0, 178.9),
+	('Charlie', 'male', '1990-04-02', 0, 179.9),
+	('Dani', 'non-binary', '2000-04-01', 0, -179.9),
+	('Eve', 'female', '1980-01-01', 0, 179.9);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		target      string
+		expectedIDs []int
+	}{
+		{
+			// Dani turns 24 today and Charlie is 33 until tomorrow
+			name:        "age range",
+			target:      "/discover?min_age=24&max_age=33",
+			expectedIDs: []int{3, 4},
+		},
+		{
+			name:        "exact age",
+			target:      "/discover?age=33",
+			expectedIDs: []int{3},
+		},
+		{
+			name:        "repeated gender",
+			target:      "/discover?gender=female&gender=non-binary",
+			expectedIDs: []int{4, 5},
+		},
+		{
+			name:        "max distance across the antimeridian",
+			target:      "/discover?max_distance_km=50",
+			expectedIDs: []int{3, 4, 5},
+		},
+		{
+			name:        "filters are combined",
+			target:      "/discover?max_distance_km=200&gender=male&min_age=35",
+			expectedIDs: []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, "GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			var response DiscoverResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []int{}
+			for _, p := range response.Results {
+				ids = append(ids, p.ID)
+			}
+			assert.ElementsMatch(t, tt.expectedIDs, ids)
+		})
+	}
+}
+
+func TestDiscoverHandlerInvalidFilters(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO users (name, gender, dob) VALUES ('Alice', 'female', '1990-01-01')`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name          string
+		target        string
+		expectedError string
+	}{
+		{name: "age isn't a number", target: "/discover?age=old", expectedError: "age must be a whole number"},
+		{name: "age is too young", target: "/discover?age=5", expectedError: "age must be between 18 and 120"},
+		{name: "age with a range", target: "/discover?age=30&min_age=25", expectedError: "age can't be combined with min_age or max_age"},
+		{name: "min age is too old", target: "/discover?min_age=200", expectedError: "min_age must be between 18 and 120"},
+		{name: "max age isn't a number", target: "/discover?max_age=1.5", expectedError: "max_age must be a whole number"},
+		{name: "min age is more than max age", target: "/discover?min_age=40&max_age=30", expectedError: "min_age can't be more than max_age"},
+		{name: "unknown gender", target: "/discover?gender=male&gender=robot", expectedError: "gender must be one of male, female, non-binary"},
+		{name: "repeated gender", target: "/discover?gender=male&gender=male", expectedError: "gender male is given more than once"},
+		{name: "distance isn't a number", target: "/discover?max_distance_km=NaN", expectedError: "max_distance_km must be a number"},
+		{name: "distance is negative", target: "/discover?max_distance_km=-1", expectedError: "max_distance_km must be more than 0 and at most 20000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, "GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+
+			var response httpresponse.ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectedError, response.Error)
+		})
+	}
+}
+
+func TestDiscoverHandlerRequireVerifiedEmail(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, email_verified_at) VALUES
+	('Alice', 'female', '1990-01-01', 1711929600),
+	('Bob', 'male', '1985-01-01', NULL),
+	('Charlie', 'male', '1995-01-01', 1711929600);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name                 string
+		requireVerifiedEmail bool
+		expectedProfiles     []*profile
+	}{
+		{
+			name:                 "unverified users are shown by default",
+			requireVerifiedEmail: false,
+			expectedProfiles: []*profile{
+				{ID: 2, Name: "Bob", Gender: "male", Age: 39},
+				{ID: 3, Name: "Charlie", Gender: "male", Age: 29},
+			},
+		},
+		{
+			name:                 "unverified users are hidden when verification is required",
+			requireVerifiedEmail: true,
+			expectedProfiles: []*profile{
+				{ID: 3, Name: "Charlie", Gender: "male", Age: 29},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, "GET", "/discover", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, RequireVerifiedEmail: tt.requireVerifiedEmail}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			var response DiscoverResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+
+			assertEqualProfiles(t, tt.expectedProfiles, response.Results)
+		})
+	}
+}
+
+func TestDiscoverHandlerPreferences(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob is ~111km from Alice and everyone else is next to her
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1995-01-01', 1, 0),
+	('Charlie', 'male', '1990-04-02', 0, 0),
+	('Dani', 'non-binary', '1993-06-01', 0, 0),
+	('Eve', 'female', '1994-01-01', 0, 0);
+
+	INSERT INTO preferences (user_id, genders, min_age, max_age, max_distance_km) VALUES
+	(1, '["male","non-binary"]', 25, 33, 100);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		target      string
+		expectedIDs []int
+	}{
+		{
+			// Bob is too far away, Charlie is 33 until tomorrow and Eve is the wrong gender
+			name:        "stored preferences are applied by default",
+			target:      "/discover",
+			expectedIDs: []int{3, 4},
+		},
+		{
+			name:        "gender param overrides the stored genders",
+			target:      "/discover?gender=female",
+			expectedIDs: []int{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, "GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			var response DiscoverResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []int{}
+			for _, p := range response.Results {
+				ids = append(ids, p.ID)
+			}
+			assert.ElementsMatch(t, tt.expectedIDs, ids)
+		})
+	}
+}
+
+func TestDiscoverHandlerMutualPreferences(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice is 34 and only Bob is ~111km away from her
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1995-01-01', 1, 0),
+	('Charlie', 'male', '1990-04-02', 0, 0),
+	('Dani', 'non-binary', '1993-06-01', 0, 0),
+	('Eve', 'female', '1994-01-01', 0, 0),
+	('Frank', 'male', '1985-01-01', 0, 0),
+	('Gus', 'male', '1992-01-01', 0, 0);
+
+	INSERT INTO preferences (user_id, genders, min_age, max_age, max_distance_km) VALUES
+	(2, '[]', NULL, NULL, 50),
+	(3, '["male"]', NULL, NULL, NULL),
+	(4, '["female","male"]', NULL, NULL, NULL),
+	(5, '[]', 18, 30, NULL),
+	(6, '[]', 35, NULL, NULL),
+	(7, '[]', 30, 40, 100);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name        string
+		userID      int
+		target      string
+		expectedIDs []int
+	}{
+		{
+			// Alice has no preferences but Bob only wants people within 50km, Charlie only wants men,
+			// Eve and Frank want people younger and older than her
+			name:        "candidates whose preferences the user doesn't meet are hidden",
+			userID:      1,
+			target:      "/discover",
+			expectedIDs: []int{4, 7},
+		},
+		{
+			// Dani wants women and men which Alice meets, but Alice only wants men
+			name:        "both users must meet the other's preferences",
+			userID:      1,
+			target:      "/discover?gender=non-binary",
+			expectedIDs: []int{4},
+		},
+		{
+			// Charlie is 33 so Frank, who only wants people who are 35 or older, is hidden even though Charlie would see him
+			// and Bob is hidden as Charlie is further away than he wants
+			name:        "one sided preferences still hide the candidate",
+			userID:      3,
+			target:      "/discover?gender=male",
+			expectedIDs: []int{7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: tt.userID})
+			req, err := http.NewRequestWithContext(ctx, "GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			var response DiscoverResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []int{}
+			for _, p := range response.Results {
+				ids = append(ids, p.ID)
+			}
+			assert.ElementsMatch(t, tt.expectedIDs, ids)
+		})
+	}
+}
+
+func TestDiscoverHandlerPagination(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// everyone is ranked by how far they are from Alice
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1990-01-01', 0, 0.1),
+	('Charlie', 'male', '1990-01-01', 0, 0.2),
+	('Dani', 'non-binary', '1990-01-01', 0, 0.3),
+	('Eve', 'female', '1990-01-01', 0, 0.4),
+	('Frank', 'male', '1990-01-01', 0, 0.5);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}))
+
+	discover := func(target string) DiscoverResponse {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var response DiscoverResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	ids := func(response DiscoverResponse) []int {
+		ids := []int{}
+		for _, p := range response.Results {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	first := discover("/discover?limit=2")
+	assert.Equal(t, []int{2, 3}, ids(first))
+	if first.NextCursor == nil {
+		t.Fatal("Expected a next cursor")
+	}
+
+	// a new user who would be ranked first and a swipe on Eve who is on the next page
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES ('Gus', 'male', '1990-01-01', 0, 0);
+	INSERT INTO swipes (swiper, swipe_target, liked) VALUES (1, 5, FALSE);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	second := discover("/discover?limit=2&cursor=" + *first.NextCursor)
+	assert.Equal(t, []int{4}, ids(second))
+	if second.NextCursor == nil {
+		t.Fatal("Expected a next cursor")
+	}
+
+	last := discover("/discover?limit=2&cursor=" + *second.NextCursor)
+	assert.Equal(t, []int{6}, ids(last))
+	assert.Nil(t, last.NextCursor)
+
+	// starting again picks up the changes
+	assert.Equal(t, []int{7, 2, 3, 4, 6}, ids(discover("/discover")))
+}
+
+func TestDiscoverHandlerInvalidPagination(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO users (name, gender, dob) VALUES ('Alice', 'female', '1990-01-01'), ('Bob', 'male', '1990-01-01')`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	secret := []byte("cursor-secret")
+	handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, CursorSecret: secret}))
+
+	// a cursor for Alice's unfiltered results
+	aliceCursor := cursor{Fingerprint: fingerprint(1, filters{genders: []string{}}, ""), Offset: 1}.encode(secret)
+	expiredCursor := cursor{Snapshot: snapshot{Time: now.Add(-maxCursorAge - time.Second).Unix()}, Fingerprint: fingerprint(1, filters{genders: []string{}}, ""), Offset: 1}.encode(secret)
+	// the expired cursor with its time moved forward to get round maxCursorAge
+	payload, signature, _ := strings.Cut(expiredCursor, ".")
+	data, _ := base64.RawURLEncoding.DecodeString(payload)
+	forgedData := bytes.Replace(data, []byte(strconv.FormatInt(now.Add(-maxCursorAge-time.Second).Unix(), 10)), []byte(strconv.FormatInt(now.Unix(), 10)), 1)
+	forgedCursor := base64.RawURLEncoding.EncodeToString(forgedData) + "." + signature
+	otherSecretCursor := cursor{Fingerprint: fingerprint(1, filters{genders: []string{}}, ""), Offset: 1}.encode([]byte("another-secret"))
+
+	tests := []struct {
+		name          string
+		userID        int
+		target        string
+		expectedError string
+	}{
+		{name: "limit isn't a number", userID: 1, target: "/discover?limit=ten", expectedError: "limit must be between 1 and 100"},
+		{name: "limit is too large", userID: 1, target: "/discover?limit=101", expectedError: "limit must be between 1 and 100"},
+		{name: "cursor isn't valid", userID: 1, target: "/discover?cursor=not-a-cursor", expectedError: "cursor is invalid"},
+		{name: "cursor used with other filters", userID: 1, target: "/discover?gender=male&cursor=" + aliceCursor, expectedError: "cursor was created with different filters, start again without a cursor"},
+		{name: "cursor used by another user", userID: 2, target: "/discover?cursor=" + aliceCursor, expectedError: "cursor was created with different filters, start again without a cursor"},
+		{name: "cursor has expired", userID: 1, target: "/discover?cursor=" + expiredCursor, expectedError: "cursor has expired, start again without a cursor"},
+		{name: "cursor has been changed", userID: 1, target: "/discover?cursor=" + forgedCursor, expectedError: "cursor is invalid"},
+		{name: "cursor isn't signed", userID: 1, target: "/discover?cursor=" + payload, expectedError: "cursor is invalid"},
+		{name: "cursor signed with another secret", userID: 1, target: "/discover?cursor=" + otherSecretCursor, expectedError: "cursor is invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: tt.userID})
+			req, err := http.NewRequestWithContext(ctx, "GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+
+			var response httpresponse.ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectedError, response.Error)
+		})
+	}
+}
+
+func TestDiscoverHandlerSpatialIndex(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob starts ~111km from Alice and Charlie is next to her
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1990-01-01', 1, 0),
+	('Charlie', 'male', '1990-01-01', 0, 0.1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	discover := func(deps DiscoverHandlerDeps, target string) []int {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		DiscoverHandler(deps).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response DiscoverResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []int{}
+		for _, p := range response.Results {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	deps := DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db}
+	assert.ElementsMatch(t, []int{3}, discover(deps, "/discover?max_distance_km=50"))
+
+	t.Run("the index follows users who move", func(t *testing.T) {
+		if _, err := db.Exec("UPDATE users SET lat = 0, lng = 0.2 WHERE id = 2"); err != nil {
+			t.Fatal(err)
+		}
+		assert.ElementsMatch(t, []int{2, 3}, discover(deps, "/discover?max_distance_km=50"))
+
+		if _, err := db.Exec("UPDATE users SET lat = 1, lng = 0 WHERE id = 2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("default max distance is used when the user hasn't saved their preferences", func(t *testing.T) {
+		deps := deps
+		deps.DefaultMaxDistanceKm = 50
+		assert.ElementsMatch(t, []int{3}, discover(deps, "/discover"))
+		assert.ElementsMatch(t, []int{2, 3}, discover(deps, "/discover?max_distance_km=200"))
+	})
+
+	t.Run("saved preferences without a max distance have no limit", func(t *testing.T) {
+		if err := user.SavePreferences(db, 1, user.Preferences{}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Exec("DELETE FROM preferences WHERE user_id = 1") })
+
+		deps := deps
+		deps.DefaultMaxDistanceKm = 50
+		assert.ElementsMatch(t, []int{2, 3}, discover(deps, "/discover"))
+	})
+}
+
+func TestDiscoverHandlerPhotoURL(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob) VALUES
+	('Alice', 'female', '1990-01-01'),
+	('Bob', 'male', '1985-01-01'),
+	('Charlie', 'male', '1995-01-01');
+
+	INSERT INTO photos (user_id, blob_key, position, is_primary, created_at) VALUES
+	(2, 'bob-first', 0, FALSE, 1711929600),
+	(2, 'bob-primary', 1, TRUE, 1711929600);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1}), "GET", "/discover", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	photoURL := func(photoKey string) string { return "https://photos.example/" + photoKey }
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, PhotoURL: photoURL}))
+	handler.ServeHTTP(rr, req)
+
+	var response DiscoverResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	photoURLs := map[int]string{}
+	for _, p := range response.Results {
+		photoURLs[p.ID] = p.PhotoURL
+	}
+	assert.Equal(t, map[int]string{2: "https://photos.example/bob-primary", 3: ""}, photoURLs)
+}
+
 func TestDiscoverHandlerNoProfiles(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
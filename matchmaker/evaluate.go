@@ -0,0 +1,247 @@
+package matchmaker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// NamedScorer is a scorer to evaluate and what to call it in the results
+type NamedScorer struct {
+	Name   string         `json:"name"`
+	Scorer WeightedScorer `json:"scorer"`
+}
+
+// EvaluationOptions controls how Evaluate replays the swipes
+type EvaluationOptions struct {
+	// how many of the top ranked candidates are looked at
+	K int
+	// only every Nth swipe is evaluated as ranking everyone for every swipe is slow, 1 evaluates them all
+	Every int
+	// ages are worked out at this time
+	Now time.Time
+	// the same as DiscoverHandlerDeps so the candidates are found the way discover finds them
+	RequireVerifiedEmail bool
+	DefaultMaxDistanceKm float64
+}
+
+// EvaluationResult is how well a scorer predicted the swipes, each metric is the mean over every evaluated swipe
+type EvaluationResult struct {
+	Scorer string
+	// how many swipes were evaluated
+	Points int
+	// share of the top K who the user went on to like
+	PrecisionAtK float64
+	// discounted cumulative gain of the top K relative to the best possible ranking, likes ranked higher count for more
+	NDCGAtK float64
+	// share of the top K who the user went on to like and matched with
+	MatchRateAtK float64
+	// how many swipes were skipped as the swiper has since been deleted, the same for every scorer
+	DeletedSwipers int
+}
+
+// a swipe from the history
+type historicSwipe struct {
+	id          int
+	swiper      int
+	swipeTarget int
+	liked       bool
+}
+
+// Evaluate replays the swipe history in the order it happened. Before each evaluated swipe the swiper's candidates are
+// found once with the same filters as discover, using a snapshot from just before the swipe, then ranked by each
+// scorer and the ranking is compared with who the swiper actually went on to like. Swipes are skipped when none of the people the swiper went on
+// to like are among their candidates as the ranking can't make a difference, and when the swiper has since been deleted.
+// History which isn't kept is taken from the db as it is now: locations, preferences and everyone's dob. Users are
+// assumed to exist from the first swipe involving anyone with the same or a higher id. Recommendations and exploration
+// aren't used as the db doesn't know what they were at the time of each swipe.
+func Evaluate(ctx context.Context, db *sql.DB, scorers []NamedScorer, options EvaluationOptions) ([]EvaluationResult, error) {
+	if len(scorers) == 0 {
+		return nil, errors.New("at least one scorer is needed")
+	}
+	for _, s := range scorers {
+		if err := s.Scorer.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if options.K < 1 {
+		return nil, errors.New("k must be at least 1")
+	}
+	if options.Every < 1 {
+		options.Every = 1
+	}
+
+	swipes, err := loadSwipeHistory(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	matched, err := loadMatches(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// each user's swipes in order, to find who they liked after a point
+	byUser := map[int][]historicSwipe{}
+	for _, s := range swipes {
+		byUser[s.swiper] = append(byUser[s.swiper], s)
+	}
+	// how many of each user's swipes have been replayed
+	replayed := map[int]int{}
+
+	results := make([]EvaluationResult, len(scorers))
+	for i, s := range scorers {
+		results[i].Scorer = s.Name
+	}
+
+	maxUserID, deletedSwipers := 0, 0
+	for i, swipe := range swipes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		maxUserID = max(maxUserID, swipe.swiper, swipe.swipeTarget)
+		later := byUser[swipe.swiper][replayed[swipe.swiper]:]
+		replayed[swipe.swiper]++
+		if i%options.Every != 0 {
+			continue
+		}
+
+		// the swiper goes on to like these people, starting with this swipe
+		liked := map[int]bool{}
+		for _, s := range later {
+			if s.liked {
+				liked[s.swipeTarget] = true
+			}
+		}
+		if len(liked) == 0 {
+			continue
+		}
+
+		s := snapshot{MaxUserID: maxUserID, MaxSwipeID: swipe.id - 1, Time: options.Now.Unix()}
+		v, err := getViewer(db, swipe.swiper, s.now())
+		if errors.Is(err, errUserNotFound) {
+			deletedSwipers++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f, err := userFilters(db, swipe.swiper, options.RequireVerifiedEmail, options.DefaultMaxDistanceKm)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates, err := queryCandidates(db, v, s, f, "")
+		if err != nil {
+			return nil, err
+		}
+		bounds := boundsOf(candidates)
+
+		for j, scorer := range scorers {
+			// every candidate is scored again so the previous scorer's order doesn't matter
+			for _, p := range candidates {
+				bounds.score(p, scorer.Scorer)
+			}
+			sortByScore(candidates)
+
+			precision, ndcg, matchRate, ok := rankingMetrics(candidates, liked, matched[swipe.swiper], options.K)
+			if !ok {
+				// the same for every scorer as they rank the same candidates
+				break
+			}
+			results[j].Points++
+			results[j].PrecisionAtK += precision
+			results[j].NDCGAtK += ndcg
+			results[j].MatchRateAtK += matchRate
+		}
+	}
+
+	for i := range results {
+		results[i].DeletedSwipers = deletedSwipers
+		if results[i].Points > 0 {
+			points := float64(results[i].Points)
+			results[i].PrecisionAtK /= points
+			results[i].NDCGAtK /= points
+			results[i].MatchRateAtK /= points
+		}
+	}
+	return results, nil
+}
+
+// precision@k, NDCG@k and match rate@k of the ranking, false when none of the liked users were ranked
+func rankingMetrics(ranked []*profile, liked map[int]bool, matched map[int]bool, k int) (float64, float64, float64, bool) {
+	relevant := 0
+	for _, p := range ranked {
+		if liked[p.ID] {
+			relevant++
+		}
+	}
+	if relevant == 0 {
+		return 0, 0, 0, false
+	}
+
+	top := ranked[:min(k, len(ranked))]
+	var hits, matches int
+	var dcg, idcg float64
+	for i, p := range top {
+		if liked[p.ID] {
+			hits++
+			dcg += 1 / math.Log2(float64(i+2))
+			if matched[p.ID] {
+				matches++
+			}
+		}
+	}
+	// the best ranking puts every liked candidate first
+	for i := 0; i < min(relevant, len(top)); i++ {
+		idcg += 1 / math.Log2(float64(i+2))
+	}
+
+	return float64(hits) / float64(len(top)), dcg / idcg, float64(matches) / float64(len(top)), true
+}
+
+func loadSwipeHistory(ctx context.Context, db *sql.DB) ([]historicSwipe, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, swiper, swipe_target, liked FROM swipes ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	swipes := []historicSwipe{}
+	for rows.Next() {
+		var s historicSwipe
+		if err := rows.Scan(&s.id, &s.swiper, &s.swipeTarget, &s.liked); err != nil {
+			return nil, err
+		}
+		swipes = append(swipes, s)
+	}
+	return swipes, rows.Err()
+}
+
+// who each user has matched with
+func loadMatches(ctx context.Context, db *sql.DB) (map[int]map[int]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT user1, user2 FROM matches")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matched := map[int]map[int]bool{}
+	add := func(a, b int) {
+		if matched[a] == nil {
+			matched[a] = map[int]bool{}
+		}
+		matched[a][b] = true
+	}
+	for rows.Next() {
+		var user1, user2 int
+		if err := rows.Scan(&user1, &user2); err != nil {
+			return nil, err
+		}
+		add(user1, user2)
+		add(user2, user1)
+	}
+	return matched, rows.Err()
+}
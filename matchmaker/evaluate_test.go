@@ -0,0 +1,134 @@
+package matchmaker
+
+import (
+	"context"
+	"database/sql"
+	"muzz/store"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankingMetrics(t *testing.T) {
+	ranked := []*profile{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+
+	precision, ndcg, matchRate, ok := rankingMetrics(ranked, map[int]bool{1: true, 2: true}, map[int]bool{2: true}, 2)
+	assert.True(t, ok)
+	assert.InDelta(t, 1.0, precision, 1e-9)
+	assert.InDelta(t, 1.0, ndcg, 1e-9)
+	assert.InDelta(t, 0.5, matchRate, 1e-9)
+
+	// the like is ranked second instead of first
+	precision, ndcg, _, _ = rankingMetrics(ranked, map[int]bool{2: true}, nil, 2)
+	assert.InDelta(t, 0.5, precision, 1e-9)
+	assert.InDelta(t, 1/1.5849625, ndcg, 1e-6)
+
+	// the like is outside the top k
+	precision, ndcg, _, _ = rankingMetrics(ranked, map[int]bool{4: true}, nil, 2)
+	assert.Equal(t, 0.0, precision)
+	assert.Equal(t, 0.0, ndcg)
+
+	// k is more than the candidates
+	precision, _, _, _ = rankingMetrics(ranked, map[int]bool{1: true}, nil, 10)
+	assert.InDelta(t, 0.25, precision, 1e-9)
+
+	// none of the likes were candidates
+	_, _, _, ok = rankingMetrics(ranked, map[int]bool{5: true}, nil, 2)
+	assert.False(t, ok)
+}
+
+func TestEvaluate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice likes Bob and Charlie who are near her and Bob likes her back, Gus likes Dani and Eve who are near him
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1990-01-01', 0, 0.1),
+	('Charlie', 'male', '1990-01-01', 0, 0.2),
+	('Dani', 'non-binary', '1990-01-01', 0, 5),
+	('Eve', 'female', '1990-01-01', 0, 6),
+	('Gus', 'male', '1990-01-01', 0, 7);
+
+	INSERT INTO swipes (swiper, swipe_target, liked) VALUES
+	(6, 4, TRUE),
+	(6, 5, TRUE),
+	(1, 2, TRUE),
+	(1, 3, TRUE),
+	(2, 1, TRUE);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	scorers := []NamedScorer{
+		{Name: "distance", Scorer: WeightedScorer{DistanceWeight: 1}},
+		{Name: "likes", Scorer: WeightedScorer{LikesWeight: 1}},
+	}
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	results, err := Evaluate(context.Background(), db, scorers, EvaluationOptions{K: 2, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// distance puts the people who were liked next at the top, likes puts Dani and Eve who Gus liked at the top
+	assert.Equal(t, "distance", results[0].Scorer)
+	assert.Equal(t, 5, results[0].Points)
+	assert.InDelta(t, 0.7, results[0].PrecisionAtK, 1e-9)
+	assert.InDelta(t, 1.0, results[0].NDCGAtK, 1e-9)
+	assert.InDelta(t, 0.2, results[0].MatchRateAtK, 1e-9)
+
+	assert.Equal(t, "likes", results[1].Scorer)
+	assert.Equal(t, 5, results[1].Points)
+	assert.Equal(t, 0.0, results[1].PrecisionAtK)
+	assert.Equal(t, 0.0, results[1].NDCGAtK)
+	assert.Equal(t, 0.0, results[1].MatchRateAtK)
+
+	results, err = Evaluate(context.Background(), db, scorers, EvaluationOptions{K: 2, Every: 2, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, results[0].Points)
+
+	// the filters are the ones discover uses, Gus has never saved preferences so Dani and Eve are too far away
+	results, err = Evaluate(context.Background(), db, scorers, EvaluationOptions{K: 2, Now: now, DefaultMaxDistanceKm: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, results[0].Points)
+	assert.Equal(t, 3, results[1].Points)
+
+	results, err = Evaluate(context.Background(), db, scorers, EvaluationOptions{K: 2, Now: now, RequireVerifiedEmail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, results[0].Points, "nobody has verified their email")
+
+	// swipes from users who have since been deleted are skipped rather than ending the run
+	if _, err := db.Exec("DELETE FROM users WHERE id = 6"); err != nil {
+		t.Fatal(err)
+	}
+	results, err = Evaluate(context.Background(), db, scorers, EvaluationOptions{K: 2, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, results[0].Points)
+	assert.Equal(t, 2, results[0].DeletedSwipers)
+	assert.Equal(t, 2, results[1].DeletedSwipers)
+	assert.InDelta(t, 2.0/3, results[0].PrecisionAtK, 1e-9)
+
+	_, err = Evaluate(context.Background(), db, scorers, EvaluationOptions{Now: now})
+	assert.Error(t, err)
+	_, err = Evaluate(context.Background(), db, []NamedScorer{{Name: "none"}}, EvaluationOptions{K: 2, Now: now})
+	assert.Error(t, err)
+}
@@ -0,0 +1,279 @@
+package matchmaker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"muzz/httpresponse"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Variant is one version of discover's ranking in an experiment
+type Variant struct {
+	Name string `json:"name"`
+	// how many of the experiment's users get this variant relative to the other variants
+	Weight int `json:"weight"`
+	// how the variant ranks candidates
+	Scorer WeightedScorer `json:"scorer"`
+}
+
+// Experiment splits some of the users between variants of the ranking so they can be compared
+type Experiment struct {
+	Name string `json:"name"`
+	// percentage of all users in the experiment, a user is only ever in one experiment
+	Traffic  int       `json:"traffic"`
+	Variants []Variant `json:"variants"`
+}
+
+// Experiments assigns users to experiments and records what they were shown and how they swiped, so the variants can
+// be compared. Users are assigned by hashing their id so they stay in the same variant as long as the config doesn't
+// change, users outside every experiment get the normal ranking.
+type Experiments struct {
+	db          *sql.DB
+	experiments []Experiment
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates the experiments, users are split between them in the order they are given
+func NewExperiments(db *sql.DB, experiments []Experiment) (*Experiments, error) {
+	names := map[string]bool{}
+	traffic := 0
+	for _, e := range experiments {
+		if e.Name == "" {
+			return nil, errors.New("experiments must have a name")
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("experiment %q is defined twice", e.Name)
+		}
+		names[e.Name] = true
+
+		if e.Traffic < 0 || e.Traffic > 100 {
+			return nil, fmt.Errorf("experiment %q traffic must be between 0 and 100", e.Name)
+		}
+		traffic += e.Traffic
+
+		if len(e.Variants) == 0 {
+			return nil, fmt.Errorf("experiment %q must have at least one variant", e.Name)
+		}
+		variants := map[string]bool{}
+		for _, v := range e.Variants {
+			if v.Name == "" || variants[v.Name] {
+				return nil, fmt.Errorf("experiment %q variants must have unique names", e.Name)
+			}
+			variants[v.Name] = true
+			if v.Weight <= 0 {
+				return nil, fmt.Errorf("experiment %q variant %q weight must be more than 0", e.Name, v.Name)
+			}
+			if err := v.Scorer.Validate(); err != nil {
+				return nil, fmt.Errorf("experiment %q variant %q: %w", e.Name, v.Name, err)
+			}
+		}
+	}
+	if traffic > 100 {
+		return nil, errors.New("experiments can't have more than 100% of the traffic between them")
+	}
+
+	return &Experiments{db: db, experiments: experiments}, nil
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (e *Experiments) now() time.Time {
+	if e.clock == nil {
+		return time.Now()
+	}
+	return e.clock()
+}
+
+func hashUserID(salt string, userID int) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d", salt, userID)
+	return h.Sum64()
+}
+
+// Assign returns the experiment and variant the user is in, false when they aren't in any
+func (e *Experiments) Assign(userID int) (Experiment, Variant, bool) {
+	// each user lands in one of 100 buckets, the experiments take up the buckets in order
+	bucket := int(hashUserID("", userID) % 100)
+	for _, experiment := range e.experiments {
+		if bucket >= experiment.Traffic {
+			bucket -= experiment.Traffic
+			continue
+		}
+
+		// hashed again with the experiment name so the variants don't depend on which bucket the user is in
+		total := 0
+		for _, v := range experiment.Variants {
+			total += v.Weight
+		}
+		pick := int(hashUserID(experiment.Name, userID) % uint64(total))
+		for _, v := range experiment.Variants {
+			if pick < v.Weight {
+				return experiment, v, true
+			}
+			pick -= v.Weight
+		}
+	}
+	return Experiment{}, Variant{}, false
+}
+
+// UsesRecommendations reports whether any variant with users in it ranks with the recommender's scores
+func (e *Experiments) UsesRecommendations() bool {
+	for _, experiment := range e.experiments {
+		if experiment.Traffic == 0 {
+			continue
+		}
+		for _, v := range experiment.Variants {
+			if UsesRecommendations(v.Scorer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RecordExposure stores that the user was shown the variant's ranking, each user is only counted once per variant
+func (e *Experiments) RecordExposure(userID int, experiment string, variant string) error {
+	_, err := e.db.Exec("INSERT OR IGNORE INTO experiment_exposures (experiment, variant, user_id, exposed_at) VALUES (?, ?, ?, ?)",
+		experiment, variant, userID, e.now().Unix())
+	return err
+}
+
+// records the swipe against the swiper's variant, must be called in the same transaction the swipe is stored in.
+// Swipes made before the swiper was shown the variant's ranking weren't made from it so aren't counted
+func (e *Experiments) recordSwipeInTransaction(tx *sql.Tx, swiper int, swipeTarget int) error {
+	experiment, variant, ok := e.Assign(swiper)
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO experiment_swipes (experiment, variant, swipe_id)
+	SELECT ?, ?, id FROM swipes WHERE swiper = ? AND swipe_target = ?
+	AND EXISTS (SELECT 1 FROM experiment_exposures WHERE experiment = ? AND variant = ? AND user_id = ?)`,
+		experiment.Name, variant.Name, swiper, swipeTarget, experiment.Name, variant.Name, swiper)
+	return err
+}
+
+// VariantReport is how the users in a variant have swiped since they were first shown it
+type VariantReport struct {
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
+	// users who have been shown the variant's ranking
+	Users  int `json:"users"`
+	Swipes int `json:"swipes"`
+	Likes  int `json:"likes"`
+	// likes which have turned into a match so far
+	Matches int `json:"matches"`
+	// likes and matches per swipe, 0 before there are any swipes
+	LikeRate  float64 `json:"like_rate"`
+	MatchRate float64 `json:"match_rate"`
+}
+
+// Report returns every variant which has been run, or is configured, ordered by experiment and variant
+func (e *Experiments) Report() ([]VariantReport, error) {
+	type key struct{ experiment, variant string }
+	reports := map[key]*VariantReport{}
+	report := func(experiment string, variant string) *VariantReport {
+		k := key{experiment, variant}
+		if reports[k] == nil {
+			reports[k] = &VariantReport{Experiment: experiment, Variant: variant}
+		}
+		return reports[k]
+	}
+
+	for _, experiment := range e.experiments {
+		for _, v := range experiment.Variants {
+			report(experiment.Name, v.Name)
+		}
+	}
+
+	rows, err := e.db.Query("SELECT experiment, variant, COUNT(*) FROM experiment_exposures GROUP BY experiment, variant")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var experiment, variant string
+		var users int
+		if err := rows.Scan(&experiment, &variant, &users); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report(experiment, variant).Users = users
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// a like counts as a match however long it took the other person to like them back
+	rows, err = e.db.Query(`
+	SELECT es.experiment, es.variant, COUNT(*), COALESCE(SUM(s.liked), 0),
+	COALESCE(SUM(s.liked AND EXISTS (SELECT 1 FROM matches m WHERE m.user1 = MIN(s.swiper, s.swipe_target) AND m.user2 = MAX(s.swiper, s.swipe_target))), 0)
+	FROM experiment_swipes es
+	JOIN swipes s ON s.id = es.swipe_id
+	GROUP BY es.experiment, es.variant`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var experiment, variant string
+		var swipes, likes, matches int
+		if err := rows.Scan(&experiment, &variant, &swipes, &likes, &matches); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r := report(experiment, variant)
+		r.Swipes, r.Likes, r.Matches = swipes, likes, matches
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]VariantReport, 0, len(reports))
+	for _, r := range reports {
+		if r.Swipes > 0 {
+			r.LikeRate = float64(r.Likes) / float64(r.Swipes)
+			r.MatchRate = float64(r.Matches) / float64(r.Swipes)
+		}
+		results = append(results, *r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Experiment != results[j].Experiment {
+			return results[i].Experiment < results[j].Experiment
+		}
+		return results[i].Variant < results[j].Variant
+	})
+	return results, nil
+}
+
+// The JSON response for the experiments report handler
+type ExperimentsReportResponse struct {
+	Results []VariantReport `json:"results"`
+}
+
+type ExperimentsHandlerDeps struct {
+	Experiments *Experiments
+}
+
+// reports the like rate and match rate of every experiment variant, for admins
+func ExperimentsReportHandler(deps ExperimentsHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		reports, err := deps.Experiments.Report()
+		if err != nil {
+			slog.Error("failed to report experiments", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to report experiments"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(ExperimentsReportResponse{Results: reports})
+	}
+}
@@ -0,0 +1,234 @@
+package matchmaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"muzz/auth"
+	"muzz/middleware"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExperiments(t *testing.T) {
+	variant := func(name string) Variant {
+		return Variant{Name: name, Weight: 1, Scorer: WeightedScorer{DistanceWeight: 1}}
+	}
+
+	tests := []struct {
+		name        string
+		experiments []Experiment
+		wantErr     bool
+	}{
+		{name: "no experiments"},
+		{name: "one experiment", experiments: []Experiment{{Name: "a", Traffic: 100, Variants: []Variant{variant("control"), variant("test")}}}},
+		{name: "experiments share the traffic", experiments: []Experiment{{Name: "a", Traffic: 60, Variants: []Variant{variant("x")}}, {Name: "b", Traffic: 40, Variants: []Variant{variant("x")}}}},
+		{name: "more than 100% traffic", experiments: []Experiment{{Name: "a", Traffic: 60, Variants: []Variant{variant("x")}}, {Name: "b", Traffic: 41, Variants: []Variant{variant("x")}}}, wantErr: true},
+		{name: "no name", experiments: []Experiment{{Traffic: 10, Variants: []Variant{variant("x")}}}, wantErr: true},
+		{name: "same name", experiments: []Experiment{{Name: "a", Variants: []Variant{variant("x")}}, {Name: "a", Variants: []Variant{variant("x")}}}, wantErr: true},
+		{name: "negative traffic", experiments: []Experiment{{Name: "a", Traffic: -1, Variants: []Variant{variant("x")}}}, wantErr: true},
+		{name: "no variants", experiments: []Experiment{{Name: "a", Traffic: 10}}, wantErr: true},
+		{name: "same variant", experiments: []Experiment{{Name: "a", Traffic: 10, Variants: []Variant{variant("x"), variant("x")}}}, wantErr: true},
+		{name: "no weight", experiments: []Experiment{{Name: "a", Traffic: 10, Variants: []Variant{{Name: "x", Scorer: WeightedScorer{DistanceWeight: 1}}}}}, wantErr: true},
+		{name: "invalid scorer", experiments: []Experiment{{Name: "a", Traffic: 10, Variants: []Variant{{Name: "x", Weight: 1}}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewExperiments(nil, tt.experiments)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExperimentsAssign(t *testing.T) {
+	experiments, err := NewExperiments(nil, []Experiment{
+		{Name: "likes", Traffic: 50, Variants: []Variant{
+			{Name: "control", Weight: 3, Scorer: WeightedScorer{DistanceWeight: 1}},
+			{Name: "likes", Weight: 1, Scorer: WeightedScorer{LikesWeight: 1}},
+		}},
+		{Name: "rating", Traffic: 20, Variants: []Variant{
+			{Name: "rating", Weight: 1, Scorer: WeightedScorer{RatingWeight: 1}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for userID := 1; userID <= 10000; userID++ {
+		experiment, variant, ok := experiments.Assign(userID)
+		if !ok {
+			counts["none"]++
+			continue
+		}
+		counts[experiment.Name+"/"+variant.Name]++
+
+		// the same user always gets the same variant
+		again, variantAgain, _ := experiments.Assign(userID)
+		assert.Equal(t, experiment.Name, again.Name)
+		assert.Equal(t, variant.Name, variantAgain.Name)
+	}
+
+	assert.InDelta(t, 3750, counts["likes/control"], 250)
+	assert.InDelta(t, 1250, counts["likes/likes"], 250)
+	assert.InDelta(t, 2000, counts["rating/rating"], 250)
+	assert.InDelta(t, 3000, counts["none"], 250)
+
+	none, err := NewExperiments(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok := none.Assign(1)
+	assert.False(t, ok)
+}
+
+func TestExperimentsReport(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	experiments, err := NewExperiments(db, []Experiment{{Name: "ranking", Traffic: 100, Variants: []Variant{
+		{Name: "distance", Weight: 1, Scorer: WeightedScorer{DistanceWeight: 1}},
+		{Name: "likes", Weight: 1, Scorer: WeightedScorer{LikesWeight: 1}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	experiments.clock = func() time.Time { return now }
+
+	discover := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Experiments: experiments})
+	swipe := SwipeHandler(SwipeHandlerDeps{DB: db, Experiments: experiments})
+
+	request := func(handler http.Handler, userID int, method string, target string, body string) {
+		ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID})
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	variants := map[int]string{}
+	for userID := 1; userID <= 6; userID++ {
+		_, variant, _ := experiments.Assign(userID)
+		variants[userID] = variant.Name
+	}
+
+	// Dani and Eve look at discover twice, Dani likes Alice who already liked her, Dani passes on Bob and Eve likes Frank
+	request(discover, 4, "GET", "/discover", "")
+	request(discover, 4, "GET", "/discover", "")
+	request(discover, 5, "GET", "/discover", "")
+	request(swipe, 4, "POST", "/swipe", `{"other_user_id": 1, "like": true}`)
+	request(swipe, 4, "POST", "/swipe", `{"other_user_id": 2, "like": false}`)
+	request(swipe, 5, "POST", "/swipe", `{"other_user_id": 6, "like": true}`)
+
+	expected := map[string]*VariantReport{
+		"distance": {Experiment: "ranking", Variant: "distance"},
+		"likes":    {Experiment: "ranking", Variant: "likes"},
+	}
+	expected[variants[4]].Users++
+	expected[variants[4]].Swipes += 2
+	expected[variants[4]].Likes++
+	expected[variants[4]].Matches++
+	expected[variants[5]].Users++
+	expected[variants[5]].Swipes++
+	expected[variants[5]].Likes++
+	for _, r := range expected {
+		if r.Swipes > 0 {
+			r.LikeRate = float64(r.Likes) / float64(r.Swipes)
+			r.MatchRate = float64(r.Matches) / float64(r.Swipes)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/admin/experiments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	ExperimentsReportHandler(ExperimentsHandlerDeps{Experiments: experiments}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response ExperimentsReportResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []VariantReport{*expected["distance"], *expected["likes"]}, response.Results, fmt.Sprintf("variants %v", variants))
+
+	// Eve matches once Frank likes her back
+	request(swipe, 6, "POST", "/swipe", `{"other_user_id": 5, "like": true}`)
+	reports, err := experiments.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if r.Variant == variants[5] {
+			assert.Equal(t, expected[variants[5]].Matches+1, r.Matches)
+		}
+	}
+}
+
+func TestExperimentsOnlyCountSwipesAfterExposure(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	experiments, err := NewExperiments(db, []Experiment{{Name: "ranking", Traffic: 100, Variants: []Variant{
+		{Name: "distance", Weight: 1, Scorer: WeightedScorer{DistanceWeight: 1}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	experiments.clock = func() time.Time { return now }
+
+	discover := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Experiments: experiments})
+	swipe := SwipeHandler(SwipeHandlerDeps{DB: db, Experiments: experiments})
+
+	request := func(handler http.Handler, method string, target string, body string) {
+		ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 4})
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	swipes := func() int {
+		t.Helper()
+		reports, err := experiments.Report()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !assert.Len(t, reports, 1) {
+			t.FailNow()
+		}
+		return reports[0].Swipes
+	}
+
+	// Dani likes Alice before she has been shown the variant's ranking, so it tells us nothing about the variant
+	request(swipe, "POST", "/swipe", `{"other_user_id": 1, "like": true}`)
+	assert.Equal(t, 0, swipes())
+
+	// once she has seen it her swipes count
+	request(discover, "GET", "/discover", "")
+	request(swipe, "POST", "/swipe", `{"other_user_id": 2, "like": true}`)
+	assert.Equal(t, 1, swipes())
+}
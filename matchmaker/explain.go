@@ -0,0 +1,141 @@
+package matchmaker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"muzz/user"
+	"slices"
+	"sort"
+)
+
+// how a candidate was ranked, or why they were left out, in discover's explain mode
+type candidateExplanation struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Gender string `json:"gender"`
+	// position in the results starting from 1, 0 when a filter left them out
+	Rank int `json:"rank"`
+	// every filter and whether the candidate passed it, the `their_` filters are the candidate's own preferences
+	Filters map[string]bool `json:"filters"`
+
+	// the rest are only set for candidates in the results, features are normalized against the other results
+	Features *Features `json:"features,omitempty"`
+	// how much each feature added to the score, when the scorer can break its score down
+	Contributions map[string]float64 `json:"contributions,omitempty"`
+	Score         *float64           `json:"score,omitempty"`
+	// placed in an exploration slot
+	Explored bool `json:"explored,omitempty"`
+}
+
+// The JSON response for the discover handler in explain mode
+type DiscoverExplanation struct {
+	// who the results are for
+	UserID int `json:"user_id"`
+	// the experiment variant which ranked the results, empty when the user isn't in an experiment
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	// the candidates in the results in the order they are shown, followed by the ones which were left out
+	Results []candidateExplanation `json:"results"`
+	// pass as the cursor param along with explain to get the next page, null on the last page
+	NextCursor *string `json:"next_cursor"`
+}
+
+// explainMatches ranks the candidates the same way getPotentialMatches does and explains the ranking, along with
+// which filters left out everyone else in the snapshot
+func explainMatches(db *sql.DB, viewer viewer, snapshot snapshot, filters filters, scorer Scorer, exploration ExplorationPolicy) ([]candidateExplanation, error) {
+	ranked, err := getPotentialMatches(db, viewer, snapshot, filters, scorer, exploration)
+	if err != nil {
+		return nil, err
+	}
+	ranks := make(map[int]*profile, len(ranked))
+	positions := make(map[int]int, len(ranked))
+	for i, p := range ranked {
+		ranks[p.ID] = p
+		positions[p.ID] = i + 1
+	}
+
+	explaining, canExplain := scorer.(ExplainingScorer)
+	now := snapshot.now()
+
+	rows, err := db.Query(`
+	SELECT u.id, u.name, u.gender, u.dob, u.lat, u.lng, u.email_verified_at IS NOT NULL,
+	EXISTS (SELECT 1 FROM swipes s WHERE s.swiper = ? AND s.swipe_target = u.id AND s.id <= ?),
+	cp.genders, cp.min_age, cp.max_age, cp.max_distance_km
+	FROM users u
+	LEFT JOIN preferences cp ON cp.user_id = u.id
+	WHERE u.id != ? AND u.id <= ?
+	ORDER BY u.id`, viewer.id, snapshot.MaxSwipeID, viewer.id, snapshot.MaxUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	explanations := []candidateExplanation{}
+	for rows.Next() {
+		var e candidateExplanation
+		var name, gender, dob, theirGenders sql.NullString
+		var location user.GeoLocation
+		var verified, swiped bool
+		var theirMinAge, theirMaxAge sql.NullInt64
+		var theirMaxDistance sql.NullFloat64
+		if err := rows.Scan(&e.ID, &name, &gender, &dob, &location.Lat, &location.Long, &verified, &swiped, &theirGenders, &theirMinAge, &theirMaxAge, &theirMaxDistance); err != nil {
+			return nil, err
+		}
+		e.Name, e.Gender = name.String, gender.String
+
+		genders := []string{}
+		if theirGenders.Valid {
+			if err := json.Unmarshal([]byte(theirGenders.String), &genders); err != nil {
+				return nil, fmt.Errorf("invalid genders preference for user %d: %w", e.ID, err)
+			}
+		}
+
+		// a candidate without a valid dob fails any age limit, as does a viewer without one
+		var age *int
+		if dob.Valid {
+			if a, err := user.CalculateAge(dob.String, now); err == nil {
+				age = &a
+			}
+		}
+		distance := haversineDistance(location.Lat, location.Long, viewer.location.Lat, viewer.location.Long)
+
+		e.Filters = map[string]bool{
+			"not_swiped":         !swiped,
+			"gender":             len(filters.genders) == 0 || slices.Contains(filters.genders, e.Gender),
+			"min_age":            filters.minAge == 0 || (age != nil && *age >= filters.minAge),
+			"max_age":            filters.maxAge == 0 || (age != nil && *age <= filters.maxAge),
+			"max_distance_km":    filters.maxDistanceKm == 0 || distance <= filters.maxDistanceKm,
+			"verified":           !filters.verifiedOnly || verified,
+			"their_genders":      len(genders) == 0 || slices.Contains(genders, viewer.gender),
+			"their_min_age":      !theirMinAge.Valid || (viewer.age != nil && *viewer.age >= int(theirMinAge.Int64)),
+			"their_max_age":      !theirMaxAge.Valid || (viewer.age != nil && *viewer.age <= int(theirMaxAge.Int64)),
+			"their_max_distance": !theirMaxDistance.Valid || distance <= theirMaxDistance.Float64,
+		}
+
+		if p, ok := ranks[e.ID]; ok {
+			features := p.features
+			score := p.attractivenessScore
+			e.Rank = positions[e.ID]
+			e.Features = &features
+			e.Score = &score
+			e.Explored = p.explored
+			if canExplain {
+				e.Contributions = explaining.Contributions(features)
+			}
+		}
+		explanations = append(explanations, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// ranked candidates first, the rest stay in id order
+	sort.SliceStable(explanations, func(i, j int) bool {
+		if explanations[i].Rank == 0 || explanations[j].Rank == 0 {
+			return explanations[i].Rank != 0 && explanations[j].Rank == 0
+		}
+		return explanations[i].Rank < explanations[j].Rank
+	})
+	return explanations, nil
+}
@@ -0,0 +1,139 @@
+package matchmaker
+
+import (
+	"context"
+	"encoding/json"
+	"muzz/auth"
+	"muzz/middleware"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverHandlerExplain(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	// Alice is an admin, everyone else is further north the higher their id and Frank only wants to see men
+	if _, err := db.Exec(`
+	UPDATE users SET is_admin = 1 WHERE id = 1;
+	UPDATE users SET lat = id WHERE id != 1;
+	INSERT INTO preferences (user_id, genders) VALUES (6, '["male"]');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Scorer: WeightedScorer{DistanceWeight: 1}})
+
+	explain := func(userID int, target string) (int, DiscoverExplanation) {
+		ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID})
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		var response DiscoverExplanation
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, response
+	}
+
+	ids := func(response DiscoverExplanation) []int {
+		ids := []int{}
+		for _, e := range response.Results {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	code, response := explain(1, "/discover?explain=true")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, response.UserID)
+	// the ranked candidates come first then Dani who Alice swiped on and Frank who doesn't want to see women
+	assert.Equal(t, []int{2, 3, 5, 4, 6}, ids(response))
+
+	bob := response.Results[0]
+	assert.Equal(t, 1, bob.Rank)
+	assert.InDelta(t, 222.4, bob.Features.DistanceKm, 0.1)
+	// distances are normalized from 0 so Eve who is 5 degrees away is 1 and Bob who is 2 degrees away is 0.4
+	assert.InDelta(t, 0.4, bob.Features.NormalizedDistance, 1e-9)
+	assert.InDelta(t, 0.6, bob.Contributions["distance"], 1e-9)
+	assert.Equal(t, 0.0, bob.Contributions["likes"])
+	assert.InDelta(t, 0.6, *bob.Score, 1e-9)
+	for filter, passed := range bob.Filters {
+		assert.True(t, passed, filter)
+	}
+
+	eve := response.Results[2]
+	assert.Equal(t, 3, eve.Rank)
+	assert.InDelta(t, 1.0, eve.Features.NormalizedDistance, 1e-9)
+	assert.InDelta(t, 0.0, *eve.Score, 1e-9)
+
+	dani := response.Results[3]
+	assert.Equal(t, 0, dani.Rank)
+	assert.Nil(t, dani.Features)
+	assert.Nil(t, dani.Score)
+	assert.False(t, dani.Filters["not_swiped"])
+	assert.True(t, dani.Filters["their_genders"])
+
+	frank := response.Results[4]
+	assert.True(t, frank.Filters["not_swiped"])
+	assert.False(t, frank.Filters["their_genders"])
+
+	// filters from the query are explained too
+	_, response = explain(1, "/discover?explain=true&gender=male")
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, ids(response))
+	assert.False(t, response.Results[3].Filters["gender"])
+
+	// admins can explain another user's results, Bob swiped on Dani and Eve
+	code, response = explain(1, "/discover?explain=true&user_id=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, response.UserID)
+	assert.Equal(t, []int{3, 1, 6, 4, 5}, ids(response))
+
+	code, _ = explain(1, "/discover?explain=true&user_id=bob")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = explain(1, "/discover?explain=true&user_id=99")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// explanations are paged like the results
+	code, response = explain(1, "/discover?explain=true&limit=3")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{2, 3, 5}, ids(response))
+	if !assert.NotNil(t, response.NextCursor) {
+		t.FailNow()
+	}
+	code, response = explain(1, "/discover?explain=true&limit=3&cursor="+*response.NextCursor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{4, 6}, ids(response))
+	assert.Nil(t, response.NextCursor)
+
+	// a cursor from the normal results can't be used to page explanations
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	req, err := http.NewRequestWithContext(ctx, "GET", "/discover?limit=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var first DiscoverResponse
+	if err := json.NewDecoder(rr.Body).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	code, _ = explain(1, "/discover?explain=true&cursor="+*first.NextCursor)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = explain(2, "/discover?explain=true")
+	assert.Equal(t, http.StatusForbidden, code)
+}
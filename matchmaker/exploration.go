@@ -0,0 +1,114 @@
+package matchmaker
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// ExplorationPolicy gives a fixed share of discover's slots to profiles which haven't been shown much, so new users
+// get seen and can start collecting likes instead of sinking below everyone who already has them
+type ExplorationPolicy struct {
+	// share of the slots given to low exposure profiles, e.g. 0.1 is one in every ten, 0 turns exploration off
+	Share float64
+	// profiles shown fewer times than this are low exposure
+	MaxImpressions int
+}
+
+// DefaultExplorationPolicy gives one in every ten slots to profiles which have been shown fewer than 50 times
+var DefaultExplorationPolicy = ExplorationPolicy{Share: 0.1, MaxImpressions: 50}
+
+// Validate checks the share is between 0 and 1 and the impressions aren't negative
+func (p ExplorationPolicy) Validate() error {
+	if p.Share < 0 || p.Share > 1 || math.IsNaN(p.Share) {
+		return errors.New("share must be between 0 and 1")
+	}
+	if p.MaxImpressions < 0 {
+		return errors.New("max impressions can't be negative")
+	}
+	return nil
+}
+
+// explore moves low exposure profiles into the exploration slots, the ranking is otherwise left alone. The slots are
+// spread evenly e.g. a share of 0.25 makes every 4th slot an exploration slot, and low exposure profiles fill them in
+// the order they were ranked. Once there are no low exposure profiles left the rest of the slots follow the ranking.
+// The profiles given to it aren't changed, ones whose slot changes are copied.
+func (p ExplorationPolicy) explore(ranked []*profile) []*profile {
+	if p.Share == 0 || p.MaxImpressions == 0 {
+		return ranked
+	}
+
+	lowExposure := []*profile{}
+	for _, profile := range ranked {
+		if profile.impressions < p.MaxImpressions {
+			lowExposure = append(lowExposure, profile)
+		}
+	}
+
+	explored := make([]*profile, 0, len(ranked))
+	placed := make(map[int]bool, len(ranked))
+	next, nextLowExposure := 0, 0
+
+	for len(explored) < len(ranked) {
+		slot := float64(len(explored))
+		// the slot is for exploration when it takes the share of slots up to the next whole number
+		exploring := math.Floor((slot+1)*p.Share) > math.Floor(slot*p.Share)
+
+		for nextLowExposure < len(lowExposure) && placed[lowExposure[nextLowExposure].ID] {
+			nextLowExposure++
+		}
+		for next < len(ranked) && placed[ranked[next].ID] {
+			next++
+		}
+
+		var chosen *profile
+		isExplored := exploring && nextLowExposure < len(lowExposure)
+		if isExplored {
+			chosen = lowExposure[nextLowExposure]
+		} else {
+			// low exposure profiles are also in ranked so it can't run out before every slot is filled
+			chosen = ranked[next]
+		}
+		placed[chosen.ID] = true
+
+		// copied rather than changed as a queue shares its profiles with the requests using its last ranking
+		if chosen.explored != isExplored {
+			copied := *chosen
+			copied.explored = isExplored
+			chosen = &copied
+		}
+		explored = append(explored, chosen)
+	}
+	return explored
+}
+
+// recordImpressions stores that the profiles were shown to the viewer. A profile is only counted once per viewer for
+// each snapshot so refreshing or retrying the same page doesn't use up a profile's exploration
+func recordImpressions(db *sql.DB, viewerID int, s snapshot, profiles []*profile, now time.Time) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// impressions since the snapshot was taken were shown from it
+	insert, err := tx.Prepare(`INSERT INTO impressions (viewer_id, profile_id, shown_at)
+	SELECT ?, ?, ?
+	WHERE NOT EXISTS (SELECT 1 FROM impressions WHERE profile_id = ? AND id > ? AND viewer_id = ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, p := range profiles {
+		if _, err := insert.Exec(viewerID, p.ID, now.Unix(), p.ID, s.MaxImpressionID, viewerID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,127 @@
+package matchmaker
+
+import (
+	"context"
+	"encoding/json"
+	"muzz/auth"
+	"muzz/middleware"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplorationPolicyValidate(t *testing.T) {
+	assert.NoError(t, DefaultExplorationPolicy.Validate())
+	assert.NoError(t, ExplorationPolicy{}.Validate())
+	assert.Error(t, ExplorationPolicy{Share: -0.1, MaxImpressions: 10}.Validate())
+	assert.Error(t, ExplorationPolicy{Share: 1.5, MaxImpressions: 10}.Validate())
+	assert.Error(t, ExplorationPolicy{Share: 0.1, MaxImpressions: -1}.Validate())
+}
+
+func TestExplorationPolicyExplore(t *testing.T) {
+	// ranked best first, 5 and 6 are new
+	ranked := func() []*profile {
+		return []*profile{{ID: 1, impressions: 90}, {ID: 2, impressions: 80}, {ID: 3, impressions: 70}, {ID: 4, impressions: 60}, {ID: 5}, {ID: 6, impressions: 5}}
+	}
+
+	tests := []struct {
+		name     string
+		policy   ExplorationPolicy
+		expected []int
+	}{
+		{"off", ExplorationPolicy{}, []int{1, 2, 3, 4, 5, 6}},
+		{"every other slot", ExplorationPolicy{Share: 0.5, MaxImpressions: 10}, []int{1, 5, 2, 6, 3, 4}},
+		{"every third slot", ExplorationPolicy{Share: 1.0 / 3, MaxImpressions: 10}, []int{1, 2, 5, 3, 4, 6}},
+		{"every slot", ExplorationPolicy{Share: 1, MaxImpressions: 10}, []int{5, 6, 1, 2, 3, 4}},
+		{"higher threshold", ExplorationPolicy{Share: 0.5, MaxImpressions: 65}, []int{1, 4, 2, 5, 3, 6}},
+		{"only profiles never shown", ExplorationPolicy{Share: 0.5, MaxImpressions: 1}, []int{1, 5, 2, 3, 4, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []int{}
+			for _, p := range tt.policy.explore(ranked()) {
+				ids = append(ids, p.ID)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+}
+
+func TestDiscoverHandlerExploration(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+
+	// everyone but Frank has been shown plenty of times, Frank is the furthest away so he'd be ranked last
+	if _, err := db.Exec(`
+	UPDATE users SET lat = id WHERE id != 1;
+	WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 20)
+	INSERT INTO impressions (viewer_id, profile_id, shown_at) SELECT 4, u.id, 0 FROM users u, n WHERE u.id != 6;
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	handler := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Scorer: WeightedScorer{DistanceWeight: 1}, Exploration: ExplorationPolicy{Share: 0.5, MaxImpressions: 10}})
+
+	discover := func(target string) DiscoverResponse {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response DiscoverResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	ids := func(response DiscoverResponse) []int {
+		ids := []int{}
+		for _, p := range response.Results {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	shown := func(profileID int) int {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM impressions WHERE viewer_id = 1 AND profile_id = ?", profileID).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Frank gets the second slot
+	first := discover("/discover?limit=2")
+	assert.Equal(t, []int{2, 6}, ids(first))
+	assert.Equal(t, 1, shown(2))
+	assert.Equal(t, 1, shown(6))
+	assert.Equal(t, 0, shown(3))
+
+	// the impressions from the first page don't change the ranking of the next
+	second := discover("/discover?limit=2&cursor=" + *first.NextCursor)
+	assert.Equal(t, []int{3, 5}, ids(second))
+	assert.Equal(t, 1, shown(3))
+
+	// showing the same page again isn't another impression
+	discover("/discover?limit=2&cursor=" + *first.NextCursor)
+	assert.Equal(t, 1, shown(3))
+	assert.Equal(t, 1, shown(5))
+
+	// a new ranking is
+	discover("/discover?limit=2")
+	assert.Equal(t, 2, shown(2))
+}
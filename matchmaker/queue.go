@@ -0,0 +1,724 @@
+package matchmaker
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"muzz/user"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a user counts as active after their last discover request, only active users' queues are kept
+const queueActiveFor = 30 * time.Minute
+
+// queues older than this aren't used for a first page even when nothing has changed so ages stay correct
+const queueMaxAge = time.Hour
+
+// how many changes can be waiting to be applied before every queue is thrown away instead
+const queueEventBuffer = 1024
+
+// how many queues are brought up to date at once, the workers share the db with discover requests so only a few run
+const queueWorkers = 4
+
+type queueEventKind int
+
+const (
+	// someone swiped, the person they swiped on has different likes and rating now
+	eventSwiped queueEventKind = iota
+	// a user signed up, moved or changed their preferences
+	eventUserChanged
+	// the recommender stored a new build
+	eventRecommendationsRebuilt
+	// profiles were shown in discover, which changes who is explored
+	eventShown
+)
+
+type queueEvent struct {
+	kind   queueEventKind
+	userID int
+	// the person swiped on
+	targetID int
+	// the changed user's gender and location, looked up when the change is sent so the event loop never waits on the db
+	gender   string
+	location user.GeoLocation
+	// the changed user couldn't be looked up so any queue could be affected
+	unknown bool
+	// the profiles which were shown
+	profileIDs []int
+}
+
+// a queue waiting for a worker to bring it up to date
+type queueJob struct {
+	userID int
+	queue  *queue
+}
+
+// changes which could affect a queue since it was last brought up to date, a worker applies them in the background
+type queueChanges struct {
+	// someone swiped on one of the candidates
+	swiped bool
+	// users who signed up or changed and could have joined, left or moved in the ranking
+	users map[int]bool
+	// the recommender stored a new build
+	recommendations bool
+	// one of the candidates was shown to someone
+	impressions bool
+}
+
+func (c queueChanges) empty() bool {
+	return !c.changesRanking() && !c.impressions
+}
+
+// new impressions only change who is explored, so a queue waiting for them is still used until the next refresh rather
+// than ranking live after every page
+func (c queueChanges) changesRanking() bool {
+	return c.swiped || len(c.users) > 0 || c.recommendations
+}
+
+// a user's ranked candidates, the same ranking getPotentialMatches would make from the queue's snapshot
+type queue struct {
+	viewer  viewer
+	filters filters
+	// the experiment variant the user is in and the scorer it uses, the variant is empty outside every experiment
+	variant     string
+	scorer      Scorer
+	fingerprint string
+	// the state of the db the ranking is up to date with
+	snapshot snapshot
+	// the snapshot when the ranking last changed, the ranking is the same for every snapshot from it up to snapshot
+	rankedAt snapshot
+	// the candidates in score order before exploration, changes move candidates within it
+	scored []*profile
+	// scored with the exploration slots filled, what discover pages through
+	ranked []*profile
+	// the profiles in scored by id
+	candidates map[int]*profile
+	// the ranges the features in scored were normalized over
+	bounds featureBounds
+	// changes waiting to be applied in the background
+	pending queueChanges
+	// the ranking has to be made again from scratch, as it's too old or changes were lost
+	stale bool
+	// how many changes have arrived, a rebuild is thrown away if this changes while it runs
+	changes  int
+	builtAt  time.Time
+	lastUsed time.Time
+}
+
+// QueueManager keeps a ranked discover queue for each active user so most discover requests don't have to rank
+// every candidate. Changes are sent to it as they happen and applied to only the queues they could affect, in the
+// background by a few workers so slow db work never holds up the changes. A swipe re-scores the candidate who was
+// swiped on, a user who signs up or changes is added, removed or re-scored, a new recommendation build re-scores
+// the queue in memory and new impressions update who is explored. Queues are only ranked again from scratch when they
+// get too old or changes are dropped.
+// Discover falls back to ranking live when there is no up to date queue.
+type QueueManager struct {
+	db *sql.DB
+	// must be the same exploration policy discover uses, each queue keeps the scorer it was ranked with
+	exploration ExplorationPolicy
+
+	events chan queueEvent
+	jobs   chan queueJob
+
+	mu     sync.Mutex
+	queues map[int]*queue
+	// users whose queue is waiting for a worker or being worked on, so it isn't handed to a second worker
+	working map[int]bool
+	// goes up every time the user changes, a ranking started before the change is thrown away rather than stored
+	generations map[int]int
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates the queue manager, Run has to be called for changes to be applied
+func NewQueueManager(db *sql.DB, exploration ExplorationPolicy) *QueueManager {
+	return &QueueManager{
+		db:          db,
+		exploration: exploration,
+		events:      make(chan queueEvent, queueEventBuffer),
+		jobs:        make(chan queueJob, queueWorkers),
+		queues:      map[int]*queue{},
+		working:     map[int]bool{},
+		generations: map[int]int{},
+	}
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (m *QueueManager) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock()
+}
+
+// Swiped is called after a swipe is stored
+func (m *QueueManager) Swiped(swiper int, swipeTarget int, liked bool) {
+	m.notify(queueEvent{kind: eventSwiped, userID: swiper, targetID: swipeTarget})
+}
+
+// UserChanged is called after a user signs up or changes anything which affects who they match with, such as their
+// location, gender, dob or preferences
+func (m *QueueManager) UserChanged(userID int) {
+	// their own queue is dropped straight away so their next request doesn't use their old location, along with any
+	// ranking of theirs which is still being made
+	m.mu.Lock()
+	delete(m.queues, userID)
+	m.generations[userID]++
+	m.mu.Unlock()
+
+	event := queueEvent{kind: eventUserChanged, userID: userID}
+	var gender sql.NullString
+	var lat, lng sql.NullFloat64
+	err := m.db.QueryRow("SELECT gender, lat, lng FROM users WHERE id = ?", userID).Scan(&gender, &lat, &lng)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("failed to look up changed user for the discover queues", slog.Int("user_id", userID), slog.Any("error", err))
+		event.unknown = true
+	}
+	event.gender, event.location = gender.String, user.GeoLocation{Lat: lat.Float64, Long: lng.Float64}
+
+	m.notify(event)
+}
+
+// RecommendationsRebuilt is called after the recommender stores a new build
+func (m *QueueManager) RecommendationsRebuilt() {
+	m.notify(queueEvent{kind: eventRecommendationsRebuilt})
+}
+
+// Shown is called after profiles are shown in discover and their impressions are stored
+func (m *QueueManager) Shown(profileIDs []int) {
+	m.notify(queueEvent{kind: eventShown, profileIDs: profileIDs})
+}
+
+// queues the change without blocking the request, if too many are waiting every queue is ranked again from scratch as
+// there is no way of knowing which ones the dropped change affected
+func (m *QueueManager) notify(event queueEvent) {
+	select {
+	case m.events <- event:
+	default:
+		slog.Warn("discover queue events are backed up, ranking every queue again")
+		m.mu.Lock()
+		for _, q := range m.queues {
+			q.markStale()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Run records changes as they arrive and every refreshEvery hands the queues of active users which have changes
+// waiting, or are stale, to the workers and forgets about inactive users, until the context is cancelled
+func (m *QueueManager) Run(ctx context.Context, refreshEvery time.Duration) {
+	for i := 0; i < queueWorkers; i++ {
+		go m.worker(ctx)
+	}
+
+	ticker := time.NewTicker(refreshEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-m.events:
+			m.apply(event)
+		case <-ticker.C:
+			m.refresh()
+		}
+	}
+}
+
+// records the change against the queues it could affect, the workers apply it
+func (m *QueueManager) apply(event queueEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch event.kind {
+	case eventSwiped:
+		// the swiper's own queue is fine for now as discover leaves out anyone they've swiped on since it was made
+		for userID, q := range m.queues {
+			if userID != event.userID && q.candidates[event.targetID] != nil {
+				q.pending.swiped = true
+				q.changes++
+			}
+		}
+
+	case eventUserChanged:
+		for _, q := range m.queues {
+			if event.unknown || q.candidates[event.userID] != nil || q.mightInclude(event.gender, event.location) {
+				if q.pending.users == nil {
+					q.pending.users = map[int]bool{}
+				}
+				q.pending.users[event.userID] = true
+				q.changes++
+			}
+		}
+
+	case eventRecommendationsRebuilt:
+		for _, q := range m.queues {
+			q.pending.recommendations = true
+			q.changes++
+		}
+
+	case eventShown:
+		for _, q := range m.queues {
+			for _, id := range event.profileIDs {
+				if q.candidates[id] != nil {
+					q.pending.impressions = true
+					q.changes++
+					break
+				}
+			}
+		}
+	}
+}
+
+func (q *queue) markStale() {
+	q.stale = true
+	q.changes++
+}
+
+// a quick check of whether someone could be in the queue, it is fine to say yes when they couldn't
+func (q *queue) mightInclude(gender string, location user.GeoLocation) bool {
+	if len(q.filters.genders) > 0 && !slices.Contains(q.filters.genders, gender) {
+		return false
+	}
+	if q.filters.maxDistanceKm != 0 && haversineDistance(location.Lat, location.Long, q.viewer.location.Lat, q.viewer.location.Long) > q.filters.maxDistanceKm {
+		return false
+	}
+	return true
+}
+
+// needs ranking again from scratch rather than having its changes applied
+func (q *queue) needsRebuild(now time.Time) bool {
+	return q.stale || now.Sub(q.builtAt) > queueMaxAge
+}
+
+// hands the queues of active users which have changes waiting or need ranking again to the workers and forgets about
+// inactive users. It never waits for the workers, queues which don't fit while they are busy are handed over at a
+// later refresh.
+func (m *QueueManager) refresh() {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	workersBusy := false
+	for userID, q := range m.queues {
+		if now.Sub(q.lastUsed) > queueActiveFor {
+			delete(m.queues, userID)
+			continue
+		}
+		if workersBusy || m.working[userID] || (q.pending.empty() && !q.needsRebuild(now)) {
+			continue
+		}
+
+		select {
+		case m.jobs <- queueJob{userID: userID, queue: q}:
+			m.working[userID] = true
+		default:
+			workersBusy = true
+		}
+	}
+}
+
+// brings the queues handed to it up to date until the context is cancelled
+func (m *QueueManager) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-m.jobs:
+			m.runJob(job)
+		}
+	}
+}
+
+func (m *QueueManager) runJob(job queueJob) {
+	m.mu.Lock()
+	rebuild := job.queue.needsRebuild(m.now())
+	m.mu.Unlock()
+
+	if rebuild {
+		if err := m.rebuild(job.userID, job.queue); err != nil {
+			slog.Error("failed to rebuild discover queue", slog.Int("user_id", job.userID), slog.Any("error", err))
+		}
+	} else if err := m.update(job.userID, job.queue); err != nil {
+		slog.Error("failed to update discover queue, it will be rebuilt", slog.Int("user_id", job.userID), slog.Any("error", err))
+		// the changes were taken off the queue so the only way to get them back is to rank it again
+		m.mu.Lock()
+		job.queue.markStale()
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	delete(m.working, job.userID)
+	m.mu.Unlock()
+}
+
+// ranks the user's candidates again from a new snapshot
+func (m *QueueManager) rebuild(userID int, old *queue) error {
+	m.mu.Lock()
+	f, variant, scorer, changes := old.filters, old.variant, old.scorer, old.changes
+	m.mu.Unlock()
+
+	s, err := takeSnapshot(m.db, m.now())
+	if err != nil {
+		return err
+	}
+	v, err := getViewer(m.db, userID, s.now())
+	if err != nil {
+		return err
+	}
+	ranked, err := getPotentialMatches(m.db, v, s, f, scorer, m.exploration)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// it was replaced, removed or changed again while rebuilding, the ranking might be missing the latest change
+	if m.queues[userID] != old || old.changes != changes {
+		return nil
+	}
+	q := newQueue(v, f, variant, scorer, s, ranked, m.now())
+	q.lastUsed = old.lastUsed
+	m.queues[userID] = q
+	return nil
+}
+
+// a swipe read back from the db
+type queuedSwipe struct {
+	id     int
+	swiper int
+	target int
+	liked  bool
+	rating sql.NullFloat64
+}
+
+// applies the changes waiting for the queue without ranking every candidate again. Everything is read in one
+// transaction so the queue ends up with the ranking discover would make live from the new snapshot.
+func (m *QueueManager) update(userID int, q *queue) error {
+	m.mu.Lock()
+	if m.queues[userID] != q {
+		m.mu.Unlock()
+		return nil
+	}
+	changes := q.pending
+	q.pending = queueChanges{}
+	v, f, old := q.viewer, q.filters, q.snapshot
+	m.mu.Unlock()
+
+	// only read from, the transaction keeps every query on the same state of the db
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s := old
+	var latestBuild int
+	err = tx.QueryRow(`SELECT COALESCE((SELECT MAX(id) FROM swipes), 0), COALESCE((SELECT MAX(build) FROM recommendation_builds), 0),
+		COALESCE((SELECT MAX(id) FROM impressions), 0)`).
+		Scan(&s.MaxSwipeID, &latestBuild, &s.MaxImpressionID)
+	if err != nil {
+		return err
+	}
+
+	// the impressions are always brought up to date so exploration doesn't keep showing people who have been seen enough
+	impressions, err := impressionsBetween(tx, old.MaxImpressionID, s.MaxImpressionID)
+	if err != nil {
+		return err
+	}
+
+	// every swipe since the queue's snapshot is read, not just the ones there were events for, so the queue can move
+	// on to the new snapshot without missing a swipe whose event hasn't arrived yet
+	swipes, err := swipesBetween(tx, old.MaxSwipeID, s.MaxSwipeID)
+	if err != nil {
+		return err
+	}
+
+	// users who changed are loaded again, along with anyone who signed up since the queue's snapshot
+	var loaded []*profile
+	if len(changes.users) > 0 {
+		ids := make([]interface{}, 0, len(changes.users)+1)
+		for id := range changes.users {
+			ids = append(ids, id)
+			s.MaxUserID = max(s.MaxUserID, id)
+		}
+		ids = append(ids, old.MaxUserID)
+		condition := "(u.id IN (?" + strings.Repeat(", ?", len(changes.users)-1) + ") OR u.id > ?)"
+		if loaded, err = queryCandidates(tx, v, s, f, condition, ids...); err != nil {
+			return err
+		}
+	}
+	reloaded := func(id int) bool {
+		return changes.users[id] || id > old.MaxUserID
+	}
+
+	var recommendations map[int]float64
+	if changes.recommendations && latestBuild != old.RecommendationBuild {
+		s.RecommendationBuild = latestBuild
+		if recommendations, err = recommendationsFor(tx, v.id, latestBuild); err != nil {
+			return err
+		}
+		// loaded before the build was known
+		for _, p := range loaded {
+			p.recommendation = recommendations[p.ID]
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// it was replaced or will be ranked again from scratch anyway
+	if m.queues[userID] != q || q.stale {
+		return nil
+	}
+
+	changed := map[int]*profile{}
+	removed := map[int]bool{}
+	edit := func(id int) *profile {
+		if p, ok := changed[id]; ok {
+			return p
+		}
+		copied := *q.candidates[id]
+		changed[id] = &copied
+		return &copied
+	}
+
+	for _, swipe := range swipes {
+		// anyone the viewer swiped on is left out, the same as discover does
+		if swipe.swiper == v.id {
+			removed[swipe.target] = true
+			continue
+		}
+		// users loaded again already include the swipe
+		if q.candidates[swipe.target] == nil || reloaded(swipe.target) {
+			continue
+		}
+		p := edit(swipe.target)
+		if swipe.liked {
+			p.totalLikes++
+		}
+		if swipe.rating.Valid {
+			p.rating = swipe.rating.Float64
+		}
+	}
+
+	for id, count := range impressions {
+		if q.candidates[id] != nil && !reloaded(id) {
+			edit(id).impressions += count
+		}
+	}
+
+	for id := range changes.users {
+		if q.candidates[id] != nil {
+			removed[id] = true
+		}
+	}
+	for _, p := range loaded {
+		delete(removed, p.ID)
+		changed[p.ID] = p
+	}
+
+	if recommendations != nil {
+		for id := range q.candidates {
+			if !removed[id] {
+				edit(id).recommendation = recommendations[id]
+			}
+		}
+	}
+
+	q.update(changed, removed, s, m.exploration)
+	return nil
+}
+
+// the swipes after one swipe up to and including another, in the order they were made
+func swipesBetween(db queryer, afterID int, upToID int) ([]queuedSwipe, error) {
+	rows, err := db.Query("SELECT id, swiper, swipe_target, liked, target_rating FROM swipes WHERE id > ? AND id <= ? ORDER BY id", afterID, upToID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	swipes := []queuedSwipe{}
+	for rows.Next() {
+		var swipe queuedSwipe
+		if err := rows.Scan(&swipe.id, &swipe.swiper, &swipe.target, &swipe.liked, &swipe.rating); err != nil {
+			return nil, err
+		}
+		swipes = append(swipes, swipe)
+	}
+	return swipes, rows.Err()
+}
+
+// how many times each profile was shown after one impression up to and including another
+func impressionsBetween(db queryer, afterID int, upToID int) (map[int]int, error) {
+	rows, err := db.Query("SELECT profile_id, COUNT(*) FROM impressions WHERE id > ? AND id <= ? GROUP BY profile_id", afterID, upToID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impressions := map[int]int{}
+	for rows.Next() {
+		var profileID, count int
+		if err := rows.Scan(&profileID, &count); err != nil {
+			return nil, err
+		}
+		impressions[profileID] = count
+	}
+	return impressions, rows.Err()
+}
+
+// the recommendations for the user in the build by candidate
+func recommendationsFor(db queryer, userID int, build int) (map[int]float64, error) {
+	rows, err := db.Query("SELECT candidate_id, score FROM recommendations WHERE build = ? AND user_id = ?", build, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recommendations := map[int]float64{}
+	for rows.Next() {
+		var candidateID int
+		var score float64
+		if err := rows.Scan(&candidateID, &score); err != nil {
+			return nil, err
+		}
+		recommendations[candidateID] = score
+	}
+	return recommendations, rows.Err()
+}
+
+// update swaps in the changed candidates and drops the removed ones, then moves the queue on to the snapshot. Only the
+// changed candidates are scored and merged back into place, unless they moved the ranges the features are normalized
+// over and everyone has to be scored again. Profiles are never changed in place as requests can still be paging
+// through the old ranking.
+func (q *queue) update(changed map[int]*profile, removed map[int]bool, s snapshot, exploration ExplorationPolicy) {
+	q.snapshot = s
+	if len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+
+	kept := make([]*profile, 0, len(q.scored))
+	for _, p := range q.scored {
+		if changed[p.ID] == nil && !removed[p.ID] {
+			kept = append(kept, p)
+		}
+	}
+	rescored := make([]*profile, 0, len(changed))
+	for _, p := range changed {
+		rescored = append(rescored, p)
+	}
+
+	bounds := boundsOf(kept)
+	for _, p := range rescored {
+		bounds.include(p)
+	}
+	if bounds != q.bounds {
+		for _, p := range kept {
+			copied := *p
+			rescored = append(rescored, &copied)
+		}
+		kept = nil
+	}
+
+	for _, p := range rescored {
+		bounds.score(p, q.scorer)
+	}
+	sortByScore(rescored)
+
+	q.scored = mergeByScore(kept, rescored)
+	q.ranked = exploration.explore(q.scored)
+	q.bounds = bounds
+	q.rankedAt = s
+
+	q.candidates = make(map[int]*profile, len(q.scored))
+	for _, p := range q.scored {
+		q.candidates[p.ID] = p
+	}
+}
+
+// merges two rankings which are each in score order
+func mergeByScore(a []*profile, b []*profile) []*profile {
+	merged := make([]*profile, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if rankedBefore(b[0], a[0]) {
+			merged = append(merged, b[0])
+			b = b[1:]
+		} else {
+			merged = append(merged, a[0])
+			a = a[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// ranked is a ranking made from the snapshot, as returned by getPotentialMatches
+func newQueue(v viewer, f filters, variant string, scorer Scorer, s snapshot, ranked []*profile, now time.Time) *queue {
+	// exploration is undone so changed candidates can be moved within the plain ranking
+	scored := slices.Clone(ranked)
+	sortByScore(scored)
+
+	candidates := make(map[int]*profile, len(scored))
+	for _, p := range scored {
+		candidates[p.ID] = p
+	}
+	return &queue{viewer: v, filters: f, variant: variant, scorer: scorer, fingerprint: fingerprint(v.id, f, variant), snapshot: s, rankedAt: s, scored: scored, ranked: ranked, candidates: candidates, bounds: boundsOf(scored), builtAt: now, lastUsed: now}
+}
+
+// reports whether the queue's ranking is the one discover would make from the snapshot, which is true of every
+// snapshot since the ranking last changed
+func (q *queue) rankedFrom(s snapshot) bool {
+	return s.Time == q.snapshot.Time && s.RecommendationBuild == q.snapshot.RecommendationBuild &&
+		s.MaxUserID >= q.rankedAt.MaxUserID && s.MaxUserID <= q.snapshot.MaxUserID &&
+		s.MaxSwipeID >= q.rankedAt.MaxSwipeID && s.MaxSwipeID <= q.snapshot.MaxSwipeID &&
+		s.MaxImpressionID >= q.rankedAt.MaxImpressionID && s.MaxImpressionID <= q.snapshot.MaxImpressionID
+}
+
+// get returns the user's ranking for the filters. For a first page s is nil and only an up to date queue is used,
+// later pages can use any queue whose ranking is the one made from their snapshot.
+// The profiles are shared so they mustn't be changed.
+func (m *QueueManager) get(userID int, fingerprint string, s *snapshot) ([]*profile, snapshot, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[userID]
+	if !ok || q.fingerprint != fingerprint {
+		return nil, snapshot{}, false
+	}
+	if s == nil {
+		if q.pending.changesRanking() || q.needsRebuild(m.now()) {
+			return nil, snapshot{}, false
+		}
+		q.lastUsed = m.now()
+		return q.ranked, q.snapshot, true
+	}
+	if !q.rankedFrom(*s) {
+		return nil, snapshot{}, false
+	}
+
+	q.lastUsed = m.now()
+	return q.ranked, *s, true
+}
+
+// the user's generation, taken before their ranking is made and given back to put
+func (m *QueueManager) generation(userID int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generations[userID]
+}
+
+// put stores a ranking discover made live so the user's next requests can use it. It is thrown away when the user
+// changed after generation was taken, as it could be from their old location or preferences.
+func (m *QueueManager) put(generation int, v viewer, f filters, variant string, scorer Scorer, s snapshot, ranked []*profile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.generations[v.id] != generation {
+		return
+	}
+	m.queues[v.id] = newQueue(v, f, variant, scorer, s, ranked, m.now())
+}
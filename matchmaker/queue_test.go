@@ -0,0 +1,382 @@
+package matchmaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"muzz/auth"
+	"muzz/middleware"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// applies the changes waiting to be applied, as Run would
+func applyQueueEvents(queues *QueueManager) {
+	for {
+		select {
+		case event := <-queues.events:
+			queues.apply(event)
+		default:
+			return
+		}
+	}
+}
+
+// brings the queues handed to the workers up to date, as the workers started by Run would
+func runQueueJobs(queues *QueueManager) {
+	for {
+		select {
+		case job := <-queues.jobs:
+			queues.runJob(job)
+		default:
+			return
+		}
+	}
+}
+
+func TestQueueManagerApply(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	// Alice only wants to see men, Bob and Eve want to see everyone
+	queues.put(0, viewer{id: 1}, filters{genders: []string{"male"}}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}, {ID: 3}})
+	queues.put(0, viewer{id: 2}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 1}, {ID: 3}})
+	queues.put(0, viewer{id: 5}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 1}})
+
+	pending := func() []int {
+		ids := []int{}
+		for userID, q := range queues.queues {
+			assert.False(t, q.stale, "changes shouldn't rank a queue again from scratch")
+			if !q.pending.empty() {
+				ids = append(ids, userID)
+			}
+		}
+		return ids
+	}
+
+	// Bob swiping on Charlie changes Charlie's likes for Alice but Bob's own queue is fine
+	queues.Swiped(2, 3, true)
+	applyQueueEvents(queues)
+	assert.ElementsMatch(t, []int{1}, pending())
+	assert.True(t, queues.queues[1].pending.swiped)
+
+	// Eve wants to see everyone so Dani might appear for her, Alice only wants to see men
+	queues.UserChanged(4)
+	applyQueueEvents(queues)
+	assert.ElementsMatch(t, []int{1, 2, 5}, pending())
+	assert.Equal(t, map[int]bool{4: true}, queues.queues[5].pending.users)
+	assert.Empty(t, queues.queues[1].pending.users)
+
+	// Bob's own queue is dropped as soon as he changes
+	queues.UserChanged(2)
+	_, ok := queues.queues[2]
+	assert.False(t, ok)
+
+	queues.RecommendationsRebuilt()
+	applyQueueEvents(queues)
+	assert.ElementsMatch(t, []int{1, 5}, pending())
+	assert.True(t, queues.queues[1].pending.recommendations)
+}
+
+func TestQueueManagerRefresh(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	queues.put(0, viewer{id: 1}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}})
+	queues.put(0, viewer{id: 2}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 1}})
+	queues.queues[1].stale = true
+
+	// Bob hasn't asked for matches for a while so his queue is dropped rather than rebuilt
+	now = now.Add(queueActiveFor / 2)
+	queues.get(1, fingerprint(1, filters{}, ""), &snapshot{})
+	now = now.Add(queueActiveFor)
+	queues.refresh()
+
+	_, ok := queues.queues[2]
+	assert.False(t, ok)
+
+	// the rebuild is left to the workers
+	assert.True(t, queues.queues[1].stale)
+	assert.True(t, queues.working[1])
+	runQueueJobs(queues)
+
+	q := queues.queues[1]
+	assert.False(t, q.stale)
+	assert.Equal(t, now, q.builtAt)
+	assert.Empty(t, queues.working)
+	ranked := []int{}
+	for _, p := range q.ranked {
+		ranked = append(ranked, p.ID)
+	}
+	assert.ElementsMatch(t, []int{2, 3, 5, 6}, ranked)
+}
+
+func TestQueueManagerRefreshDoesNotWaitForWorkers(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	// more stale queues than the workers can be handed at once
+	for userID := 1; userID <= queueWorkers+2; userID++ {
+		queues.put(0, viewer{id: userID}, filters{}, "", DefaultScorer, snapshot{}, []*profile{})
+		queues.queues[userID].markStale()
+	}
+
+	queues.refresh()
+	assert.Len(t, queues.jobs, queueWorkers)
+	assert.Len(t, queues.working, queueWorkers)
+
+	// the rest are handed over once the workers have caught up
+	runQueueJobs(queues)
+	queues.refresh()
+	assert.Len(t, queues.working, 2)
+	runQueueJobs(queues)
+
+	for userID, q := range queues.queues {
+		assert.False(t, q.stale, "user %d", userID)
+	}
+}
+
+func TestQueueManagerUpdate(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	scorer := WeightedScorer{DistanceWeight: 0.4, LikesWeight: 0.3, RatingWeight: 0.1, RecommendationWeight: 0.2}
+	exploration := ExplorationPolicy{Share: 0.25, MaxImpressions: 2}
+	queues := NewQueueManager(db, exploration)
+	queues.clock = func() time.Time { return now }
+
+	// spread out so distance counts, and Bob and Charlie have been shown enough not to be explored
+	if _, err := db.Exec(`
+	UPDATE users SET lat = id * 0.1;
+	INSERT INTO impressions (viewer_id, profile_id, shown_at) VALUES (4, 2, 0), (4, 2, 0), (4, 3, 0), (4, 3, 0);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := takeSnapshot(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := getViewer(db, 1, s.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranked, err := getPotentialMatches(db, v, s, filters{}, scorer, exploration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues.put(0, v, filters{}, "", scorer, s, ranked)
+	builtAt := queues.queues[1].builtAt
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update := func() {
+		t.Helper()
+		now = now.Add(time.Minute)
+		applyQueueEvents(queues)
+		queues.refresh()
+		runQueueJobs(queues)
+
+		q := queues.queues[1]
+		assert.Equal(t, builtAt, q.builtAt, "the queue shouldn't be ranked again from scratch")
+		assert.True(t, q.pending.empty())
+
+		// the same ranking discover would make live from the queue's new snapshot
+		expected, err := getPotentialMatches(db, v, q.snapshot, filters{}, scorer, exploration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, q.ranked, len(expected)) {
+			for i, p := range expected {
+				assert.Equal(t, p.ID, q.ranked[i].ID, "slot %d", i)
+				assert.InDelta(t, p.attractivenessScore, q.ranked[i].attractivenessScore, 1e-9, "slot %d", i)
+				assert.Equal(t, p.explored, q.ranked[i].explored, "slot %d", i)
+			}
+		}
+	}
+
+	// Frank likes and rates Charlie, only Charlie is re-scored. Alice's own swipe on Eve is picked up with it.
+	exec("INSERT INTO swipes (swiper, swipe_target, liked, target_rating) VALUES (6, 3, TRUE, 1300)")
+	queues.Swiped(6, 3, true)
+	exec("INSERT INTO swipes (swiper, swipe_target, liked) VALUES (1, 5, FALSE)")
+	queues.Swiped(1, 5, false)
+	update()
+	assert.NotContains(t, queues.queues[1].candidates, 5)
+
+	// cursors from before the change are ranked live as the queue's order has moved on
+	assert.False(t, queues.queues[1].rankedFrom(s))
+	assert.True(t, queues.queues[1].rankedFrom(queues.queues[1].snapshot))
+
+	// Gus signs up close by, Bob only wants to see men now and Frank moves away
+	exec("INSERT INTO users (name, gender, dob, lat, lng) VALUES ('Gus', 'male', '1990-01-01', 0.05, 0)")
+	queues.UserChanged(7)
+	exec(`INSERT INTO preferences (user_id, genders) VALUES (2, '["male"]')`)
+	queues.UserChanged(2)
+	exec("UPDATE users SET lat = 5 WHERE id = 6")
+	queues.UserChanged(6)
+	update()
+	assert.Contains(t, queues.queues[1].candidates, 7)
+	assert.NotContains(t, queues.queues[1].candidates, 2)
+
+	// a new recommendation build re-scores the queue in memory
+	if err := NewRecommender(db, DefaultRecommendationsPerUser, nil).Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	queues.RecommendationsRebuilt()
+	update()
+	assert.NotZero(t, queues.queues[1].snapshot.RecommendationBuild)
+
+	// Dani liking Gus gives him as many likes as Frank, no one else's score moves
+	exec("INSERT INTO swipes (swiper, swipe_target, liked) VALUES (4, 7, TRUE)")
+	queues.Swiped(4, 7, true)
+	bounds := queues.queues[1].bounds
+	update()
+	assert.Equal(t, bounds, queues.queues[1].bounds)
+
+	// once Gus has been shown enough he isn't explored any more
+	exec("INSERT INTO impressions (viewer_id, profile_id, shown_at) VALUES (4, 7, 0), (5, 7, 0)")
+	queues.Shown([]int{7})
+	update()
+	assert.Equal(t, 2, queues.queues[1].candidates[7].impressions)
+}
+
+func TestQueueManagerUserChangedLookup(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	queues.put(0, viewer{id: 1}, filters{genders: []string{"male"}}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}})
+	queues.put(0, viewer{id: 2}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 1}})
+
+	// Dani is looked up when the change is sent, applying it doesn't wait on the db
+	queues.UserChanged(4)
+	db.Close()
+	applyQueueEvents(queues)
+	assert.True(t, queues.queues[1].pending.empty())
+	assert.Equal(t, map[int]bool{4: true}, queues.queues[2].pending.users)
+
+	// when the lookup fails every queue could be affected
+	queues.UserChanged(3)
+	applyQueueEvents(queues)
+	assert.Equal(t, map[int]bool{3: true}, queues.queues[1].pending.users)
+}
+
+func TestQueueManagerPutAfterUserChanged(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+
+	// Alice moves while her ranking is being made from her old location
+	generation := queues.generation(1)
+	queues.UserChanged(1)
+	queues.put(generation, viewer{id: 1}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}})
+	assert.NotContains(t, queues.queues, 1)
+
+	// one made after the change is kept
+	queues.put(queues.generation(1), viewer{id: 1}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}})
+	assert.Contains(t, queues.queues, 1)
+}
+
+func TestQueueManagerDroppedEvents(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	queues.put(0, viewer{id: 1}, filters{}, "", DefaultScorer, snapshot{}, []*profile{{ID: 2}})
+
+	// once the buffer is full there is no telling which queues the next change affects
+	for range queueEventBuffer {
+		queues.RecommendationsRebuilt()
+	}
+	assert.False(t, queues.queues[1].stale)
+	queues.RecommendationsRebuilt()
+	assert.True(t, queues.queues[1].stale)
+}
+
+func TestDiscoverHandlerQueues(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	queues := NewQueueManager(db, ExplorationPolicy{})
+	queues.clock = func() time.Time { return now }
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	handler := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Queues: queues})
+	swipe := SwipeHandler(SwipeHandlerDeps{DB: db, Swiped: queues.Swiped})
+
+	discover := func(target string) DiscoverResponse {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response DiscoverResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	ids := func(response DiscoverResponse) []int {
+		ids := []int{}
+		for _, p := range response.Results {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	assert.ElementsMatch(t, []int{2, 3, 5, 6}, ids(discover("/discover")))
+	assert.Contains(t, queues.queues, 1)
+
+	// a user added without telling the queues isn't seen as the queue is used
+	if _, err := db.Exec("INSERT INTO users (name, gender, dob, lat, lng) VALUES ('Gus', 'male', '1990-01-01', 0, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []int{2, 3, 5, 6}, ids(discover("/discover")))
+
+	// Alice's own swipes are left out straight away
+	req, err := http.NewRequestWithContext(ctx, "POST", "/swipe", bytes.NewBufferString(`{"other_user_id": 2, "like": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	swipe.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	applyQueueEvents(queues)
+	assert.False(t, queues.queues[1].stale)
+	assert.ElementsMatch(t, []int{3, 5, 6}, ids(discover("/discover")))
+
+	// once the queues are told about Gus, Alice's queue falls back to ranking live until he is added to it
+	queues.UserChanged(7)
+	applyQueueEvents(queues)
+	assert.False(t, queues.queues[1].pending.empty())
+	assert.ElementsMatch(t, []int{3, 5, 6, 7}, ids(discover("/discover")))
+	assert.True(t, queues.queues[1].pending.empty())
+
+	// different filters don't use the queue
+	assert.ElementsMatch(t, []int{5}, ids(discover("/discover?gender=female")))
+}
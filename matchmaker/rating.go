@@ -0,0 +1,118 @@
+package matchmaker
+
+import (
+	"database/sql"
+	"math"
+)
+
+// DefaultRating is the desirability rating every user starts with
+const DefaultRating = 1500
+
+// how far a single swipe can move a rating
+const ratingK = 32
+
+// Each swipe is treated like an Elo game between the swiper and the person they swiped on, who wins if they were liked.
+// A like from someone rated higher than you is worth more than one from someone rated lower, and a pass from someone
+// rated lower costs more than one from someone rated higher.
+// Only the person swiped on is rated, the swiper's rating is about how desirable they are not how picky they are.
+func nextRating(targetRating float64, swiperRating float64, liked bool) float64 {
+	expected := 1 / (1 + math.Pow(10, (swiperRating-targetRating)/400))
+	var result float64
+	if liked {
+		result = 1
+	}
+	return targetRating + ratingK*(result-expected)
+}
+
+// updates the rating of the person swiped on, must be called in the same transaction the swipe is stored in
+func updateRatingInTransaction(tx *sql.Tx, swipeID int64, swiper int, swipeTarget int, liked bool) error {
+	var swiperRating, targetRating float64
+	err := tx.QueryRow("SELECT COALESCE((SELECT rating FROM users WHERE id = ?), ?), COALESCE((SELECT rating FROM users WHERE id = ?), ?)",
+		swiper, DefaultRating, swipeTarget, DefaultRating).Scan(&swiperRating, &targetRating)
+	if err != nil {
+		return err
+	}
+
+	rating := nextRating(targetRating, swiperRating, liked)
+	if _, err := tx.Exec("UPDATE users SET rating = ? WHERE id = ?", rating, swipeTarget); err != nil {
+		return err
+	}
+	// kept with the swipe so discover can rank using the ratings from when the first page was requested
+	_, err = tx.Exec("UPDATE swipes SET target_rating = ? WHERE id = ?", rating, swipeID)
+	return err
+}
+
+// RecomputeRatings replays every swipe in the order they happened to rebuild everyone's rating, e.g. after changing how
+// ratings are calculated
+func RecomputeRatings(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, swiper, swipe_target, liked FROM swipes ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	type swipe struct {
+		id          int
+		swipeTarget int
+		rating      float64
+	}
+
+	ratings := map[int]float64{}
+	rating := func(userID int) float64 {
+		if r, ok := ratings[userID]; ok {
+			return r
+		}
+		return DefaultRating
+	}
+
+	swipes := []swipe{}
+	for rows.Next() {
+		var s swipe
+		var swiper int
+		var liked bool
+		if err := rows.Scan(&s.id, &swiper, &s.swipeTarget, &liked); err != nil {
+			rows.Close()
+			return err
+		}
+		s.rating = nextRating(rating(s.swipeTarget), rating(swiper), liked)
+		ratings[s.swipeTarget] = s.rating
+		swipes = append(swipes, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET rating = ?", DefaultRating); err != nil {
+		return err
+	}
+
+	updateUser, err := tx.Prepare("UPDATE users SET rating = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer updateUser.Close()
+	for userID, r := range ratings {
+		if _, err := updateUser.Exec(r, userID); err != nil {
+			return err
+		}
+	}
+
+	updateSwipe, err := tx.Prepare("UPDATE swipes SET target_rating = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer updateSwipe.Close()
+	for _, s := range swipes {
+		if _, err := updateSwipe.Exec(s.rating, s.id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
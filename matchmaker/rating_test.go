@@ -0,0 +1,118 @@
+package matchmaker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"muzz/auth"
+	"muzz/middleware"
+	"muzz/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextRating(t *testing.T) {
+	// evenly rated users move by half of K
+	assert.InDelta(t, DefaultRating+16, nextRating(DefaultRating, DefaultRating, true), 1e-9)
+	assert.InDelta(t, DefaultRating-16, nextRating(DefaultRating, DefaultRating, false), 1e-9)
+
+	// a like from someone rated higher is worth more than one from someone rated lower
+	fromHigher := nextRating(DefaultRating, 1800, true)
+	fromLower := nextRating(DefaultRating, 1200, true)
+	assert.Greater(t, fromHigher, fromLower)
+
+	// a pass from someone rated lower costs more than one from someone rated higher
+	assert.Less(t, nextRating(DefaultRating, 1200, false), nextRating(DefaultRating, 1800, false))
+}
+
+func TestSwipeHandlerUpdatesRatings(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob) VALUES
+	('Alice', 'female', '1990-01-01'),
+	('Bob', 'male', '1990-01-01'),
+	('Charlie', 'male', '1990-01-01');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	swipe := func(userID int, body string) {
+		ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID})
+		req, err := http.NewRequestWithContext(ctx, "POST", "/swipe", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		SwipeHandler(SwipeHandlerDeps{DB: db}).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	ratings := func() map[int]float64 {
+		rows, err := db.Query("SELECT id, rating FROM users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		ratings := map[int]float64{}
+		for rows.Next() {
+			var id int
+			var rating float64
+			if err := rows.Scan(&id, &rating); err != nil {
+				t.Fatal(err)
+			}
+			ratings[id] = rating
+		}
+		return ratings
+	}
+
+	// Bob is liked by Alice, then he likes Charlie who is now rated lower than him, then Alice passes on Charlie
+	swipe(1, `{"other_user_id": 2, "like": true}`)
+	swipe(2, `{"other_user_id": 3, "like": true}`)
+	swipe(1, `{"other_user_id": 3, "like": false}`)
+
+	bob := nextRating(DefaultRating, DefaultRating, true)
+	charlie := nextRating(nextRating(DefaultRating, bob, true), DefaultRating, false)
+	expected := map[int]float64{1: DefaultRating, 2: bob, 3: charlie}
+	assert.Equal(t, expected, ratings())
+
+	var targetRating float64
+	if err := db.QueryRow("SELECT target_rating FROM swipes WHERE swiper = 2 AND swipe_target = 3").Scan(&targetRating); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextRating(DefaultRating, bob, true), targetRating)
+
+	t.Run("recomputing gives the same ratings", func(t *testing.T) {
+		if _, err := db.Exec("UPDATE users SET rating = 0; UPDATE swipes SET target_rating = NULL"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := RecomputeRatings(db); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, ratings())
+
+		var unrated int
+		if err := db.QueryRow("SELECT COUNT(*) FROM swipes WHERE target_rating IS NULL").Scan(&unrated); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, unrated)
+	})
+}
@@ -0,0 +1,205 @@
+package matchmaker
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultRecommendationsPerUser is how many recommendations are kept for each user
+const DefaultRecommendationsPerUser = 100
+
+// Recommender learns who each user might like from people with similar taste, people who liked X also liked Y.
+// It is a batch job, recommendations are rebuilt from the whole swipes table every time it runs.
+type Recommender struct {
+	db *sql.DB
+	// how many recommendations are kept for each user
+	perUser int
+	// optional, called after a new build is stored
+	onRebuild func()
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates a recommender which keeps the best perUser recommendations for each user, onRebuild can be nil
+func NewRecommender(db *sql.DB, perUser int, onRebuild func()) *Recommender {
+	return &Recommender{db: db, perUser: perUser, onRebuild: onRebuild}
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (r *Recommender) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+	return r.clock()
+}
+
+// Run rebuilds the recommendations straight away and then every interval until the context is cancelled
+// failures are logged and retried at the next interval
+func (r *Recommender) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		if err := r.Rebuild(ctx); err != nil {
+			slog.Error("failed to rebuild recommendations", slog.Any("error", err))
+		} else {
+			slog.Info("rebuilt recommendations", slog.Duration("took", time.Since(start)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// a recommended candidate and how strongly they are recommended
+type recommendation struct {
+	candidateID int
+	score       float64
+}
+
+// Rebuild works out everyone's recommendations from the likes in the swipes table and stores them as a new build.
+// Older builds are kept while discover cursors which use them can still be used, so the ranking doesn't change between
+// pages.
+func (r *Recommender) Rebuild(ctx context.Context) error {
+	// who each user has liked and who has liked each user
+	liked := map[int][]int{}
+	likedBy := map[int][]int{}
+	// everyone each user has swiped on, they aren't recommended again
+	swiped := map[int]map[int]bool{}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT swiper, swipe_target, liked FROM swipes")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var swiper, target int
+		var like bool
+		if err := rows.Scan(&swiper, &target, &like); err != nil {
+			rows.Close()
+			return err
+		}
+		if swiped[swiper] == nil {
+			swiped[swiper] = map[int]bool{}
+		}
+		swiped[swiper][target] = true
+		if like {
+			liked[swiper] = append(liked[swiper], target)
+			likedBy[target] = append(likedBy[target], swiper)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	recommendations := map[int][]recommendation{}
+	for userID, likes := range liked {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		recommendations[userID] = r.recommend(userID, likes, liked, likedBy, swiped[userID])
+	}
+
+	if err := r.store(ctx, recommendations); err != nil {
+		return err
+	}
+	if r.onRebuild != nil {
+		r.onRebuild()
+	}
+	return nil
+}
+
+// scores everyone liked by the people who liked the same people as the user. The score for a candidate Y is the sum of
+// the cosine similarity between Y and each X the user liked, where X and Y are similar when the same people liked both
+func (r *Recommender) recommend(userID int, likes []int, liked map[int][]int, likedBy map[int][]int, swiped map[int]bool) []recommendation {
+	scores := map[int]float64{}
+
+	for _, x := range likes {
+		// how many people liked both x and each y
+		coLikes := map[int]int{}
+		for _, liker := range likedBy[x] {
+			if liker == userID {
+				continue
+			}
+			for _, y := range liked[liker] {
+				coLikes[y]++
+			}
+		}
+
+		for y, count := range coLikes {
+			if y == userID || swiped[y] {
+				continue
+			}
+			scores[y] += float64(count) / math.Sqrt(float64(len(likedBy[x])*len(likedBy[y])))
+		}
+	}
+
+	best := make([]recommendation, 0, len(scores))
+	for candidateID, score := range scores {
+		best = append(best, recommendation{candidateID: candidateID, score: score})
+	}
+	sort.Slice(best, func(i, j int) bool {
+		if best[i].score != best[j].score {
+			return best[i].score > best[j].score
+		}
+		return best[i].candidateID < best[j].candidateID
+	})
+	if len(best) > r.perUser {
+		best = best[:r.perUser]
+	}
+	return best
+}
+
+// stores the recommendations as a new build and removes the builds which no usable cursor can refer to
+func (r *Recommender) store(ctx context.Context, recommendations map[int][]recommendation) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var build int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(build), 0) + 1 FROM recommendation_builds").Scan(&build); err != nil {
+		return err
+	}
+
+	insert, err := tx.Prepare("INSERT INTO recommendations (build, user_id, candidate_id, score) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for userID, recs := range recommendations {
+		for _, rec := range recs {
+			if _, err := insert.Exec(build, userID, rec.candidateID, rec.score); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := r.now()
+	if _, err := tx.Exec("INSERT INTO recommendation_builds (build, built_at) VALUES (?, ?)", build, now.Unix()); err != nil {
+		return err
+	}
+
+	// a cursor refers to the newest build when its first page was requested, so a build is needed until the cursors
+	// taken before the next build was stored have expired. Every build before the newest one stored by then can go.
+	expired := now.Add(-maxCursorAge).Unix()
+	if _, err := tx.Exec("DELETE FROM recommendations WHERE build < (SELECT COALESCE(MAX(build), 0) FROM recommendation_builds WHERE built_at <= ?)", expired); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recommendation_builds WHERE build < (SELECT COALESCE(MAX(build), 0) FROM recommendation_builds WHERE built_at <= ?)", expired); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,206 @@
+package matchmaker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"muzz/auth"
+	"muzz/middleware"
+	"muzz/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRecommenderTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice liked Dani, so did Bob and Charlie who also liked Eve and Charlie liked Frank
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES
+	('Alice', 'female', '1990-01-01', 0, 0),
+	('Bob', 'male', '1990-01-01', 0, 0),
+	('Charlie', 'male', '1990-01-01', 0, 0),
+	('Dani', 'non-binary', '1990-01-01', 0, 0),
+	('Eve', 'female', '1990-01-01', 0, 0),
+	('Frank', 'male', '1990-01-01', 0, 0);
+
+	INSERT INTO swipes (swiper, swipe_target, liked) VALUES
+	(1, 4, TRUE),
+	(2, 4, TRUE),
+	(2, 5, TRUE),
+	(3, 4, TRUE),
+	(3, 5, TRUE),
+	(3, 6, TRUE);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// the recommendations stored for the user in the newest build
+func storedRecommendations(t *testing.T, db *sql.DB, userID int) map[int]float64 {
+	rows, err := db.Query(`SELECT candidate_id, score FROM recommendations
+	WHERE user_id = ? AND build = (SELECT MAX(build) FROM recommendation_builds)`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	recommendations := map[int]float64{}
+	for rows.Next() {
+		var candidateID int
+		var score float64
+		if err := rows.Scan(&candidateID, &score); err != nil {
+			t.Fatal(err)
+		}
+		recommendations[candidateID] = score
+	}
+	return recommendations
+}
+
+func TestRecommenderRebuild(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	recommender := NewRecommender(db, DefaultRecommendationsPerUser, nil)
+
+	if err := recommender.Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dani was liked by 3 people, Eve by 2 of them and Frank by 1
+	recommendations := storedRecommendations(t, db, 1)
+	assert.Len(t, recommendations, 2)
+	assert.InDelta(t, 0.816, recommendations[5], 0.001)
+	assert.InDelta(t, 0.577, recommendations[6], 0.001)
+
+	t.Run("people the user has swiped on aren't recommended", func(t *testing.T) {
+		if _, err := db.Exec("INSERT INTO swipes (swiper, swipe_target, liked) VALUES (1, 6, FALSE)"); err != nil {
+			t.Fatal(err)
+		}
+		if err := recommender.Rebuild(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		recommendations := storedRecommendations(t, db, 1)
+		assert.Len(t, recommendations, 1)
+		assert.Contains(t, recommendations, 5)
+	})
+
+	t.Run("only the best recommendations are kept", func(t *testing.T) {
+		if err := NewRecommender(db, 1, nil).Rebuild(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Charlie liked the same person as Bob so Bob is recommended Frank, and Bob liked the same people as Charlie
+		// but Charlie has already liked them all
+		assert.Len(t, storedRecommendations(t, db, 2), 1)
+		assert.Empty(t, storedRecommendations(t, db, 3))
+	})
+
+	t.Run("builds are kept until cursors which use them expire", func(t *testing.T) {
+		builds := func() []int {
+			var builds []int
+			rows, err := db.Query("SELECT DISTINCT build FROM recommendation_builds ORDER BY build")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var build int
+				if err := rows.Scan(&build); err != nil {
+					t.Fatal(err)
+				}
+				builds = append(builds, build)
+			}
+			return builds
+		}
+		assert.Equal(t, []int{1, 2, 3}, builds())
+
+		// cursors taken before build 3 have expired but build 3 is still needed by cursors taken since
+		later := NewRecommender(db, DefaultRecommendationsPerUser, nil)
+		later.clock = func() time.Time { return time.Now().Add(maxCursorAge + time.Minute) }
+		if err := later.Rebuild(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []int{3, 4}, builds())
+
+		var stale int
+		if err := db.QueryRow("SELECT COUNT(*) FROM recommendations WHERE build < 3").Scan(&stale); err != nil {
+			t.Fatal(err)
+		}
+		assert.Zero(t, stale)
+	})
+}
+
+func TestDiscoverHandlerRecommendations(t *testing.T) {
+	db := newRecommenderTestDB(t)
+	recommender := NewRecommender(db, DefaultRecommendationsPerUser, nil)
+
+	if err := recommender.Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1})
+	now := time.Date(2024, 04, 01, 0, 0, 0, 0, time.Local)
+	handler := DiscoverHandler(DiscoverHandlerDeps{clock: func() time.Time { return now }, DB: db, Scorer: WeightedScorer{RecommendationWeight: 1}})
+
+	discover := func(target string) DiscoverResponse {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response DiscoverResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	ids := func(response DiscoverResponse) []int {
+		ids := []int{}
+		for _, p := range response.Results {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	first := discover("/discover?limit=2")
+	assert.Equal(t, []int{5, 6}, ids(first))
+
+	// Gus likes Dani and Bob which recommends Bob as strongly as Frank
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, lat, lng) VALUES ('Gus', 'male', '1990-01-01', 0, 0);
+	INSERT INTO swipes (swiper, swipe_target, liked) VALUES (7, 4, TRUE), (7, 2, TRUE);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := recommender.Rebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next page still uses the recommendations from when the first page was requested
+	second := discover("/discover?limit=2&cursor=" + *first.NextCursor)
+	assert.Equal(t, []int{2, 3}, ids(second))
+
+	assert.Equal(t, []int{5, 2, 6}, ids(discover("/discover?limit=3")))
+}
@@ -0,0 +1,87 @@
+package matchmaker
+
+import (
+	"errors"
+	"math"
+)
+
+// Features of a candidate which they can be ranked on
+type Features struct {
+	// how far the candidate is from the user in km
+	DistanceKm float64 `json:"distance_km"`
+	// likes the candidate has received from other users
+	TotalLikes int `json:"total_likes"`
+	// Elo style desirability rating, starts at DefaultRating
+	Rating float64 `json:"rating"`
+	// how strongly the Recommender thinks the user will like the candidate, 0 if they weren't recommended
+	Recommendation float64 `json:"recommendation"`
+
+	// the raw features scaled between 0 and 1 relative to the other candidates, 0 is the closest, least liked, lowest
+	// rated or not recommended
+	NormalizedDistance       float64 `json:"normalized_distance"`
+	NormalizedLikes          float64 `json:"normalized_likes"`
+	NormalizedRating         float64 `json:"normalized_rating"`
+	NormalizedRecommendation float64 `json:"normalized_recommendation"`
+}
+
+// Scorer decides the order candidates are shown in, candidates with a higher score are shown first
+type Scorer interface {
+	Score(features Features) float64
+}
+
+// ExplainingScorer is a Scorer which can break a score down into how much each feature added to it, discover's explain
+// mode shows the breakdown when the scorer supports it
+type ExplainingScorer interface {
+	Scorer
+	Contributions(features Features) map[string]float64
+}
+
+// WeightedScorer adds up the normalized features multiplied by their weights, closer candidates score higher
+type WeightedScorer struct {
+	DistanceWeight       float64 `json:"distance_weight"`
+	LikesWeight          float64 `json:"likes_weight"`
+	RatingWeight         float64 `json:"rating_weight"`
+	RecommendationWeight float64 `json:"recommendation_weight"`
+}
+
+// DefaultScorer places a heavier weight on distance so nearby profiles are recommended higher but likes still have
+// some influence. The rating and recommender are left out so they can be turned on with config or tried in an experiment
+var DefaultScorer Scorer = WeightedScorer{DistanceWeight: 0.8, LikesWeight: 0.2}
+
+// UsesRecommendations reports whether the scorer could blend in the recommender's scores, so the recommender only has
+// to run when something uses it. Scorers other than WeightedScorer are assumed to
+func UsesRecommendations(scorer Scorer) bool {
+	weighted, ok := scorer.(WeightedScorer)
+	return !ok || weighted.RecommendationWeight > 0
+}
+
+// Validate checks the weights can't be negative and at least one is set
+func (s WeightedScorer) Validate() error {
+	weights := []float64{s.DistanceWeight, s.LikesWeight, s.RatingWeight, s.RecommendationWeight}
+	total := 0.0
+	for _, weight := range weights {
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return errors.New("weights must be positive numbers")
+		}
+		total += weight
+	}
+	if total == 0 {
+		return errors.New("at least one weight must be more than 0")
+	}
+	return nil
+}
+
+func (s WeightedScorer) Score(features Features) float64 {
+	return ((1 - features.NormalizedDistance) * s.DistanceWeight) + (features.NormalizedLikes * s.LikesWeight) +
+		(features.NormalizedRating * s.RatingWeight) + (features.NormalizedRecommendation * s.RecommendationWeight)
+}
+
+// Contributions are the weighted features which Score adds up
+func (s WeightedScorer) Contributions(features Features) map[string]float64 {
+	return map[string]float64{
+		"distance":       (1 - features.NormalizedDistance) * s.DistanceWeight,
+		"likes":          features.NormalizedLikes * s.LikesWeight,
+		"rating":         features.NormalizedRating * s.RatingWeight,
+		"recommendation": features.NormalizedRecommendation * s.RecommendationWeight,
+	}
+}
@@ -0,0 +1,98 @@
+package matchmaker
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedScorerValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		scorer  WeightedScorer
+		wantErr bool
+	}{
+		{name: "default weights", scorer: DefaultScorer.(WeightedScorer)},
+		{name: "one weight", scorer: WeightedScorer{LikesWeight: 1}},
+		{name: "weights don't have to add up to 1", scorer: WeightedScorer{DistanceWeight: 3, LikesWeight: 2}},
+		{name: "rating only", scorer: WeightedScorer{RatingWeight: 1}},
+		{name: "recommendations only", scorer: WeightedScorer{RecommendationWeight: 1}},
+		{name: "negative weight", scorer: WeightedScorer{DistanceWeight: -1, LikesWeight: 1}, wantErr: true},
+		{name: "no weights", scorer: WeightedScorer{}, wantErr: true},
+		{name: "NaN weight", scorer: WeightedScorer{DistanceWeight: math.NaN(), LikesWeight: 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scorer.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDefaultScorerIsTheOriginalFormula(t *testing.T) {
+	// changing the default changes the ranking for everyone, new features should be turned on with config or an experiment
+	assert.Equal(t, WeightedScorer{DistanceWeight: 0.8, LikesWeight: 0.2}, DefaultScorer)
+}
+
+func TestWeightedScorerScore(t *testing.T) {
+	scorer := WeightedScorer{DistanceWeight: 0.8, LikesWeight: 0.2}
+
+	assert.InDelta(t, 1.0, scorer.Score(Features{NormalizedDistance: 0, NormalizedLikes: 1}), 1e-9)
+	assert.InDelta(t, 0.0, scorer.Score(Features{NormalizedDistance: 1, NormalizedLikes: 0}), 1e-9)
+	assert.InDelta(t, 0.5, scorer.Score(Features{NormalizedDistance: 0.5, NormalizedLikes: 0.5}), 1e-9)
+
+	scorer = WeightedScorer{DistanceWeight: 0.5, RatingWeight: 0.5}
+	assert.InDelta(t, 0.75, scorer.Score(Features{NormalizedDistance: 0.5, NormalizedRating: 1}), 1e-9)
+
+	scorer = WeightedScorer{RecommendationWeight: 2}
+	assert.InDelta(t, 1.0, scorer.Score(Features{NormalizedRecommendation: 0.5}), 1e-9)
+}
+
+func TestWeightedScorerContributions(t *testing.T) {
+	scorer := WeightedScorer{DistanceWeight: 0.5, LikesWeight: 0.2, RatingWeight: 0.2, RecommendationWeight: 0.1}
+	features := Features{NormalizedDistance: 0.5, NormalizedLikes: 1, NormalizedRating: 0.5, NormalizedRecommendation: 1}
+
+	contributions := scorer.Contributions(features)
+	assert.InDelta(t, 0.25, contributions["distance"], 1e-9)
+	assert.InDelta(t, 0.2, contributions["likes"], 1e-9)
+	assert.InDelta(t, 0.1, contributions["rating"], 1e-9)
+	assert.InDelta(t, 0.1, contributions["recommendation"], 1e-9)
+
+	total := 0.0
+	for _, contribution := range contributions {
+		total += contribution
+	}
+	assert.InDelta(t, scorer.Score(features), total, 1e-9)
+}
+
+func TestUsesRecommendations(t *testing.T) {
+	assert.False(t, UsesRecommendations(DefaultScorer))
+	assert.True(t, UsesRecommendations(WeightedScorer{DistanceWeight: 0.8, RecommendationWeight: 0.2}))
+
+	experiments, err := NewExperiments(nil, []Experiment{
+		{Name: "rating", Traffic: 50, Variants: []Variant{{Name: "rated", Weight: 1, Scorer: WeightedScorer{RatingWeight: 1}}}},
+		{Name: "paused", Traffic: 0, Variants: []Variant{{Name: "recommended", Weight: 1, Scorer: WeightedScorer{RecommendationWeight: 1}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the only variant using recommendations has no users
+	assert.False(t, experiments.UsesRecommendations())
+
+	experiments, err = NewExperiments(nil, []Experiment{
+		{Name: "recommendations", Traffic: 10, Variants: []Variant{
+			{Name: "control", Weight: 1, Scorer: WeightedScorer{DistanceWeight: 0.8, LikesWeight: 0.2}},
+			{Name: "recommended", Weight: 1, Scorer: WeightedScorer{DistanceWeight: 0.8, RecommendationWeight: 0.2}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, experiments.UsesRecommendations())
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"muzz/httpresponse"
 	"muzz/middleware"
+	"muzz/user"
 	"net/http"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -37,6 +38,15 @@ type Match struct {
 
 type SwipeHandlerDeps struct {
 	DB *sql.DB
+
+	// when set, users have to verify their email before they can swipe
+	RequireVerifiedEmail bool
+
+	// optional, called after the swipe is stored
+	Swiped func(swiper int, swipeTarget int, liked bool)
+
+	// optional, swipes by users in an experiment are recorded against their variant
+	Experiments *Experiments
 }
 
 // allows the sender to potentially match with other users on the platform
@@ -63,6 +73,20 @@ func SwipeHandler(deps SwipeHandlerDeps) http.HandlerFunc {
 			return
 		}
 
+		if deps.RequireVerifiedEmail {
+			verified, err := user.IsEmailVerified(deps.DB, claims.UserID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to process swipe request"})
+				return
+			}
+			if !verified {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Verify your email before swiping"})
+				return
+			}
+		}
+
 		tx, err := deps.DB.Begin()
 		if err != nil {
 			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
@@ -79,6 +103,14 @@ func SwipeHandler(deps SwipeHandlerDeps) http.HandlerFunc {
 			return
 		}
 
+		if deps.Experiments != nil {
+			if err := deps.Experiments.recordSwipeInTransaction(tx, myUserID, req.OtherUserID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to process swipe request"})
+				return
+			}
+		}
+
 		err = tx.Commit()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -86,6 +118,10 @@ func SwipeHandler(deps SwipeHandlerDeps) http.HandlerFunc {
 			return
 		}
 
+		if deps.Swiped != nil {
+			deps.Swiped(myUserID, req.OtherUserID, userLiked)
+		}
+
 		existingMatch, foundMatchErr := getExistingMatchForUser(deps.DB, myUserID, req.OtherUserID)
 
 		// no existing match found
@@ -131,13 +167,19 @@ func getExistingMatchForUser(db *sql.DB, userID1 int, userID2 int) (*Match, erro
 }
 
 // When we create a new swipe record it will call a SQL trigger which might create a match record if both users have liked each other
+// The rating of the person swiped on is updated as part of the same transaction
 func createSwipeRecordInTransaction(tx *sql.Tx, swiper int, swipe_target int, liked bool) error {
-	_, err := tx.Exec("INSERT INTO swipes (swiper, swipe_target, liked) VALUES (?, ?, ?)",
+	result, err := tx.Exec("INSERT INTO swipes (swiper, swipe_target, liked) VALUES (?, ?, ?)",
 		swiper, swipe_target, liked)
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	swipeID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return updateRatingInTransaction(tx, swipeID, swiper, swipe_target, liked)
 }
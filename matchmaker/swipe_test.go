@@ -149,3 +149,57 @@ func TestSwipeHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestSwipeHandlerRequireVerifiedEmail(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`
+	INSERT INTO users (name, gender, dob, email_verified_at) VALUES
+	('Alice', 'female', '1990-01-01', 1711929600),
+	('Bob', 'male', '1985-01-01', NULL);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		userID         int
+		expectedStatus int
+	}{
+		{
+			name:           "verified user can swipe",
+			userID:         1,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unverified user can't swipe",
+			userID:         2,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: tt.userID})
+			req, err := http.NewRequestWithContext(ctx, "POST", "/swipe", bytes.NewBufferString(`{"other_user_id": 3, "like": true}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(SwipeHandler(SwipeHandlerDeps{DB: db, RequireVerifiedEmail: true})).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// reports whether the user is an admin
+type IsAdmin = func(userID int) (bool, error)
+
+// Creates a new middleware which only lets admins through
+// Must be used behind the auth guard as it relies on the claims being on the context
+func NewAdminGuardMiddleware(isAdmin IsAdmin) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, found := GetClaimsFromContext(r.Context())
+			if !found {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			admin, err := isAdmin(claims.UserID)
+			if err != nil {
+				slog.Error("failed to check if user is an admin", slog.Any("error", err))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			if !admin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
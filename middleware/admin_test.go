@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"muzz/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminGuard(t *testing.T) {
+	isAdmin := func(userID int) (bool, error) {
+		switch userID {
+		case 1:
+			return true, nil
+		case 2:
+			return false, nil
+		default:
+			return false, errors.New("db is down")
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		ctx          context.Context
+		expectedCode int
+	}{
+		{
+			name:         "no claims on context",
+			ctx:          context.Background(),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "user is an admin",
+			ctx:          SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 1}),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "user isn't an admin",
+			ctx:          SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 2}),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "failed to check if the user is an admin",
+			ctx:          SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: 3}),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil).WithContext(tc.ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			NewAdminGuardMiddleware(isAdmin)(handler).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedCode {
+				t.Errorf("Test case '%s': Expected status code %d, got %d", tc.name, tc.expectedCode, rr.Code)
+			}
+		})
+	}
+}
@@ -25,13 +25,34 @@ const claimsContextKey = "claims"
 // extracts the claims from a given token
 type ExtractClaimsFromToken = func(tokenString string) (*auth.JWTClaims, error)
 
+// reports whether the token the claims came from has been revoked
+type IsTokenRevoked = func(claims auth.JWTClaims) bool
+
 type authGuardMiddleware struct {
 	ExtractClaimsFromToken
+
+	// optional, when set revoked tokens are rejected
+	isTokenRevoked IsTokenRevoked
+}
+
+// provides functional-style options to modify the behaviour of the auth guard
+type authGuardOption func(*authGuardMiddleware)
+
+// Rejects tokens which have been revoked before they expired e.g. on logout
+// the check is made on every request so it should be served from memory
+func WithRevocationCheck(isTokenRevoked IsTokenRevoked) authGuardOption {
+	return func(m *authGuardMiddleware) {
+		m.isTokenRevoked = isTokenRevoked
+	}
 }
 
 // Creates a new middleware which protects from un-authenticated users
-func NewAuthGuardMiddleware(extractor ExtractClaimsFromToken) Middleware {
+func NewAuthGuardMiddleware(extractor ExtractClaimsFromToken, options ...authGuardOption) Middleware {
 	m := authGuardMiddleware{ExtractClaimsFromToken: extractor}
+
+	for _, option := range options {
+		option(&m)
+	}
 	return m.authGuard
 }
 
@@ -58,6 +79,11 @@ func (m *authGuardMiddleware) authGuard(next http.Handler) http.Handler {
 			return
 		}
 
+		if m.isTokenRevoked != nil && m.isTokenRevoked(*claims) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		r = r.WithContext(SetClaimsOnContext(r.Context(), *claims))
 
 		next.ServeHTTP(w, r)
@@ -54,10 +54,11 @@ func TestGetClaimsFromContext(t *testing.T) {
 func TestAuthGuard(t *testing.T) {
 
 	testCases := []struct {
-		name         string
-		header       string
-		expectedCode int
-		extractor    ExtractClaimsFromToken
+		name           string
+		header         string
+		expectedCode   int
+		extractor      ExtractClaimsFromToken
+		isTokenRevoked IsTokenRevoked
 	}{
 		{
 			name:         "Empty Authorization header",
@@ -88,6 +89,27 @@ func TestAuthGuard(t *testing.T) {
 				return &auth.JWTClaims{}, nil
 			},
 		},
+		{
+			name:         "Valid token which has been revoked",
+			header:       "Bearer my-token",
+			expectedCode: http.StatusUnauthorized,
+			extractor: func(tokenString string) (*auth.JWTClaims, error) {
+				return &auth.JWTClaims{UserID: 1}, nil
+			},
+			isTokenRevoked: func(claims auth.JWTClaims) bool {
+				assert.Equal(t, 1, claims.UserID)
+				return true
+			},
+		},
+		{
+			name:         "Valid token which hasn't been revoked",
+			header:       "Bearer my-token",
+			expectedCode: http.StatusOK,
+			extractor: func(tokenString string) (*auth.JWTClaims, error) {
+				return &auth.JWTClaims{UserID: 1}, nil
+			},
+			isTokenRevoked: func(claims auth.JWTClaims) bool { return false },
+		},
 	}
 
 	for _, tc := range testCases {
@@ -102,6 +124,9 @@ func TestAuthGuard(t *testing.T) {
 			// Call the AuthGuard middleware with a dummy handler
 			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 			middleware := NewAuthGuardMiddleware(tc.extractor)
+			if tc.isTokenRevoked != nil {
+				middleware = NewAuthGuardMiddleware(tc.extractor, WithRevocationCheck(tc.isTokenRevoked))
+			}
 			authGuard := middleware(handler)
 			authGuard.ServeHTTP(rr, req)
 
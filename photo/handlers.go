@@ -0,0 +1,274 @@
+package photo
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"muzz/httpresponse"
+	"muzz/middleware"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The JSON representation of a photo
+type PhotoResponse struct {
+	ID       int  `json:"id"`
+	Position int  `json:"position"`
+	Primary  bool `json:"primary"`
+	// download link for each size e.g. "thumb"
+	URLs map[string]string `json:"urls"`
+}
+
+// The JSON response listing the user's photos
+type PhotosResponse struct {
+	Results []PhotoResponse `json:"results"`
+}
+
+func (p *Photos) toResponse(photo Photo) PhotoResponse {
+	urls := map[string]string{}
+	for _, size := range Sizes {
+		urls[size.Name] = p.URL(photo.Key, size.Name)
+	}
+	return PhotoResponse{ID: photo.ID, Position: photo.Position, Primary: photo.Primary, URLs: urls}
+}
+
+type PhotoHandlerDeps struct {
+	Photos *Photos
+}
+
+// uploads a photo for the logged in user, the file is sent in the `photo` field of a multipart form
+func UploadPhotoHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		// leaves room for the rest of the multipart form
+		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadBytes+(1<<20))
+
+		file, _, err := r.FormFile("photo")
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo is too large"})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "The photo must be uploaded in the `photo` field of a multipart form"})
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, MaxUploadBytes+1))
+		if err != nil {
+			slog.Error("failed to read photo upload", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to upload photo"})
+			return
+		}
+		if len(data) > MaxUploadBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo is too large"})
+			return
+		}
+
+		photo, err := deps.Photos.Upload(r.Context(), claims.UserID, data)
+		if err != nil {
+			switch {
+			case errors.Is(err, errUnsupportedImage):
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			case errors.Is(err, errImageTooLarge):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			case errors.Is(err, errTooManyPhotos):
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			default:
+				slog.Error("failed to upload photo", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to upload photo"})
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(deps.Photos.toResponse(photo))
+	}
+}
+
+// lists the logged in user's photos in order
+func ListPhotosHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		photos, err := deps.Photos.List(claims.UserID)
+		if err != nil {
+			slog.Error("failed to list photos", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to get photos"})
+			return
+		}
+
+		response := PhotosResponse{Results: []PhotoResponse{}}
+		for _, photo := range photos {
+			response.Results = append(response.Results, deps.Photos.toResponse(photo))
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Request body for the ReorderPhotosHandler
+type ReorderPhotosRequest struct {
+	// every one of the user's photos in the order they should be shown
+	PhotoIDs []int `json:"photo_ids"`
+}
+
+// changes the order the logged in user's photos are shown in
+func ReorderPhotosHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		var req ReorderPhotosRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if err := deps.Photos.Reorder(claims.UserID, req.PhotoIDs); err != nil {
+			if errors.Is(err, errInvalidOrder) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+				return
+			}
+			slog.Error("failed to reorder photos", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to reorder photos"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// makes the photo from the `id` path value the logged in user's primary photo
+func SetPrimaryPhotoHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		photoID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo ID must be a number"})
+			return
+		}
+
+		if err := deps.Photos.SetPrimary(claims.UserID, photoID); err != nil {
+			if errors.Is(err, errPhotoNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo not found"})
+				return
+			}
+			slog.Error("failed to set primary photo", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to set primary photo"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deletes the photo from the `id` path value
+func DeletePhotoHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		photoID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo ID must be a number"})
+			return
+		}
+
+		if err := deps.Photos.Delete(r.Context(), claims.UserID, photoID); err != nil {
+			if errors.Is(err, errPhotoNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Photo not found"})
+				return
+			}
+			slog.Error("failed to delete photo", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to delete photo"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serves a photo file using the `key` and `file` path values e.g. /photos/{key}/thumb.jpg
+// photo keys are random and never reused so the files can be cached forever
+func ServePhotoHandler(deps PhotoHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size, ok := strings.CutSuffix(r.PathValue("file"), ".jpg")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := deps.Photos.open(r.Context(), r.PathValue("key"), size)
+		if err != nil {
+			if !errors.Is(err, ErrBlobNotFound) {
+				slog.Error("failed to open photo", slog.Any("error", err))
+				http.Error(w, "failed to get photo", http.StatusInternalServerError)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		io.Copy(w, file)
+	}
+}
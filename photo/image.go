@@ -0,0 +1,194 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+
+	// registers the png decoder with image.Decode
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+var (
+	errUnsupportedImage = errors.New("photo must be a jpeg or png")
+	errImageTooLarge    = errors.New("photo has too many pixels")
+)
+
+// content types which can be uploaded, worked out from the file itself rather than what the client says
+var allowedContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// stops small files which decode to huge images from using all the memory
+const maxPixels = 40_000_000
+
+const jpegQuality = 85
+
+// Size is one of the versions of a photo which are generated on upload
+type Size struct {
+	Name string
+	// the longest side in pixels, smaller photos aren't scaled up
+	MaxDimension int
+}
+
+// Sizes generated for every photo
+var Sizes = []Size{
+	{Name: "thumb", MaxDimension: 200},
+	{Name: "medium", MaxDimension: 800},
+	{Name: "large", MaxDimension: 1600},
+}
+
+// decodes the upload after checking it is an allowed type and isn't too large, turned the way up it's meant to be
+// viewed as the EXIF orientation is lost when it is re-encoded
+func decodeImage(data []byte) (image.Image, error) {
+	if !allowedContentTypes[http.DetectContentType(data)] {
+		return nil, errUnsupportedImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, errImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	return orient(img, exifOrientation(data)), nil
+}
+
+// the EXIF orientation of a jpeg, 1 (as stored) when there isn't one. Phones usually store photos the way the sensor
+// was facing and rely on the orientation to show them the right way up
+func exifOrientation(data []byte) int {
+	// the segments after the start of image marker, EXIF is always before the image data starts
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			break
+		}
+		if payload := data[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return tiffOrientation(payload[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// reads the orientation tag from the first IFD of the EXIF TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// the orientation is a single short stored in the entry itself
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// turns and flips the image the way its EXIF orientation says it should be viewed
+func orient(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+
+	// maps the stored pixels to where they are viewed
+	var transform f64.Aff3
+	switch orientation {
+	case 2: // mirrored
+		transform = f64.Aff3{-1, 0, w, 0, 1, 0}
+	case 3: // upside down
+		transform = f64.Aff3{-1, 0, w, 0, -1, h}
+	case 4: // upside down and mirrored
+		transform = f64.Aff3{1, 0, 0, 0, -1, h}
+	case 5: // on its side and mirrored
+		transform = f64.Aff3{0, 1, 0, 1, 0, 0}
+	case 6: // needs turning 90 degrees clockwise
+		transform = f64.Aff3{0, -1, h, 1, 0, 0}
+	case 7: // on its other side and mirrored
+		transform = f64.Aff3{0, -1, h, -1, 0, w}
+	case 8: // needs turning 90 degrees anticlockwise
+		transform = f64.Aff3{0, 1, 0, -1, 0, w}
+	default:
+		return img
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	// relative to the bounds as decoded images don't have to start at 0, 0
+	transform[2] -= transform[0]*float64(bounds.Min.X) + transform[1]*float64(bounds.Min.Y)
+	transform[5] -= transform[3]*float64(bounds.Min.X) + transform[4]*float64(bounds.Min.Y)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	// whole pixels only move so nearest neighbour copies them exactly
+	draw.NearestNeighbor.Transform(dst, transform, img, bounds, draw.Src, nil)
+	return dst
+}
+
+// scales the image down so its longest side is at most maxDimension, keeping the aspect ratio
+func resize(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width <= maxDimension && height <= maxDimension {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*maxDimension/width)
+		width = maxDimension
+	} else {
+		width = max(1, width*maxDimension/height)
+		height = maxDimension
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// re-encodes the image as a jpeg, only the pixels are kept so EXIF data such as GPS coordinates is dropped
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
@@ -0,0 +1,267 @@
+package photo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// MaxUploadBytes is the largest photo file which can be uploaded
+const MaxUploadBytes = 10 << 20
+
+// MaxPhotosPerUser is how many photos a user can have at once
+const MaxPhotosPerUser = 6
+
+var (
+	errPhotoNotFound = errors.New("photo not found")
+	errTooManyPhotos = fmt.Errorf("users can have at most %d photos", MaxPhotosPerUser)
+	errInvalidOrder  = errors.New("order must contain each of the user's photos exactly once")
+)
+
+// Photo is a photo the user has uploaded
+type Photo struct {
+	ID int
+	// where the sizes of the photo are kept in the blob store
+	Key      string
+	Position int
+	Primary  bool
+}
+
+// Photos stores the photos users upload, the files are kept in the BlobStore and the order in the db
+type Photos struct {
+	db    *sql.DB
+	blobs BlobStore
+	// photo URLs start with this e.g. http://localhost:8080
+	baseURL string
+
+	// for managing the time yourself, mainly for testing
+	clock func() time.Time
+}
+
+// Creates the photo store, photo URLs are served from baseURL by the ServePhotoHandler
+func NewPhotos(db *sql.DB, blobs BlobStore, baseURL string) *Photos {
+	return &Photos{db: db, blobs: blobs, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (p *Photos) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock()
+}
+
+// the blob store key of one size of a photo
+func blobKey(photoKey string, size string) string {
+	return photoKey + "/" + size + ".jpg"
+}
+
+// URL returns where the given size of a photo can be downloaded from
+func (p *Photos) URL(photoKey string, size string) string {
+	return p.baseURL + "/photos/" + blobKey(photoKey, size)
+}
+
+// Upload checks the image, stores every size of it without its metadata and adds it to the end of the user's photos
+// The first photo a user uploads becomes their primary photo
+func (p *Photos) Upload(ctx context.Context, userID int, data []byte) (Photo, error) {
+	// checked before the image is processed to fail fast, the insert checks again in case of concurrent uploads
+	var count int
+	if err := p.db.QueryRow("SELECT COUNT(*) FROM photos WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return Photo{}, err
+	}
+	if count >= MaxPhotosPerUser {
+		return Photo{}, errTooManyPhotos
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return Photo{}, err
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return Photo{}, err
+	}
+	key := hex.EncodeToString(random)
+
+	for _, size := range Sizes {
+		var buf bytes.Buffer
+		if err := encodeJPEG(&buf, resize(img, size.MaxDimension)); err != nil {
+			p.deleteBlobs(ctx, key)
+			return Photo{}, err
+		}
+		if err := p.blobs.Put(ctx, blobKey(key, size.Name), &buf); err != nil {
+			p.deleteBlobs(ctx, key)
+			return Photo{}, err
+		}
+	}
+
+	photo := Photo{Key: key}
+	err = p.db.QueryRow(`INSERT INTO photos (user_id, blob_key, position, is_primary, created_at)
+	SELECT ?, ?,
+		COALESCE((SELECT MAX(position) + 1 FROM photos WHERE user_id = ?), 0),
+		NOT EXISTS (SELECT 1 FROM photos WHERE user_id = ? AND is_primary),
+		?
+	WHERE (SELECT COUNT(*) FROM photos WHERE user_id = ?) < ?
+	RETURNING id, position, is_primary`, userID, key, userID, userID, p.now().Unix(), userID, MaxPhotosPerUser).Scan(&photo.ID, &photo.Position, &photo.Primary)
+	if err != nil {
+		p.deleteBlobs(ctx, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Photo{}, errTooManyPhotos
+		}
+		return Photo{}, err
+	}
+
+	return photo, nil
+}
+
+// removes every size of the photo from the blob store, failures are only logged as the photo is no longer referenced
+func (p *Photos) deleteBlobs(ctx context.Context, photoKey string) {
+	for _, size := range Sizes {
+		if err := p.blobs.Delete(ctx, blobKey(photoKey, size.Name)); err != nil {
+			slog.Error("failed to delete photo", slog.String("key", photoKey), slog.Any("error", err))
+		}
+	}
+}
+
+// List returns the user's photos in the order they want them shown
+func (p *Photos) List(userID int) ([]Photo, error) {
+	rows, err := p.db.Query("SELECT id, blob_key, position, is_primary FROM photos WHERE user_id = ? ORDER BY position", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	for rows.Next() {
+		var photo Photo
+		if err := rows.Scan(&photo.ID, &photo.Key, &photo.Position, &photo.Primary); err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+// Reorder sets the order of the user's photos, photoIDs must contain each of their photos exactly once
+func (p *Photos) Reorder(userID int, photoIDs []int) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM photos WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return err
+	}
+	if count != len(photoIDs) {
+		return errInvalidOrder
+	}
+
+	seen := map[int]bool{}
+	for position, photoID := range photoIDs {
+		if seen[photoID] {
+			return errInvalidOrder
+		}
+		seen[photoID] = true
+
+		result, err := tx.Exec("UPDATE photos SET position = ? WHERE id = ? AND user_id = ?", position, photoID, userID)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// the photo belongs to someone else or doesn't exist
+		if updated == 0 {
+			return errInvalidOrder
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetPrimary makes the photo the one shown in discover results
+func (p *Photos) SetPrimary(userID int, photoID int) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM photos WHERE id = ? AND user_id = ?)", photoID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errPhotoNotFound
+	}
+
+	if _, err := tx.Exec("UPDATE photos SET is_primary = 0 WHERE user_id = ? AND is_primary", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE photos SET is_primary = 1 WHERE id = ?", photoID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the photo, if it was the primary photo the next photo in the user's order becomes primary
+func (p *Photos) Delete(ctx context.Context, userID int, photoID int) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	var position int
+	var primary bool
+	err = tx.QueryRow("DELETE FROM photos WHERE id = ? AND user_id = ? RETURNING blob_key, position, is_primary", photoID, userID).Scan(&key, &position, &primary)
+	if err == sql.ErrNoRows {
+		return errPhotoNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// close the gap so positions stay contiguous
+	if _, err := tx.Exec("UPDATE photos SET position = position - 1 WHERE user_id = ? AND position > ?", userID, position); err != nil {
+		return err
+	}
+
+	if primary {
+		_, err := tx.Exec("UPDATE photos SET is_primary = 1 WHERE id = (SELECT id FROM photos WHERE user_id = ? ORDER BY position LIMIT 1)", userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	p.deleteBlobs(ctx, key)
+	return nil
+}
+
+// opens one size of a photo, returns ErrBlobNotFound if it doesn't exist
+func (p *Photos) open(ctx context.Context, photoKey string, size string) (io.ReadCloser, error) {
+	for _, s := range Sizes {
+		if s.Name == size {
+			return p.blobs.Get(ctx, blobKey(photoKey, size))
+		}
+	}
+	return nil, ErrBlobNotFound
+}
@@ -0,0 +1,432 @@
+package photo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"muzz/auth"
+	"muzz/middleware"
+	"muzz/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPhotos(t *testing.T) (*Photos, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPhotos(db, blobs, "http://localhost:8080/"), db
+}
+
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// a jpeg with an EXIF segment containing GPS coordinates, like the ones phones take
+func testJPEGWithEXIF(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(300, 200), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	payload := []byte("Exif\x00\x00GPSLatitude 51.5072 GPSLongitude -0.1276")
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	// the APP1 segment goes straight after the start of image marker
+	withEXIF := append([]byte{}, encoded[:2]...)
+	withEXIF = append(withEXIF, segment...)
+	return append(withEXIF, encoded[2:]...)
+}
+
+// a jpeg stored on its side like phones do, with an EXIF orientation of 6 to say it needs turning 90 degrees clockwise.
+// The top left corner as stored is red so it can be found after turning.
+func testJPEGWithOrientation(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			c := color.RGBA{B: 255, A: 255}
+			if x < 50 && y < 50 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// a big endian TIFF header and an IFD with just the orientation
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	tiff = append(tiff, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0)
+	tiff = append(tiff, 0, 0, 0, 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	withEXIF := append([]byte{}, encoded[:2]...)
+	withEXIF = append(withEXIF, segment...)
+	return append(withEXIF, encoded[2:]...)
+}
+
+func uploadRequest(t *testing.T, userID int, data []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("photo", "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/user/me/photos", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req.WithContext(middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID}))
+}
+
+func TestUploadPhoto(t *testing.T) {
+	photos, _ := newTestPhotos(t)
+	upload := UploadPhotoHandler(PhotoHandlerDeps{Photos: photos})
+
+	rr := httptest.NewRecorder()
+	upload.ServeHTTP(rr, uploadRequest(t, 1, testJPEGWithEXIF(t)))
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	var response PhotoResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, response.Primary, "the first photo is the primary photo")
+	assert.Equal(t, 0, response.Position)
+	assert.Len(t, response.URLs, len(Sizes))
+
+	stored, err := photos.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, stored, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, "http://localhost:8080/photos/"+stored[0].Key+"/thumb.jpg", response.URLs["thumb"])
+
+	serve := ServePhotoHandler(PhotoHandlerDeps{Photos: photos})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /photos/{key}/{file}", serve)
+
+	for _, size := range Sizes {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/photos/"+stored[0].Key+"/"+size.Name+".jpg", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+
+		data, _ := io.ReadAll(rr.Body)
+		assert.NotContains(t, string(data), "Exif", "metadata should be stripped")
+		assert.NotContains(t, string(data), "GPS", "metadata should be stripped")
+
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 300x200 is only scaled down for the thumbnail
+		expectedWidth := min(300, size.MaxDimension)
+		assert.Equal(t, expectedWidth, config.Width, size.Name)
+		assert.Equal(t, expectedWidth*2/3, config.Height, size.Name)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/photos/"+stored[0].Key+"/original.jpg", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/photos/..%2F..%2Fetc/thumb.jpg", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestUploadPhotoValidation(t *testing.T) {
+	photos, _ := newTestPhotos(t)
+	upload := UploadPhotoHandler(PhotoHandlerDeps{Photos: photos})
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantStatus int
+	}{
+		{name: "not an image", data: []byte("<html>definitely a photo</html>"), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "gif", data: []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "too many bytes", data: append(testPNG(t, 10, 10), make([]byte, MaxUploadBytes)...), wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			upload.ServeHTTP(rr, uploadRequest(t, 1, tc.data))
+			assert.Equal(t, tc.wantStatus, rr.Code, rr.Body.String())
+		})
+	}
+
+	for i := 0; i < MaxPhotosPerUser; i++ {
+		rr := httptest.NewRecorder()
+		upload.ServeHTTP(rr, uploadRequest(t, 1, testPNG(t, 10, 10)))
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	upload.ServeHTTP(rr, uploadRequest(t, 1, testPNG(t, 10, 10)))
+	assert.Equal(t, http.StatusConflict, rr.Code, "users have a limited number of photos")
+}
+
+func TestConcurrentUploadsKeepTheLimit(t *testing.T) {
+	photos, db := newTestPhotos(t)
+	// the in memory db only exists on one connection
+	db.SetMaxOpenConns(1)
+
+	uploads := 2 * MaxPhotosPerUser
+	errs := make(chan error, uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := photos.Upload(context.Background(), 1, testPNG(t, 10, 10))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	uploaded := 0
+	for err := range errs {
+		if err == nil {
+			uploaded++
+		} else {
+			assert.ErrorIs(t, err, errTooManyPhotos)
+		}
+	}
+	assert.Equal(t, MaxPhotosPerUser, uploaded)
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM photos WHERE user_id = 1").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MaxPhotosPerUser, count)
+}
+
+func TestOrderAndPrimaryPhoto(t *testing.T) {
+	photos, _ := newTestPhotos(t)
+	ctx := context.Background()
+
+	ids := []int{}
+	for i := 0; i < 3; i++ {
+		photo, err := photos.Upload(ctx, 1, testPNG(t, 10, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, photo.ID)
+	}
+
+	other, err := photos.Upload(ctx, 2, testPNG(t, 10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimsCtx := middleware.SetClaimsOnContext(ctx, auth.JWTClaims{UserID: 1})
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /user/me/photos/order", ReorderPhotosHandler(PhotoHandlerDeps{Photos: photos}))
+	mux.HandleFunc("PUT /user/me/photos/{id}/primary", SetPrimaryPhotoHandler(PhotoHandlerDeps{Photos: photos}))
+	mux.HandleFunc("DELETE /user/me/photos/{id}", DeletePhotoHandler(PhotoHandlerDeps{Photos: photos}))
+
+	do := func(method string, target string, body string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, bytes.NewBufferString(body)).WithContext(claimsCtx))
+		return rr.Code
+	}
+
+	order := func(ids ...int) string {
+		b, _ := json.Marshal(ReorderPhotosRequest{PhotoIDs: ids})
+		return string(b)
+	}
+
+	// every photo has to be given once
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/user/me/photos/order", order(ids[2], ids[1])))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/user/me/photos/order", order(ids[2], ids[2], ids[1])))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/user/me/photos/order", order(ids[2], ids[1], other.ID)))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/user/me/photos/order", order(ids[2], ids[0], ids[1])))
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/user/me/photos/"+strconv.Itoa(other.ID)+"/primary", ""), "can't use someone else's photo")
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/user/me/photos/"+strconv.Itoa(ids[1])+"/primary", ""))
+
+	listed, err := photos.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []int{ids[2], ids[0], ids[1]}, []int{listed[0].ID, listed[1].ID, listed[2].ID})
+	assert.Equal(t, []bool{false, false, true}, []bool{listed[0].Primary, listed[1].Primary, listed[2].Primary})
+
+	// deleting the primary photo promotes the first photo
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/user/me/photos/"+strconv.Itoa(other.ID), ""))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/user/me/photos/"+strconv.Itoa(ids[1]), ""))
+
+	listed, err = photos.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Photo{
+		{ID: ids[2], Key: listed[0].Key, Position: 0, Primary: true},
+		{ID: ids[0], Key: listed[1].Key, Position: 1, Primary: false},
+	}, listed)
+
+	_, err = photos.open(ctx, listed[0].Key, "thumb")
+	assert.NoError(t, err)
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		width, height, maxDimension int
+		wantWidth, wantHeight       int
+	}{
+		{width: 1000, height: 500, maxDimension: 200, wantWidth: 200, wantHeight: 100},
+		{width: 500, height: 1000, maxDimension: 200, wantWidth: 100, wantHeight: 200},
+		{width: 100, height: 50, maxDimension: 200, wantWidth: 100, wantHeight: 50},
+		{width: 1000, height: 1, maxDimension: 200, wantWidth: 200, wantHeight: 1},
+	}
+
+	for _, tc := range tests {
+		bounds := resize(image.NewRGBA(image.Rect(0, 0, tc.width, tc.height)), tc.maxDimension).Bounds()
+		assert.Equal(t, tc.wantWidth, bounds.Dx())
+		assert.Equal(t, tc.wantHeight, bounds.Dy())
+	}
+}
+
+func TestUploadPhotoKeepsOrientation(t *testing.T) {
+	photos, _ := newTestPhotos(t)
+	upload := UploadPhotoHandler(PhotoHandlerDeps{Photos: photos})
+
+	data := testJPEGWithOrientation(t)
+	assert.Equal(t, 6, exifOrientation(data))
+
+	rr := httptest.NewRecorder()
+	upload.ServeHTTP(rr, uploadRequest(t, 1, data))
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	stored, err := photos.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, stored, 1) {
+		t.FailNow()
+	}
+
+	serve := ServePhotoHandler(PhotoHandlerDeps{Photos: photos})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /photos/{key}/{file}", serve)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/photos/"+stored[0].Key+"/large.jpg", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	img, err := jpeg.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata is gone so the pixels have to be the right way up, the red corner is now top right
+	assert.Equal(t, image.Rect(0, 0, 200, 300), img.Bounds())
+	isRed := func(x, y int) bool {
+		r, _, b, _ := img.At(x, y).RGBA()
+		return r > 0xC000 && b < 0x4000
+	}
+	assert.True(t, isRed(175, 25))
+	assert.False(t, isRed(25, 25))
+}
+
+func TestOrient(t *testing.T) {
+	// where the stored pixel at x, y of a 3x2 image is viewed for each orientation
+	tests := []struct {
+		orientation int
+		viewedAt    func(x, y int) image.Point
+	}{
+		{orientation: 1, viewedAt: func(x, y int) image.Point { return image.Pt(x, y) }},
+		{orientation: 2, viewedAt: func(x, y int) image.Point { return image.Pt(2-x, y) }},
+		{orientation: 3, viewedAt: func(x, y int) image.Point { return image.Pt(2-x, 1-y) }},
+		{orientation: 4, viewedAt: func(x, y int) image.Point { return image.Pt(x, 1-y) }},
+		{orientation: 5, viewedAt: func(x, y int) image.Point { return image.Pt(y, x) }},
+		{orientation: 6, viewedAt: func(x, y int) image.Point { return image.Pt(1-y, x) }},
+		{orientation: 7, viewedAt: func(x, y int) image.Point { return image.Pt(1-y, 2-x) }},
+		{orientation: 8, viewedAt: func(x, y int) image.Point { return image.Pt(y, 2-x) }},
+	}
+
+	src := testImage(3, 2)
+	for _, tc := range tests {
+		oriented := orient(src, tc.orientation)
+		if tc.orientation >= 5 {
+			assert.Equal(t, image.Rect(0, 0, 2, 3), oriented.Bounds(), "orientation %d", tc.orientation)
+		} else {
+			assert.Equal(t, image.Rect(0, 0, 3, 2), oriented.Bounds(), "orientation %d", tc.orientation)
+		}
+
+		for x := 0; x < 3; x++ {
+			for y := 0; y < 2; y++ {
+				viewed := tc.viewedAt(x, y)
+				assert.Equal(t, color.RGBAModel.Convert(src.At(x, y)), color.RGBAModel.Convert(oriented.At(viewed.X, viewed.Y)),
+					"orientation %d pixel %d,%d", tc.orientation, x, y)
+			}
+		}
+	}
+}
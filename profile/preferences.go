@@ -0,0 +1,87 @@
+package profile
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"muzz/httpresponse"
+	"muzz/middleware"
+	"muzz/user"
+	"net/http"
+)
+
+type PreferencesHandlerDeps struct {
+	DB *sql.DB
+
+	// optional, called after a user changes their preferences
+	PreferencesChanged func(userID int)
+}
+
+// returns who the logged in user wants to see in discover
+func GetPreferencesHandler(deps PreferencesHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		preferences, err := user.GetPreferences(deps.DB, claims.UserID)
+		if err != nil {
+			slog.Error("failed to get preferences", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to get preferences"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(preferences)
+	}
+}
+
+// replaces who the logged in user wants to see in discover, fields which are left out or null have no limit
+func UpdatePreferencesHandler(deps PreferencesHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		var preferences user.Preferences
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&preferences); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if err := preferences.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		if err := user.SavePreferences(deps.DB, claims.UserID, preferences); err != nil {
+			slog.Error("failed to save preferences", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to save preferences"})
+			return
+		}
+
+		if deps.PreferencesChanged != nil {
+			deps.PreferencesChanged(claims.UserID)
+		}
+
+		if preferences.Genders == nil {
+			preferences.Genders = []string{}
+		}
+		json.NewEncoder(w).Encode(preferences)
+	}
+}
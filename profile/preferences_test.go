@@ -0,0 +1,69 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"muzz/auth"
+	"muzz/middleware"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferences(t *testing.T) {
+	db := newTestDB(t)
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deps := PreferencesHandlerDeps{DB: db}
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID})
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		GetPreferencesHandler(deps).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/me/preferences", nil).WithContext(ctx))
+		return rr
+	}
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		UpdatePreferencesHandler(deps).ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/user/me/preferences", bytes.NewBufferString(body)).WithContext(ctx))
+		return rr
+	}
+
+	rr := get()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"genders": [], "min_age": null, "max_age": null, "max_distance_km": null}`, rr.Body.String(), "no limits until preferences are saved")
+
+	invalid := []string{
+		`{"genders": ["robot"]}`,
+		`{"genders": ["female", "female"]}`,
+		`{"min_age": 17}`,
+		`{"max_age": 121}`,
+		`{"min_age": 30, "max_age": 25}`,
+		`{"max_distance_km": 0}`,
+		`{"max_distance_km": 50000}`,
+		`{"unknown": true}`,
+	}
+	for _, body := range invalid {
+		assert.Equal(t, http.StatusBadRequest, put(body).Code, body)
+	}
+
+	rr = put(`{"genders": ["female", "non-binary"], "min_age": 25, "max_age": 35, "max_distance_km": 50}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = get()
+	assert.JSONEq(t, `{"genders": ["female", "non-binary"], "min_age": 25, "max_age": 35, "max_distance_km": 50}`, rr.Body.String())
+
+	// fields left out are cleared
+	rr = put(`{"genders": ["male"]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = get()
+	assert.JSONEq(t, `{"genders": ["male"], "min_age": null, "max_age": null, "max_distance_km": null}`, rr.Body.String())
+}
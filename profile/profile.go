@@ -0,0 +1,274 @@
+package profile
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"muzz/httpresponse"
+	"muzz/middleware"
+	"muzz/user"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON response for the logged in user's own profile
+type MyProfileResponse struct {
+	ID            int           `json:"id"`
+	Email         string        `json:"email"`
+	Name          string        `json:"name"`
+	Gender        string        `json:"gender"`
+	DOB           string        `json:"dob"`
+	Age           int           `json:"age"`
+	Location      user.Location `json:"location"`
+	EmailVerified bool          `json:"email_verified"`
+	// pass back in the If-Match header when updating the profile
+	Version int `json:"version"`
+}
+
+// The JSON response for another user's profile, it only has what is safe to show to anyone
+type PublicProfileResponse struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Gender string `json:"gender"`
+	Age    int    `json:"age"`
+}
+
+type ProfileHandlerDeps struct {
+	DB *sql.DB
+
+	// when set, users who haven't verified their email can't be viewed by other users
+	RequireVerifiedEmail bool
+
+	// optional, called after a user changes their gender, dob or location
+	MatchingChanged func(userID int)
+
+	// for managing the time yourself - in most cases you wont need to use this
+	// mainly for testing
+	Clock func() time.Time
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (c *ProfileHandlerDeps) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock()
+}
+
+// the ETag for a version of the profile
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parses the version out of an If-Match header, weak tags are accepted
+func versionFromIfMatch(header string) (int, error) {
+	tag := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	return strconv.Atoi(strings.Trim(tag, `"`))
+}
+
+func toMyProfileResponse(p user.Profile, now time.Time) MyProfileResponse {
+	response := MyProfileResponse{
+		ID:            p.ID,
+		Email:         p.Email,
+		Name:          p.Name,
+		Gender:        p.Gender,
+		DOB:           p.DOB,
+		Location:      user.Location{Lat: p.Location.Lat, Long: p.Location.Long},
+		EmailVerified: p.EmailVerified,
+		Version:       p.Version,
+	}
+
+	// users created before registration was validated might not have a dob
+	if age, err := user.CalculateAge(p.DOB, now); err == nil {
+		response.Age = age
+	}
+
+	return response
+}
+
+// returns the logged in user's profile, the ETag header holds the version to update it with
+func GetMyProfileHandler(deps ProfileHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		p, err := user.GetProfile(deps.DB, claims.UserID)
+		if err != nil {
+			if errors.Is(err, user.ErrUserNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "User not found"})
+				return
+			}
+			slog.Error("failed to get profile", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to get profile"})
+			return
+		}
+
+		w.Header().Set("ETag", etag(p.Version))
+		json.NewEncoder(w).Encode(toMyProfileResponse(p, deps.now()))
+	}
+}
+
+// Request body for the UpdateMyProfileHandler, only the fields given are changed
+type UpdateProfileRequest struct {
+	Name     *string        `json:"name"`
+	Gender   *string        `json:"gender"`
+	DOB      *string        `json:"dob"`
+	Location *user.Location `json:"location"`
+}
+
+// returns the first problem with the request, or nil if it is valid
+func (r UpdateProfileRequest) validate(now time.Time) error {
+	if r.Name == nil && r.Gender == nil && r.DOB == nil && r.Location == nil {
+		return errors.New("nothing to update")
+	}
+	if r.Name != nil {
+		if err := user.ValidateName(*r.Name); err != nil {
+			return err
+		}
+	}
+	if r.Gender != nil {
+		if err := user.ValidateGender(*r.Gender); err != nil {
+			return err
+		}
+	}
+	if r.DOB != nil {
+		if err := user.ValidateDOB(*r.DOB, now); err != nil {
+			return err
+		}
+	}
+	if r.Location != nil {
+		if err := user.ValidateLocation(r.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partially updates the logged in user's profile
+// the If-Match header must hold the ETag from when the profile was read, if it has changed since the update is rejected with 412
+func UpdateMyProfileHandler(deps ProfileHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		claims, found := middleware.GetClaimsFromContext(r.Context())
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Unauthenticated"})
+			return
+		}
+
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "If-Match header is required"})
+			return
+		}
+
+		version, err := versionFromIfMatch(ifMatch)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "If-Match header must be the ETag of the profile"})
+			return
+		}
+
+		var req UpdateProfileRequest
+		decoder := json.NewDecoder(r.Body)
+		// e.g. the email can't be changed here
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			req.Name = &name
+		}
+
+		now := deps.now()
+
+		if err := req.validate(now); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		update := user.ProfileUpdate{Name: req.Name, Gender: req.Gender, DOB: req.DOB}
+		if req.Location != nil {
+			update.Location = &user.GeoLocation{Lat: req.Location.Lat, Long: req.Location.Long}
+		}
+
+		p, err := user.UpdateProfile(deps.DB, claims.UserID, version, update)
+		if err != nil {
+			switch {
+			case errors.Is(err, user.ErrVersionMismatch):
+				w.WriteHeader(http.StatusPreconditionFailed)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Profile has been changed, get the latest version and try again"})
+			case errors.Is(err, user.ErrUserNotFound):
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "User not found"})
+			default:
+				slog.Error("failed to update profile", slog.Any("error", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to update profile"})
+			}
+			return
+		}
+
+		// a new name doesn't change who the user matches with
+		if deps.MatchingChanged != nil && (req.Gender != nil || req.DOB != nil || req.Location != nil) {
+			deps.MatchingChanged(claims.UserID)
+		}
+
+		w.Header().Set("ETag", etag(p.Version))
+		json.NewEncoder(w).Encode(toMyProfileResponse(p, now))
+	}
+}
+
+// returns what other users can see of a user's profile, using the `id` path value
+func GetPublicProfileHandler(deps ProfileHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "User ID must be a number"})
+			return
+		}
+
+		p, err := user.GetProfile(deps.DB, userID)
+		if err != nil && !errors.Is(err, user.ErrUserNotFound) {
+			slog.Error("failed to get profile", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Failed to get profile"})
+			return
+		}
+
+		if err != nil || (deps.RequireVerifiedEmail && !p.EmailVerified) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "User not found"})
+			return
+		}
+
+		response := PublicProfileResponse{ID: p.ID, Name: p.Name, Gender: p.Gender}
+		if age, err := user.CalculateAge(p.DOB, deps.now()); err == nil {
+			response.Age = age
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
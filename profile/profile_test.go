@@ -0,0 +1,141 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"muzz/auth"
+	"muzz/middleware"
+	"muzz/store"
+	"muzz/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMyProfile(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 06, 20, 0, 0, 0, 0, time.UTC)
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123", Name: "Test", Gender: "female", DOB: "2000-01-01", Location: user.GeoLocation{Lat: 51.5, Long: -0.12}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deps := ProfileHandlerDeps{DB: db, Clock: func() time.Time { return now }}
+	get := GetMyProfileHandler(deps)
+	patch := UpdateMyProfileHandler(deps)
+	ctx := middleware.SetClaimsOnContext(context.Background(), auth.JWTClaims{UserID: userID})
+
+	update := func(ifMatch string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/user/me", bytes.NewBufferString(body)).WithContext(ctx)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		patch.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := httptest.NewRecorder()
+	get.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/me", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+
+	var me MyProfileResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &me); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MyProfileResponse{ID: userID, Email: "test@example.com", Name: "Test", Gender: "female", DOB: "2000-01-01", Age: 24, Location: user.Location{Lat: 51.5, Long: -0.12}, Version: 1}, me)
+
+	rr = update("", `{"name": "New name"}`)
+	assert.Equal(t, http.StatusPreconditionRequired, rr.Code)
+
+	rr = update(`"1"`, `{"gender": "robot"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = update(`"1"`, `{"dob": "2010-01-01"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = update(`"1"`, `{"email": "new@example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "email can't be changed")
+
+	rr = update(`"1"`, `{}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = update(`"1"`, `{"name": "New name", "location": {"lat": 48.85, "lng": 2.35}}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	me = MyProfileResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &me); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "New name", me.Name)
+	assert.Equal(t, "female", me.Gender, "fields not given are left alone")
+	assert.Equal(t, user.Location{Lat: 48.85, Long: 2.35}, me.Location)
+	assert.Equal(t, 2, me.Version)
+
+	// someone else updated the profile after this version was read
+	rr = update(`"1"`, `{"name": "Stale"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+
+	p, err := user.GetProfile(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "New name", p.Name)
+}
+
+func TestPublicProfile(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 06, 20, 0, 0, 0, 0, time.UTC)
+
+	userID, err := user.InsertUser(db, user.User{Email: "test@example.com", Password: "password123", Name: "Test", Gender: "female", DOB: "2000-01-01", Location: user.GeoLocation{Lat: 51.5, Long: -0.12}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(deps ProfileHandlerDeps, id string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /user/{id}", GetPublicProfileHandler(deps))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/"+id, nil))
+		return rr
+	}
+
+	deps := ProfileHandlerDeps{DB: db, Clock: func() time.Time { return now }}
+
+	rr := get(deps, "1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"id": 1, "name": "Test", "gender": "female", "age": 24}`, rr.Body.String(), "only the safe fields should be returned")
+
+	assert.Equal(t, http.StatusNotFound, get(deps, "2").Code)
+	assert.Equal(t, http.StatusBadRequest, get(deps, "abc").Code)
+
+	deps.RequireVerifiedEmail = true
+	assert.Equal(t, http.StatusNotFound, get(deps, "1").Code, "unverified users are hidden")
+
+	if err := user.MarkEmailVerified(db, userID, now); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, get(deps, "1").Code)
+}
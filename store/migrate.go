@@ -0,0 +1,53 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// a column added to a table after it was first created, CREATE TABLE IF NOT EXISTS leaves existing tables as they are
+// so the column has to be added to databases created before it existed
+type addedColumn struct {
+	table string
+	name  string
+	// everything after the column name in ALTER TABLE ... ADD COLUMN, NOT NULL columns need a default
+	definition string
+}
+
+// every column which has been added to a table since it was first released, in the order they were added
+var addedColumns = []addedColumn{
+	{table: "users", name: "is_admin", definition: "BOOLEAN NOT NULL DEFAULT 0"},
+	{table: "users", name: "email_verified_at", definition: "INTEGER"},
+	{table: "users", name: "version", definition: "INTEGER NOT NULL DEFAULT 1"},
+	// run cmd/recompute-ratings after these are added to rate the swipes made before them
+	{table: "users", name: "rating", definition: "REAL NOT NULL DEFAULT 1500"},
+	{table: "swipes", name: "target_rating", definition: "REAL"},
+}
+
+// Migrate creates any tables which don't exist yet and adds the columns missing from tables created by an older
+// version, it is safe to run on every start up
+func Migrate(db *sql.DB) error {
+	if _, err := db.Exec(SchemaSQL); err != nil {
+		return err
+	}
+
+	for _, c := range addedColumns {
+		exists, err := hasColumn(db, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+	return nil
+}
+
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the users and swipes tables as they were first released
+	if _, err := db.Exec(`
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT UNIQUE,
+		password TEXT,
+		name TEXT,
+		gender TEXT,
+		dob TEXT,
+		lat REAL DEFAULT 0,
+		lng REAL DEFAULT 0
+	);
+	CREATE TABLE swipes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		swiper INTEGER REFERENCES users(id),
+		swipe_target INTEGER REFERENCES users(id),
+		liked BOOLEAN,
+		UNIQUE(swiper, swipe_target)
+	);
+	INSERT INTO users (email, name) VALUES ('alice@example.com', 'Alice');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	// running it again doesn't try to add the columns twice
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range addedColumns {
+		exists, err := hasColumn(db, c.table, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, exists, "%s.%s", c.table, c.name)
+	}
+
+	// existing rows get the defaults
+	var isAdmin bool
+	var version int
+	if err := db.QueryRow("SELECT is_admin, version FROM users WHERE email = 'alice@example.com'").Scan(&isAdmin, &version); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, isAdmin)
+	assert.Equal(t, 1, version)
+}
@@ -6,9 +6,20 @@ CREATE TABLE IF NOT EXISTS users (
 	gender TEXT,
 	dob TEXT,
 	lat REAL DEFAULT 0,
-	lng REAL DEFAULT 0
+	lng REAL DEFAULT 0,
+	-- admins can access the /admin endpoints
+	is_admin BOOLEAN NOT NULL DEFAULT 0,
+	-- unix timestamp of when the user proved they own the email, null until then
+	email_verified_at INTEGER,
+	-- incremented on every profile update so concurrent edits can be detected
+	version INTEGER NOT NULL DEFAULT 1,
+	-- Elo style desirability, updated whenever someone swipes on the user
+	rating REAL NOT NULL DEFAULT 1500
 );
 
+-- emails are looked up ignoring case as emails stored before they were normalized may not be lower case
+CREATE INDEX IF NOT EXISTS users_email_lower ON users(LOWER(email));
+
 -- stores the user's swipes
 CREATE TABLE IF NOT EXISTS swipes (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -17,9 +28,45 @@ CREATE TABLE IF NOT EXISTS swipes (
 	-- the person getting 'swiped' on
     swipe_target INTEGER REFERENCES users(id),
 	liked BOOLEAN,
+	-- the swipe_target's rating after this swipe, null until it has been rated
+	target_rating REAL,
 	UNIQUE(swiper, swipe_target)
 );
 
+-- used to count the likes a user has received
+CREATE INDEX IF NOT EXISTS swipes_target ON swipes(swipe_target, liked);
+
+-- each time a profile was shown to someone in discover, used to measure exposure and find profiles to explore
+CREATE TABLE IF NOT EXISTS impressions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- the person discover was shown to
+	viewer_id INTEGER REFERENCES users(id),
+	-- the person they were shown
+	profile_id INTEGER REFERENCES users(id),
+	-- unix timestamp
+	shown_at INTEGER NOT NULL
+);
+
+-- used to count how many times a profile has been shown
+CREATE INDEX IF NOT EXISTS impressions_profile ON impressions(profile_id, id);
+
+-- users who have been shown an experiment variant's discover ranking
+CREATE TABLE IF NOT EXISTS experiment_exposures (
+	experiment TEXT NOT NULL,
+	variant TEXT NOT NULL,
+	user_id INTEGER REFERENCES users(id),
+	-- unix timestamp of the first time they were shown it
+	exposed_at INTEGER NOT NULL,
+	PRIMARY KEY (experiment, variant, user_id)
+);
+
+-- swipes made by users in an experiment variant, used to compare the variants' like and match rates
+CREATE TABLE IF NOT EXISTS experiment_swipes (
+	swipe_id INTEGER PRIMARY KEY REFERENCES swipes(id),
+	experiment TEXT NOT NULL,
+	variant TEXT NOT NULL
+);
+
 -- stores matches between 2 users
 CREATE TABLE IF NOT EXISTS matches (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -53,3 +100,152 @@ BEGIN
         AND liked = 1
     );
 END;
+
+-- opaque refresh tokens used to renew short lived access tokens
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER REFERENCES users(id),
+	-- every token rotated from the same login shares a family, reusing a token revokes the whole family
+	family TEXT NOT NULL,
+	-- sha256 of the token, the token itself is never stored
+	token_hash TEXT UNIQUE NOT NULL,
+	-- unix timestamps
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER,
+	revoked_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens(family);
+
+-- access tokens which were revoked before they expired e.g. on logout
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	-- the jti claim of the revoked token
+	jti TEXT PRIMARY KEY,
+	-- unix timestamp, the row can be removed once the token has expired anyway
+	expires_at INTEGER NOT NULL
+);
+
+-- every token issued to the user at or before revoked_before is rejected e.g. when the user is banned
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id),
+	-- unix timestamp
+	revoked_before INTEGER NOT NULL
+);
+
+-- failed login attempts, used to slow down and lock out brute force attacks
+CREATE TABLE IF NOT EXISTS login_attempts (
+	-- either 'email:<email>' or 'ip:<client address>'
+	key TEXT PRIMARY KEY,
+	-- consecutive failures since the last successful login
+	failures INTEGER NOT NULL,
+	-- unix timestamps
+	last_failure_at INTEGER NOT NULL,
+	-- further attempts are rejected until this time
+	locked_until INTEGER
+);
+
+-- single use tokens e.g. for resetting a password
+CREATE TABLE IF NOT EXISTS one_time_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER REFERENCES users(id),
+	-- what the token can be used for e.g. 'password_reset' or 'email_verification'
+	purpose TEXT NOT NULL,
+	-- sha256 of the token, the token itself is never stored
+	token_hash TEXT UNIQUE NOT NULL,
+	-- unix timestamps
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER
+);
+
+-- TOTP secrets for users who have set up two factor authentication
+CREATE TABLE IF NOT EXISTS mfa_secrets (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id),
+	-- base32 encoded shared secret
+	secret TEXT NOT NULL,
+	-- unix timestamp, null until the user confirms they can generate codes
+	enabled_at INTEGER,
+	-- the last time step a code was accepted for, stops codes being replayed
+	last_used_step INTEGER NOT NULL DEFAULT 0
+);
+
+-- single use codes to login when the user has lost their authenticator
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER REFERENCES users(id),
+	-- sha256 of the normalised code
+	code_hash TEXT NOT NULL,
+	-- unix timestamp
+	used_at INTEGER
+);
+
+-- photos users have uploaded, the files are in the blob store under '<blob_key>/<size>.jpg'
+CREATE TABLE IF NOT EXISTS photos (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	blob_key TEXT UNIQUE NOT NULL,
+	-- the order the user wants their photos shown in, starting from 0
+	position INTEGER NOT NULL,
+	-- the photo shown in discover results, each user has at most one
+	is_primary BOOLEAN NOT NULL DEFAULT 0,
+	-- unix timestamp
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS photos_user_id ON photos(user_id, position);
+CREATE UNIQUE INDEX IF NOT EXISTS photos_primary ON photos(user_id) WHERE is_primary;
+
+-- who the user wants to see in discover, a null column means no limit
+CREATE TABLE IF NOT EXISTS preferences (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id),
+	-- JSON array of genders e.g. '["female","non-binary"]', empty means every gender
+	genders TEXT NOT NULL DEFAULT '[]',
+	min_age INTEGER,
+	max_age INTEGER,
+	max_distance_km REAL
+);
+
+-- spatial index of where users are so discover only has to look at users near the viewer
+-- kept in sync with the users table by the triggers below
+CREATE VIRTUAL TABLE IF NOT EXISTS users_geo USING rtree(id, min_lat, max_lat, min_lng, max_lng);
+
+CREATE TRIGGER IF NOT EXISTS users_geo_insert
+AFTER INSERT ON users
+BEGIN
+	INSERT INTO users_geo (id, min_lat, max_lat, min_lng, max_lng) VALUES (NEW.id, NEW.lat, NEW.lat, NEW.lng, NEW.lng);
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_geo_update
+AFTER UPDATE OF lat, lng ON users
+BEGIN
+	UPDATE users_geo SET min_lat = NEW.lat, max_lat = NEW.lat, min_lng = NEW.lng, max_lng = NEW.lng WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_geo_delete
+AFTER DELETE ON users
+BEGIN
+	DELETE FROM users_geo WHERE id = OLD.id;
+END;
+
+-- adds users who were created before the index existed
+INSERT INTO users_geo (id, min_lat, max_lat, min_lng, max_lng)
+SELECT id, lat, lat, lng, lng FROM users WHERE id NOT IN (SELECT id FROM users_geo);
+
+-- each time the recommender runs it stores a new build of everyone's recommendations
+CREATE TABLE IF NOT EXISTS recommendation_builds (
+	build INTEGER PRIMARY KEY,
+	-- unix timestamp
+	built_at INTEGER NOT NULL
+);
+
+-- people each user might like because people who liked the same people as them liked them too
+-- older builds are kept while discover cursors can still refer to them so pages keep the same ranking
+CREATE TABLE IF NOT EXISTS recommendations (
+	build INTEGER NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	candidate_id INTEGER NOT NULL REFERENCES users(id),
+	-- higher is a stronger recommendation
+	score REAL NOT NULL,
+	PRIMARY KEY (build, user_id, candidate_id)
+);
@@ -0,0 +1,15 @@
+package user
+
+import (
+	"database/sql"
+)
+
+// reports whether the user is an admin, unknown users aren't admins
+func IsAdmin(db *sql.DB, userID int) (bool, error) {
+	var isAdmin bool
+	err := db.QueryRow("SELECT is_admin FROM users WHERE id = ?", userID).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return isAdmin, err
+}
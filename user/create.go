@@ -2,17 +2,16 @@ package user
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log/slog"
-	"muzz/httpresponse"
-	"net/http"
 	"time"
 
-	"github.com/go-faker/faker/v4"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mattn/go-sqlite3"
 )
 
+// ErrEmailTaken is returned when storing a user whose email is already registered
+var ErrEmailTaken = errors.New("email is already registered")
+
 // User represents the data stored in the user table
 type User struct {
 	ID       int
@@ -29,127 +28,115 @@ type GeoLocation struct {
 	Long float64
 }
 
-// createUserResult is the data returned to the client upon successful creation of the user
-type createUserResult struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Name     string `json:"name"`
-	Gender   string `json:"gender"`
-	Age      int    `json:"age"`
+// calculates age in whole years from a dob, the age goes up on the user's birthday
+func CalculateAge(dob string, now time.Time) (int, error) {
+	t, err := time.Parse(dobLayout, dob)
+	if err != nil {
+		return 0, err
+	}
+	age := now.Year() - t.Year()
+	if now.Month() < t.Month() || (now.Month() == t.Month() && now.Day() < t.Day()) {
+		age--
+	}
+	return age, nil
 }
 
-// CreateUserResponse is the data returned to the client when creating a new user
-type CreateUserResponse struct {
-	Result createUserResult `json:"result"`
+// LatestDOB is the latest dob someone can have and still be at least age years old on now, in the same format as the
+// users table so it can be compared against in queries
+func LatestDOB(age int, now time.Time) string {
+	dob := time.Date(now.Year()-age, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// the 29th of February becomes the 28th rather than rolling over into March
+	if dob.Month() != now.Month() {
+		dob = dob.AddDate(0, 0, -dob.Day())
+	}
+	return dob.Format(dobLayout)
 }
 
-type CreateUserHandlerDeps struct {
-	// db to save the user to
-	DB *sql.DB
-
-	// for managing the time yourself - in most cases you wont need to use this
-	// mainly for testing
-	Clock func() time.Time
+// Stores a user in the sqlite db
+func StoreUser(db *sql.DB, user User) error {
+	_, err := InsertUser(db, user)
+	return err
 }
 
-// now is a time generator that falls back to std lib if clock is not specified
-func (c *CreateUserHandlerDeps) now() time.Time {
-	if c.Clock == nil {
-		return time.Now()
+// Stores a user in the sqlite db and returns the ID of the new user
+func InsertUser(db *sql.DB, user User) (int, error) {
+
+	if db == nil {
+		return 0, fmt.Errorf("no database provided")
 	}
-	return c.Clock()
-}
 
-// Creates a random user
-func CreateUserHandler(deps CreateUserHandlerDeps) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		randomUser := generateRandomUser()
-		err := StoreUser(deps.DB, randomUser)
-		if err != nil {
-			slog.Error("failed to create user", slog.Any("error", err))
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to create user"})
-			return
-		}
-
-		createUserResult, err := convertToCreateUserResult(randomUser, deps.now())
-
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to create user"})
-		}
-
-		response := CreateUserResponse{Result: createUserResult}
-
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(response)
+	hashedPassword, err := HashPassword(user.Password)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save user, password couldnt be salted %w", err)
 	}
-}
 
-func convertToCreateUserResult(user User, now time.Time) (createUserResult, error) {
-	age, err := CalculateAge(user.DOB, now)
+	email := NormalizeEmail(user.Email)
 
+	// the unique constraint only catches emails with the same case, emails stored before they were normalized may not
+	// be lower case
+	result, err := db.Exec(`INSERT INTO users (email, password, name, gender, dob, lat, lng)
+	SELECT ?, ?, ?, ?, ?, ?, ?
+	WHERE NOT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = ?)`,
+		email, hashedPassword, user.Name, user.Gender, user.DOB, user.Location.Lat, user.Location.Long, email)
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return 0, ErrEmailTaken
+	}
 	if err != nil {
-		return createUserResult{}, err
+		return 0, err
 	}
 
-	return createUserResult{
-		ID:       user.ID,
-		Email:    user.Email,
-		Password: user.Password,
-		Name:     user.Name,
-		Gender:   user.Gender,
-		Age:      age,
-	}, nil
-}
-
-// calculates age from a dob
-func CalculateAge(dob string, now time.Time) (int, error) {
-	layout := "2006-01-02"
-	t, err := time.Parse(layout, dob)
+	inserted, err := result.RowsAffected()
 	if err != nil {
 		return 0, err
 	}
-	age := now.Sub(t).Hours() / 24 / 365
-	return int(age), nil
-}
+	if inserted == 0 {
+		return 0, ErrEmailTaken
+	}
 
-func generateRandomUser() User {
-	user := User{
-		Email:    faker.Email(),
-		Password: faker.Password(),
-		Name:     faker.Name(),
-		Gender:   faker.Gender(),
-		DOB:      faker.Date(),
-		Location: GeoLocation{
-			Lat:  faker.Latitude(),
-			Long: faker.Longitude(),
-		},
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
 	}
 
-	return user
+	return int(id), nil
 }
 
-// Stores a user in the sqlite db
-func StoreUser(db *sql.DB, user User) error {
+// hashes the password with the DefaultPasswordHasher so it can be stored
+func HashPassword(password string) (string, error) {
+	return DefaultPasswordHasher.Hash(password)
+}
 
-	if db == nil {
-		return fmt.Errorf("no database provided")
+// replaces the user's password with the new password
+func UpdatePassword(db *sql.DB, userID int, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to update password, password couldnt be salted %w", err)
 	}
 
-	// bcrypt salts the password for us
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	return UpdatePasswordHash(db, userID, hashedPassword)
+}
+
+// Executor is satisfied by both *sql.DB and *sql.Tx
+type Executor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// replaces the user's stored password hash, the hash must come from a PasswordHasher
+func UpdatePasswordHash(db Executor, userID int, hashedPassword string) error {
+	result, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID)
 	if err != nil {
-		return fmt.Errorf("failed to save user, password couldnt be salted %w", err)
+		return err
 	}
 
-	_, err = db.Exec("INSERT INTO users (email, password, name, gender, dob, lat, lng) VALUES (?, ?, ?, ?, ?, ?, ?)", user.Email, hashedPassword, user.Name, user.Gender, user.DOB, user.Location.Lat, user.Location.Long)
-
+	updated, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if updated == 0 {
+		return fmt.Errorf("user with ID %d not found", userID)
+	}
 
 	return nil
 }
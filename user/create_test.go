@@ -1,67 +1,10 @@
 package user
 
 import (
-	"database/sql"
-	"encoding/json"
-	"muzz/store"
-	"net/http"
-	"net/http/httptest"
-	"os"
 	"testing"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-func TestCreateUserHandler(t *testing.T) {
-	db, err := sql.Open("sqlite3", "./test.db")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer db.Close()
-	defer os.Remove("./test.db")
-
-	if _, err := db.Exec(store.SchemaSQL); err != nil {
-		t.Fatal(err)
-	}
-
-	req, err := http.NewRequest("GET", "/user/create", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CreateUserHandler(CreateUserHandlerDeps{DB: db}))
-
-	handler.ServeHTTP(rr, req)
-	wantStatus := http.StatusCreated
-
-	if status := rr.Code; status != wantStatus {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, wantStatus)
-	}
-
-	expectedContentType := "application/json"
-	if contentType := rr.Header().Get("Content-Type"); contentType != expectedContentType {
-		t.Errorf("handler returned unexpected content type: got %v want %v",
-			contentType, expectedContentType)
-	}
-
-	var response CreateUserResponse
-
-	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
-		t.Errorf("error parsing response body: %v", err)
-	}
-
-	if response.Result.Email == "" ||
-		response.Result.Password == "" ||
-		response.Result.Name == "" ||
-		response.Result.Gender == "" ||
-		response.Result.Age == 0 {
-		t.Errorf("handler returned incomplete user data: %v", response)
-	}
-}
-
 func TestCalculateAge(t *testing.T) {
 	type args struct {
 		dob string
@@ -82,6 +25,32 @@ func TestCalculateAge(t *testing.T) {
 			want:    24,
 			wantErr: false,
 		},
+		{
+			name: "calculate 1990-04-02 as 33 the day before their birthday",
+			args: args{
+				dob: "1990-04-02",
+				now: time.Date(2024, 04, 01, 0, 0, 0, 0, time.UTC),
+			},
+			want:    33,
+			wantErr: false,
+		},
+		{
+			name: "calculate 1990-04-02 as 34 on their birthday",
+			args: args{
+				dob: "1990-04-02",
+				now: time.Date(2024, 04, 02, 0, 0, 0, 0, time.UTC),
+			},
+			want:    34,
+			wantErr: false,
+		},
+		{
+			name: "invalid dob",
+			args: args{
+				dob: "02/04/1990",
+				now: time.Date(2024, 04, 02, 0, 0, 0, 0, time.UTC),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -96,3 +65,41 @@ func TestCalculateAge(t *testing.T) {
 		})
 	}
 }
+
+func TestLatestDOB(t *testing.T) {
+	tests := []struct {
+		name string
+		age  int
+		now  time.Time
+		want string
+	}{
+		{
+			name: "same day age years ago",
+			age:  18,
+			now:  time.Date(2024, 04, 01, 12, 0, 0, 0, time.UTC),
+			want: "2006-04-01",
+		},
+		{
+			name: "leap day becomes the 28th of February",
+			age:  19,
+			now:  time.Date(2024, 02, 29, 0, 0, 0, 0, time.UTC),
+			want: "2005-02-28",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LatestDOB(tt.age, tt.now)
+			if got != tt.want {
+				t.Errorf("LatestDOB() = %v, want %v", got, tt.want)
+			}
+
+			age, err := CalculateAge(got, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if age != tt.age {
+				t.Errorf("CalculateAge(LatestDOB()) = %v, want %v", age, tt.age)
+			}
+		})
+	}
+}
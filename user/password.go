@@ -0,0 +1,171 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUnknownPasswordHash = errors.New("unknown password hash format")
+	errInvalidPasswordHash = errors.New("invalid password hash")
+)
+
+// PasswordHasher hashes passwords so they can be stored and checks passwords against stored hashes
+type PasswordHasher interface {
+	// hashes the password, the result includes everything needed to verify it later
+	Hash(password string) (string, error)
+	// reports whether the password matches the hash and whether the hash is out of date and should be replaced
+	Verify(password string, encodedHash string) (match bool, needsRehash bool, err error)
+}
+
+// DefaultPasswordHasher is used whenever a password is stored or checked
+var DefaultPasswordHasher PasswordHasher = Argon2idHasher{Params: DefaultArgon2idParams}
+
+// Argon2idParams are the tunable costs of argon2id, see RFC 9106 for recommendations
+type Argon2idParams struct {
+	// memory used in KiB
+	Memory uint32
+	// number of passes over the memory
+	Iterations uint32
+	// number of threads used
+	Parallelism uint8
+	// length of the random salt in bytes
+	SaltLength uint32
+	// length of the generated key in bytes
+	KeyLength uint32
+}
+
+// DefaultArgon2idParams follows the OWASP recommendation of 64MiB with 3 iterations
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (p Argon2idParams) validate() error {
+	if p.Memory < 8*uint32(p.Parallelism) {
+		return errors.New("argon2id memory must be at least 8KiB per thread")
+	}
+	if p.Iterations < 1 {
+		return errors.New("argon2id needs at least one iteration")
+	}
+	if p.Parallelism < 1 {
+		return errors.New("argon2id needs at least one thread")
+	}
+	if p.SaltLength < 8 {
+		return errors.New("argon2id salt must be at least 8 bytes")
+	}
+	if p.KeyLength < 16 {
+		return errors.New("argon2id key must be at least 16 bytes")
+	}
+	return nil
+}
+
+// Argon2idHasher hashes passwords with argon2id using the PHC string format e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// bcrypt hashes from before argon2id was introduced are still verified but always need rehashing.
+type Argon2idHasher struct {
+	Params Argon2idParams
+}
+
+// Creates a hasher using the given argon2id costs
+func NewArgon2idHasher(params Argon2idParams) (Argon2idHasher, error) {
+	if err := params.validate(); err != nil {
+		return Argon2idHasher{}, err
+	}
+	return Argon2idHasher{Params: params}, nil
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Params.Memory, h.Params.Iterations, h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password string, encodedHash string) (bool, bool, error) {
+	if isBcryptHash(encodedHash) {
+		err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+
+	if !strings.HasPrefix(encodedHash, "$argon2id$") {
+		return false, false, errUnknownPasswordHash
+	}
+
+	version, params, salt, key, err := decodeArgon2idHash(encodedHash)
+	if err != nil {
+		return false, false, err
+	}
+
+	// argon2 only implements the latest version so older hashes can't be checked
+	if version != argon2.Version {
+		return false, false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+
+	return true, params != h.Params, nil
+}
+
+// bcrypt hashes start with the version e.g. $2a$10$
+func isBcryptHash(encodedHash string) bool {
+	return strings.HasPrefix(encodedHash, "$2a$") || strings.HasPrefix(encodedHash, "$2b$") || strings.HasPrefix(encodedHash, "$2y$")
+}
+
+// parses a hash in the PHC string format
+func decodeArgon2idHash(encodedHash string) (version int, params Argon2idParams, salt []byte, key []byte, err error) {
+	// the leading $ gives an empty first part
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 {
+		return 0, params, nil, nil, errInvalidPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return 0, params, nil, nil, errInvalidPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return 0, params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, params, nil, nil, errInvalidPasswordHash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return 0, params, nil, nil, errInvalidPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return version, params, salt, key, nil
+}
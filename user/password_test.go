@@ -0,0 +1,95 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap params so the tests run quickly
+var testArgon2idParams = Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher, err := NewArgon2idHasher(testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hasher.Hash("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+
+	other, err := hasher.Hash("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, hash, other, "hashes should be salted")
+
+	match, needsRehash, err := hasher.Verify("password123", hash)
+	assert.NoError(t, err)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	match, _, err = hasher.Verify("wrong-password", hash)
+	assert.NoError(t, err)
+	assert.False(t, match)
+
+	// raising the cost means existing hashes are out of date
+	stronger := Argon2idHasher{Params: testArgon2idParams}
+	stronger.Params.Iterations = 2
+
+	match, needsRehash, err = stronger.Verify("password123", hash)
+	assert.NoError(t, err)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+}
+
+func TestArgon2idHasherLegacyBcrypt(t *testing.T) {
+	hasher := Argon2idHasher{Params: testArgon2idParams}
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, needsRehash, err := hasher.Verify("password123", string(legacy))
+	assert.NoError(t, err)
+	assert.True(t, match)
+	assert.True(t, needsRehash, "bcrypt hashes should be upgraded")
+
+	match, needsRehash, err = hasher.Verify("wrong-password", string(legacy))
+	assert.NoError(t, err)
+	assert.False(t, match)
+	assert.False(t, needsRehash)
+}
+
+func TestArgon2idHasherInvalidHashes(t *testing.T) {
+	hasher := Argon2idHasher{Params: testArgon2idParams}
+
+	tests := []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=19$m=oops$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$not base64$a2V5",
+	}
+
+	for _, hash := range tests {
+		match, _, err := hasher.Verify("password123", hash)
+		assert.Error(t, err, hash)
+		assert.False(t, match, hash)
+	}
+}
+
+func TestNewArgon2idHasherValidatesParams(t *testing.T) {
+	params := testArgon2idParams
+	params.Iterations = 0
+
+	_, err := NewArgon2idHasher(params)
+	assert.Error(t, err)
+}
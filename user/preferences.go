@@ -0,0 +1,127 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// the oldest age which can be asked for
+const maximumAge = 120
+
+// the furthest distance which can be asked for, roughly half way round the world
+const maxDistanceKm = 20_000
+
+// Preferences are who the user wants to see in discover, nil or empty fields mean no limit
+type Preferences struct {
+	Genders       []string `json:"genders"`
+	MinAge        *int     `json:"min_age"`
+	MaxAge        *int     `json:"max_age"`
+	MaxDistanceKm *float64 `json:"max_distance_km"`
+}
+
+// Validate checks the preferences can be used to find matches
+func (p Preferences) Validate() error {
+	seen := map[string]bool{}
+	for _, gender := range p.Genders {
+		if err := ValidateGender(gender); err != nil {
+			return err
+		}
+		if seen[gender] {
+			return fmt.Errorf("gender %s is given more than once", gender)
+		}
+		seen[gender] = true
+	}
+
+	if p.MinAge != nil {
+		if err := ValidateAge("min_age", *p.MinAge); err != nil {
+			return err
+		}
+	}
+	if p.MaxAge != nil {
+		if err := ValidateAge("max_age", *p.MaxAge); err != nil {
+			return err
+		}
+	}
+	if p.MinAge != nil && p.MaxAge != nil && *p.MinAge > *p.MaxAge {
+		return errors.New("min_age can't be more than max_age")
+	}
+
+	if p.MaxDistanceKm != nil && (*p.MaxDistanceKm <= 0 || *p.MaxDistanceKm > maxDistanceKm) {
+		return fmt.Errorf("max_distance_km must be more than 0 and at most %d", maxDistanceKm)
+	}
+
+	return nil
+}
+
+// ValidateAge checks the age can be searched for, field is the name shown in the error
+func ValidateAge(field string, age int) error {
+	if age < minimumAge || age > maximumAge {
+		return fmt.Errorf("%s must be between %d and %d", field, minimumAge, maximumAge)
+	}
+	return nil
+}
+
+// gets the user's preferences, users who haven't set any have no limits
+func GetPreferences(db *sql.DB, userID int) (Preferences, error) {
+	p, _, err := GetSavedPreferences(db, userID)
+	return p, err
+}
+
+// like GetPreferences but also reports whether the user has ever saved their preferences,
+// so users who chose to have no limit can be told apart from users who haven't chosen yet
+func GetSavedPreferences(db *sql.DB, userID int) (Preferences, bool, error) {
+	var genders string
+	var minAge, maxAge sql.NullInt64
+	var maxDistance sql.NullFloat64
+
+	err := db.QueryRow("SELECT genders, min_age, max_age, max_distance_km FROM preferences WHERE user_id = ?", userID).
+		Scan(&genders, &minAge, &maxAge, &maxDistance)
+	if err == sql.ErrNoRows {
+		return Preferences{Genders: []string{}}, false, nil
+	}
+	if err != nil {
+		return Preferences{}, false, err
+	}
+
+	p := Preferences{Genders: []string{}}
+	if err := json.Unmarshal([]byte(genders), &p.Genders); err != nil {
+		return Preferences{}, false, fmt.Errorf("invalid genders preference for user %d: %w", userID, err)
+	}
+	if minAge.Valid {
+		age := int(minAge.Int64)
+		p.MinAge = &age
+	}
+	if maxAge.Valid {
+		age := int(maxAge.Int64)
+		p.MaxAge = &age
+	}
+	if maxDistance.Valid {
+		p.MaxDistanceKm = &maxDistance.Float64
+	}
+
+	return p, true, nil
+}
+
+// replaces the user's preferences, they should have been validated first
+func SavePreferences(db *sql.DB, userID int, p Preferences) error {
+	genders := p.Genders
+	if genders == nil {
+		genders = []string{}
+	}
+
+	encodedGenders, err := json.Marshal(genders)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO preferences (user_id, genders, min_age, max_age, max_distance_km) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		genders = excluded.genders,
+		min_age = excluded.min_age,
+		max_age = excluded.max_age,
+		max_distance_km = excluded.max_distance_km`,
+		userID, string(encodedGenders), p.MinAge, p.MaxAge, p.MaxDistanceKm)
+	return err
+}
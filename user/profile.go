@@ -0,0 +1,106 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrUserNotFound is returned when there is no user with the given ID
+	ErrUserNotFound = errors.New("user not found")
+	// ErrVersionMismatch is returned when the profile has been changed since the caller last read it
+	ErrVersionMismatch = errors.New("profile has been changed since it was read")
+)
+
+// Profile is everything about a user other than their password
+type Profile struct {
+	ID            int
+	Email         string
+	Name          string
+	Gender        string
+	DOB           string
+	Location      GeoLocation
+	EmailVerified bool
+	// incremented on every update, used to detect concurrent edits
+	Version int
+}
+
+// gets the user's profile, returns ErrUserNotFound if the user doesn't exist
+func GetProfile(db *sql.DB, userID int) (Profile, error) {
+	var p Profile
+	var email, name, gender, dob sql.NullString
+	var verifiedAt sql.NullInt64
+
+	err := db.QueryRow("SELECT id, email, name, gender, dob, lat, lng, email_verified_at, version FROM users WHERE id = ?", userID).
+		Scan(&p.ID, &email, &name, &gender, &dob, &p.Location.Lat, &p.Location.Long, &verifiedAt, &p.Version)
+	if err == sql.ErrNoRows {
+		return Profile{}, ErrUserNotFound
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+
+	p.Email = email.String
+	p.Name = name.String
+	p.Gender = gender.String
+	p.DOB = dob.String
+	p.EmailVerified = verifiedAt.Valid
+
+	return p, nil
+}
+
+// ProfileUpdate holds the fields to change, nil fields are left as they are
+type ProfileUpdate struct {
+	Name     *string
+	Gender   *string
+	DOB      *string
+	Location *GeoLocation
+}
+
+// applies the update if the profile is still at the expected version and returns the updated profile
+// returns ErrVersionMismatch if someone else has updated the profile first
+func UpdateProfile(db *sql.DB, userID int, expectedVersion int, update ProfileUpdate) (Profile, error) {
+	columns := []string{}
+	params := []interface{}{}
+
+	if update.Name != nil {
+		columns = append(columns, "name = ?")
+		params = append(params, *update.Name)
+	}
+	if update.Gender != nil {
+		columns = append(columns, "gender = ?")
+		params = append(params, *update.Gender)
+	}
+	if update.DOB != nil {
+		columns = append(columns, "dob = ?")
+		params = append(params, *update.DOB)
+	}
+	if update.Location != nil {
+		columns = append(columns, "lat = ?", "lng = ?")
+		params = append(params, update.Location.Lat, update.Location.Long)
+	}
+
+	columns = append(columns, "version = version + 1")
+	params = append(params, userID, expectedVersion)
+
+	result, err := db.Exec("UPDATE users SET "+strings.Join(columns, ", ")+" WHERE id = ? AND version = ?", params...)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if updated == 0 {
+		// work out whether the user is missing or the version was stale
+		if _, err := GetProfile(db, userID); err != nil {
+			return Profile{}, err
+		}
+		return Profile{}, ErrVersionMismatch
+	}
+
+	return GetProfile(db, userID)
+}
@@ -0,0 +1,271 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"muzz/httpresponse"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the layout dates of birth are given in
+const dobLayout = "2006-01-02"
+
+// users have to be at least this old to register
+const minimumAge = 18
+
+const (
+	minPasswordLength = 8
+	// stops very long passwords being used to make hashing expensive
+	maxPasswordLength = 128
+	maxNameLength     = 100
+)
+
+// Genders users can register with
+var Genders = []string{"male", "female", "non-binary"}
+
+// reports whether the gender is one of Genders
+func IsValidGender(gender string) bool {
+	for _, g := range Genders {
+		if g == gender {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePassword checks the password is strong enough to be used
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d characters", maxPasswordLength)
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("password must contain a letter and a number")
+	}
+
+	return nil
+}
+
+// NormalizeEmail returns the form emails are stored and looked up in, addresses which only differ by case or
+// surrounding whitespace belong to the same account
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checks the email is a plain address e.g. test@example.com
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	// ParseAddress also accepts display names e.g. "Test <test@example.com>"
+	if err != nil || address.Address != email {
+		return errors.New("email is invalid")
+	}
+	return nil
+}
+
+// ValidateName checks the name can be shown to other users
+func ValidateName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is required")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	}
+	return nil
+}
+
+// ValidateGender checks the gender is one of Genders
+func ValidateGender(gender string) error {
+	if !IsValidGender(gender) {
+		return fmt.Errorf("gender must be one of %s", strings.Join(Genders, ", "))
+	}
+	return nil
+}
+
+// ValidateDOB checks the dob is a real date and the user is old enough to use the app
+func ValidateDOB(dob string, now time.Time) error {
+	t, err := time.Parse(dobLayout, dob)
+	if err != nil {
+		return errors.New("dob must be a date in the format YYYY-MM-DD")
+	}
+	if t.AddDate(minimumAge, 0, 0).After(now) {
+		return fmt.Errorf("you must be at least %d to register", minimumAge)
+	}
+	return nil
+}
+
+// Location of the user, used to find matches near them
+type Location struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"lng"`
+}
+
+// ValidateLocation checks the location is a real coordinate
+func ValidateLocation(location *Location) error {
+	if location == nil {
+		return errors.New("location is required")
+	}
+	if location.Lat < -90 || location.Lat > 90 || location.Long < -180 || location.Long > 180 {
+		return errors.New("location is invalid")
+	}
+	return nil
+}
+
+// Request body for the RegisterHandler
+type RegisterRequest struct {
+	Email    string    `json:"email"`
+	Password string    `json:"password"`
+	Name     string    `json:"name"`
+	Gender   string    `json:"gender"`
+	DOB      string    `json:"dob"`
+	Location *Location `json:"location"`
+}
+
+// returns the first problem with the request, or nil if it is valid
+func (r RegisterRequest) validate(now time.Time) error {
+	if err := validateEmail(r.Email); err != nil {
+		return err
+	}
+	if err := ValidatePassword(r.Password); err != nil {
+		return err
+	}
+	if err := ValidateName(r.Name); err != nil {
+		return err
+	}
+	if err := ValidateGender(r.Gender); err != nil {
+		return err
+	}
+	if err := ValidateDOB(r.DOB, now); err != nil {
+		return err
+	}
+	return ValidateLocation(r.Location)
+}
+
+// registeredUser is the data returned to the client once they have registered, it never includes the password
+type registeredUser struct {
+	ID     int    `json:"id"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+	Gender string `json:"gender"`
+	Age    int    `json:"age"`
+}
+
+// RegisterResponse is the data returned to the client when registering
+type RegisterResponse struct {
+	Result registeredUser `json:"result"`
+}
+
+// Sends an email to the user with a link to verify they own the email address
+type SendVerificationEmail func(ctx context.Context, userID int, email string) error
+
+type RegisterHandlerDeps struct {
+	// db to save the user to
+	DB *sql.DB
+
+	// optional, when set the new user is emailed a link to verify their email
+	SendVerificationEmail
+
+	// optional, called after the user is stored
+	UserCreated func(userID int)
+
+	// for managing the time yourself - in most cases you wont need to use this
+	// mainly for testing
+	Clock func() time.Time
+}
+
+// now is a time generator that falls back to std lib if clock is not specified
+func (c *RegisterHandlerDeps) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock()
+}
+
+// Signs up a new user
+func RegisterHandler(deps RegisterHandlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req RegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Invalid request payload"})
+			return
+		}
+
+		req.Email = NormalizeEmail(req.Email)
+		req.Name = strings.TrimSpace(req.Name)
+
+		now := deps.now()
+
+		if err := req.validate(now); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		newUser := User{
+			Email:    req.Email,
+			Password: req.Password,
+			Name:     req.Name,
+			Gender:   req.Gender,
+			DOB:      req.DOB,
+			Location: GeoLocation{Lat: req.Location.Lat, Long: req.Location.Long},
+		}
+
+		userID, err := InsertUser(deps.DB, newUser)
+		if err != nil {
+			if errors.Is(err, ErrEmailTaken) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "Email is already registered"})
+				return
+			}
+			slog.Error("failed to create user", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(httpresponse.ErrorResponse{Error: "failed to create user"})
+			return
+		}
+
+		if deps.UserCreated != nil {
+			deps.UserCreated(userID)
+		}
+
+		if deps.SendVerificationEmail != nil {
+			// the user can ask for another email so this isn't fatal
+			if err := deps.SendVerificationEmail(r.Context(), userID, newUser.Email); err != nil {
+				slog.Error("failed to send verification email", slog.Any("error", err))
+			}
+		}
+
+		// the dob has already been validated so this can't fail
+		age, _ := CalculateAge(newUser.DOB, now)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(RegisterResponse{Result: registeredUser{
+			ID:     userID,
+			Email:  newUser.Email,
+			Name:   newUser.Name,
+			Gender: newUser.Gender,
+			Age:    age,
+		}})
+	}
+}
@@ -0,0 +1,124 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"muzz/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterHandler(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	verificationsSent := []string{}
+	sendVerificationEmail := func(ctx context.Context, userID int, email string) error {
+		verificationsSent = append(verificationsSent, email)
+		return nil
+	}
+
+	now := time.Date(2024, 06, 20, 0, 0, 0, 0, time.UTC)
+	handler := RegisterHandler(RegisterHandlerDeps{DB: db, SendVerificationEmail: sendVerificationEmail, Clock: func() time.Time { return now }})
+
+	register := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/user/register", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	valid := `{"email": "test@example.com", "password": "password123", "name": "Test User", "gender": "female", "dob": "2000-01-01", "location": {"lat": 51.5, "lng": -0.12}}`
+
+	rr := register(valid)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.NotContains(t, rr.Body.String(), "password123", "the password shouldn't be echoed back")
+
+	var response RegisterResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, registeredUser{ID: 1, Email: "test@example.com", Name: "Test User", Gender: "female", Age: 24}, response.Result)
+	assert.Equal(t, []string{"test@example.com"}, verificationsSent)
+
+	var lat, lng float64
+	if err := db.QueryRow("SELECT lat, lng FROM users WHERE id = 1").Scan(&lat, &lng); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 51.5, lat)
+	assert.Equal(t, -0.12, lng)
+
+	rr = register(valid)
+	assert.Equal(t, http.StatusConflict, rr.Code, "emails can only be registered once")
+
+	rr = register(`{"email": " Test@Example.COM", "password": "password123", "name": "Test User", "gender": "female", "dob": "2000-01-01", "location": {"lat": 51.5, "lng": -0.12}}`)
+	assert.Equal(t, http.StatusConflict, rr.Code, "emails which only differ by case are the same")
+
+	// emails stored before they were normalized can have upper case letters
+	if _, err := db.Exec("INSERT INTO users (email, name) VALUES ('Legacy@Example.com', 'Legacy')"); err != nil {
+		t.Fatal(err)
+	}
+	rr = register(`{"email": "legacy@example.com", "password": "password123", "name": "Test User", "gender": "female", "dob": "2000-01-01", "location": {"lat": 51.5, "lng": -0.12}}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestRegisterHandlerValidation(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(store.SchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 06, 20, 0, 0, 0, 0, time.UTC)
+	handler := RegisterHandler(RegisterHandlerDeps{DB: db, Clock: func() time.Time { return now }})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid json", body: `{`},
+		{name: "missing email", body: `{"password": "password123", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "invalid email", body: `{"email": "not-an-email", "password": "password123", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "email with display name", body: `{"email": "Test <test@example.com>", "password": "password123", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "short password", body: `{"email": "test@example.com", "password": "pass1", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "password without a number", body: `{"email": "test@example.com", "password": "passwordonly", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "missing name", body: `{"email": "test@example.com", "password": "password123", "name": "  ", "gender": "male", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "unknown gender", body: `{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "robot", "dob": "2000-01-01", "location": {"lat": 0, "lng": 0}}`},
+		{name: "invalid dob", body: `{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "male", "dob": "01/01/2000", "location": {"lat": 0, "lng": 0}}`},
+		{name: "under 18", body: `{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "male", "dob": "2006-06-21", "location": {"lat": 0, "lng": 0}}`},
+		{name: "missing location", body: `{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "male", "dob": "2000-01-01"}`},
+		{name: "invalid location", body: `{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "male", "dob": "2000-01-01", "location": {"lat": 91, "lng": 0}}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/user/register", bytes.NewBufferString(tc.body)))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+		})
+	}
+
+	// turning 18 today is old enough
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/user/register", bytes.NewBufferString(
+		`{"email": "test@example.com", "password": "password123", "name": "Test", "gender": "male", "dob": "2006-06-20", "location": {"lat": 0, "lng": 0}}`)))
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+}
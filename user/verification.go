@@ -0,0 +1,35 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// records that the user has proved they own their email address
+func MarkEmailVerified(db Executor, userID int, verifiedAt time.Time) error {
+	result, err := db.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?", verifiedAt.Unix(), userID)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("user with ID %d not found", userID)
+	}
+
+	return nil
+}
+
+// reports whether the user has verified their email address, unknown users aren't verified
+func IsEmailVerified(db *sql.DB, userID int) (bool, error) {
+	var verifiedAt sql.NullInt64
+	err := db.QueryRow("SELECT email_verified_at FROM users WHERE id = ?", userID).Scan(&verifiedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return verifiedAt.Valid, err
+}